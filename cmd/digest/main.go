@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/digest"
+	"github.com/codezombiech/aws-mail-forwarder-test/forwarder"
+)
+
+const (
+	ConfigInvalidOrMissingExitCode = -1
+	LoadingAwsConfigFailedExitCode = -2
+	DigestFailedExitCode           = -3
+)
+
+// Event of a scheduled invocation, e.g. by an EventBridge schedule
+type DigestEvent struct {
+	Force bool `json:"force"`
+}
+
+var (
+	awsConfig    aws.Config
+	configSource config.Source
+)
+
+func HandleRequest(ctx context.Context, event DigestEvent) (*digest.Result, error) {
+	return send(ctx, event.Force)
+}
+
+func send(ctx context.Context, force bool) (*digest.Result, error) {
+	cfg, err := configSource.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := forwarder.NewStorage(cfg, awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if force {
+		log.Print("Forced, digests are sent regardless of the interval")
+	}
+	return digest.NewDigester(cfg, storage, forwarder.NewSender(cfg, awsConfig)).Run(ctx, time.Now(), force)
+}
+
+// Sends a digest of the queued messages to each target whose interval has
+// elapsed (see digest.intervalMinutes).
+//
+// Runs as a Lambda function if deployed as such, otherwise once from the
+// command line. The config is loaded the same way as by the forwarder.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	force := flag.Bool("force", false, "send the digests regardless of the interval")
+	flag.Parse()
+
+	var err error
+	awsConfig, err = awsconfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Printf("Failed to load AWS config: %v", err)
+		os.Exit(LoadingAwsConfigFailedExitCode)
+	}
+
+	configSource, err = config.SourceFromEnv(awsConfig)
+	if err != nil {
+		log.Printf("Failed to create config source: %v", err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		lambda.Start(HandleRequest)
+		return
+	}
+
+	if _, err := send(context.Background(), *force); err != nil {
+		log.Print(err)
+		os.Exit(DigestFailedExitCode)
+	}
+}
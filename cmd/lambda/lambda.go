@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
 	"github.com/codezombiech/aws-mail-forwarder-test/forwarder"
+	"github.com/codezombiech/aws-mail-forwarder-test/ingress"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
 )
 
 const (
@@ -19,52 +26,342 @@ const (
 	LoadingAwsConfigFailedExitCode = -2
 )
 
-var f *forwarder.Forwarder
+// Handler modes, selected by HANDLER_MODE
+const (
+	handlerModeForward     = "forward"     // Forward messages, invoked asynchronously by SES (default)
+	handlerModeDisposition = "disposition" // Return a disposition, invoked synchronously by SES
+)
+
+// Default number of records of an event processed in parallel
+const defaultMaxParallelRecords = 4
+
+var (
+	awsConfig      aws.Config
+	configSource   config.Source
+	currentConfig  *config.ParsedConfig
+	rejectedConfig *config.ParsedConfig // The last config the forwarder could not be created for
+	f              *forwarder.Forwarder
+	st             *storage.Storage
+
+	maxParallelRecords = defaultMaxParallelRecords
+)
+
+// Handler for SES events, S3 ObjectCreated events, and SES or S3 notifications
+// delivered through SNS or SQS (see package ingress).
+//
+// For SQS events, only the SQS messages of records that need a retry are
+// reported as batch item failures, which requires ReportBatchItemFailures in
+// the function response types of the event source mapping. Without it, SQS
+// deletes the whole batch, including the messages to retry.
+func HandleRequest(ctx context.Context, payload json.RawMessage) (*events.SQSEventResponse, error) {
+	if err := refreshForwarder(); err != nil {
+		log.Print(err)
+		return nil, err
+	}
+
+	records, err := ingress.Parse(payload)
+	if err != nil {
+		// Retrying won't help
+		log.Printf("Ignoring event: %v (%s)", err, string(payload))
+		return nil, nil
+	}
+
+	results := processRecords(ctx, records, maxParallelRecords, forwardRecord)
+	logSummary(results)
+
+	if response := batchItemFailures(records, results); response != nil {
+		return response, nil
+	}
+
+	// Records that succeeded are not reprocessed when the event is retried,
+	// as their messages are no longer at the new prefix (see failure.Handled)
+	retry := make([]string, 0)
+	for _, result := range results {
+		if result.Outcome == outcomeRetry {
+			retry = append(retry, result.MessageId)
+		}
+	}
+	if len(retry) > 0 {
+		return nil, fmt.Errorf("%d of %d records need a retry: %v", len(retry), len(results), retry)
+	}
+
+	return nil, nil
+}
+
+// Returns the SQS messages of the records that need a retry, nil if the
+// records were not delivered through SQS
+func batchItemFailures(records []ingress.Record, results []recordResult) *events.SQSEventResponse {
+	if len(records) == 0 || records[0].SQSMessageId == "" {
+		return nil
+	}
+
+	// A SQS message might contain multiple records (e.g. a S3 event)
+	response := &events.SQSEventResponse{BatchItemFailures: make([]events.SQSBatchItemFailure, 0)}
+	seen := make(map[string]bool)
+	for i, result := range results {
+		id := records[i].SQSMessageId
+		if result.Outcome != outcomeRetry || seen[id] {
+			continue
+		}
+		seen[id] = true
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: id})
+	}
 
-func HandleRequest(ctx context.Context, sesEvent events.SimpleEmailEvent) error {
+	if len(response.BatchItemFailures) > 0 {
+		log.Printf("%d SQS messages need a retry", len(response.BatchItemFailures))
+	}
+	return response
+}
+
+// Handler for receipt rules invoking the function synchronously
+// (RequestResponse), see
+// https://docs.aws.amazon.com/ses/latest/dg/receiving-email-action-lambda.html
+//
+// Returns STOP_RULE_SET to drop unwanted messages before they are stored and
+// forwarded, CONTINUE otherwise.
+func HandleDisposition(ctx context.Context, sesEvent events.SimpleEmailEvent) (events.SimpleEmailDisposition, error) {
+	if err := refreshForwarder(); err != nil {
+		// Rather forward unwanted messages than losing wanted ones
+		log.Print(err)
+		return events.SimpleEmailDisposition{Disposition: events.SimpleEmailContinue}, nil
+	}
+
+	// Stop only if all records (there is usually one) should be dropped
+	disposition := events.SimpleEmailStopRuleSet
 	for _, record := range sesEvent.Records {
-		ses := record.SES
+		if f.Disposition(record.SES) == events.SimpleEmailContinue {
+			disposition = events.SimpleEmailContinue
+		}
+	}
+	if len(sesEvent.Records) == 0 {
+		disposition = events.SimpleEmailContinue
+	}
+
+	log.Printf("Disposition: %s", disposition)
+	return events.SimpleEmailDisposition{Disposition: disposition}, nil
+}
+
+// Forward the message of a record
+func forwardRecord(ctx context.Context, record ingress.Record) error {
+	if record.SES != nil {
+		return f.Forward(ctx, *record.SES)
+	}
+	return f.ForwardObject(ctx, record.Bucket, record.Key)
+}
+
+// Outcomes of processing a record
+const (
+	outcomeForwarded    = "forwarded"     // Forwarded (or handled according to the config)
+	outcomeHandled      = "handled"       // Failed, but nothing left to do (e.g. already processed)
+	outcomeDeadLettered = "dead-lettered" // Failed permanently
+	outcomeRetry        = "retry"         // Failed transiently, the event needs to be retried
+)
+
+// Outcome of processing a single record
+type recordResult struct {
+	MessageId string
+	Outcome   string
+	Err       error
+}
+
+// Process the records independently of each other, at most maxParallel at a time
+func processRecords(ctx context.Context, records []ingress.Record, maxParallel int, forward func(context.Context, ingress.Record) error) []recordResult {
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+
+	results := make([]recordResult, len(records))
+	semaphore := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+
+	for i, record := range records {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, record ingress.Record) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			results[i] = processRecord(ctx, record, forward)
+		}(i, record)
+	}
+
+	wg.Wait()
+	return results
+}
 
-		// Print event as JSON for debugging
-		eventJson, err := json.Marshal(record)
-		if err == nil {
-			log.Print(string(eventJson))
+func processRecord(ctx context.Context, record ingress.Record, forward func(context.Context, ingress.Record) error) recordResult {
+	result := recordResult{MessageId: record.MessageId(), Outcome: outcomeForwarded}
+
+	// Print event as JSON for debugging
+	eventJson, err := json.Marshal(record)
+	if err == nil {
+		log.Print(string(eventJson))
+	}
+
+	err = forward(ctx, record)
+	if err == nil {
+		return result
+	}
+
+	result.Err = err
+	if handleErr := handleError(record, err); handleErr != nil {
+		result.Outcome = outcomeRetry
+	} else if failure.Classify(err) == failure.Permanent {
+		result.Outcome = outcomeDeadLettered
+	} else {
+		result.Outcome = outcomeHandled
+	}
+
+	return result
+}
+
+func logSummary(results []recordResult) {
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Outcome]++
+		if result.Err != nil {
+			log.Printf("Record %s: %s (%v)", result.MessageId, result.Outcome, result.Err)
 		}
+	}
+
+	log.Printf(
+		"Processed %d records: %d forwarded, %d handled, %d dead-lettered, %d to retry",
+		len(results), counts[outcomeForwarded], counts[outcomeHandled], counts[outcomeDeadLettered], counts[outcomeRetry],
+	)
+}
+
+// Decide based on the class of the error whether the event is retried.
+// Returns the error to return from the handler (nil if it should not be retried).
+func handleError(record ingress.Record, err error) error {
+	class := failure.Classify(err)
+	log.Printf("Forwarding message %s failed (%s): %v", record.MessageId(), class, err)
 
-		err = f.Forward(ses)
-		if err != nil {
-			log.Print(err)
+	switch class {
+	case failure.Handled:
+		// Nothing left to do
+		return nil
+	case failure.Permanent:
+		// Retrying won't help, keep the event for later inspection instead
+		if err := storeDeadLetter(record, err); err != nil {
+			log.Printf("Failed to store dead letter: %v", err)
 			return err
 		}
+		return nil
+	default:
+		// Ask Lambda to retry the event
+		return err
+	}
+}
+
+// An event that failed permanently
+type deadLetter struct {
+	Error  string         `json:"error"`
+	Class  string         `json:"class"`
+	Record ingress.Record `json:"record"`
+}
+
+// Store the event at the dead letter prefix (if configured)
+func storeDeadLetter(record ingress.Record, err error) error {
+	prefix := currentConfig.S3.DeadLetterPrefix
+	if prefix == "" {
+		log.Print("No dead letter prefix configured, dropping event")
+		return nil
+	}
+
+	data, marshalErr := json.Marshal(deadLetter{
+		Error:  err.Error(),
+		Class:  failure.Classify(err).String(),
+		Record: record,
+	})
+	if marshalErr != nil {
+		return fmt.Errorf("failed to serialize dead letter: %w", marshalErr)
+	}
+
+	key := prefix + record.MessageId() + ".json"
+	if _, err := st.Put(key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to store dead letter at %s: %w", key, err)
 	}
 
+	log.Printf("Stored dead letter at %s", key)
 	return nil
 }
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// Recreate the forwarder if the config source returned a new config.
+//
+// If the forwarder cannot be created for the new config (e.g. a key or secret
+// file it refers to is missing), the current forwarder is kept like the
+// config source keeps the last valid config. Fails only if there is none yet.
+func refreshForwarder() error {
+	cfg, err := configSource.Config()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
 
-	// Load config expected to be present at config(.<env>).json
-	configFile := "config.json"
-	env := os.Getenv("ENVIRONMENT")
-	if env != "" {
-		configFile = fmt.Sprintf("config.%s.json", env)
+	if cfg != currentConfig && cfg != rejectedConfig {
+		newForwarder, newStorage, err := createForwarder(cfg)
+		if err != nil && f == nil {
+			return err
+		} else if err != nil {
+			log.Printf("Keeping the current config: %v", err)
+			rejectedConfig = cfg
+			return nil
+		}
+		f, st, currentConfig = newForwarder, newStorage, cfg
 	}
 
-	log.Printf("Loading config file %s", configFile)
-	config, err := config.LoadAndParseConfig(configFile)
+	return nil
+}
+
+func createForwarder(cfg *config.ParsedConfig) (*forwarder.Forwarder, *storage.Storage, error) {
+	newForwarder, err := forwarder.NewForwarder(cfg, awsConfig)
 	if err != nil {
-		log.Printf("Failed to load config: %v", err)
-		os.Exit(ConfigInvalidOrMissingExitCode)
+		return nil, nil, fmt.Errorf("failed to create forwarder: %w", err)
+	}
+	newStorage, err := forwarder.NewStorage(cfg, awsConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create storage: %w", err)
 	}
+	return newForwarder, newStorage, nil
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	awsConfig, err := awsconfig.LoadDefaultConfig(context.TODO())
+	var err error
+	awsConfig, err = awsconfig.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		log.Printf("Failed to load AWS config: %v", err)
 		os.Exit(LoadingAwsConfigFailedExitCode)
 	}
 
-	f = forwarder.NewForwarder(config, awsConfig)
+	if rawMaxParallel := os.Getenv("MAX_PARALLEL_RECORDS"); rawMaxParallel != "" {
+		maxParallelRecords, err = strconv.Atoi(rawMaxParallel)
+		if err != nil || maxParallelRecords < 1 {
+			log.Printf("Invalid MAX_PARALLEL_RECORDS %s", rawMaxParallel)
+			os.Exit(ConfigInvalidOrMissingExitCode)
+		}
+	}
+
+	configSource, err = config.SourceFromEnv(awsConfig)
+	if err != nil {
+		log.Printf("Failed to create config source: %v", err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+
+	// Fail fast at cold start if there is no valid config at all
+	if err := refreshForwarder(); err != nil {
+		log.Print(err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
 
-	lambda.Start(HandleRequest)
+	switch mode := os.Getenv("HANDLER_MODE"); mode {
+	case "", handlerModeForward:
+		lambda.Start(HandleRequest)
+	case handlerModeDisposition:
+		lambda.Start(HandleDisposition)
+	default:
+		log.Printf("Invalid HANDLER_MODE %s (allowed: %s, %s)", mode, handlerModeForward, handlerModeDisposition)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
 }
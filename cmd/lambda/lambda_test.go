@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/ingress"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProcessRecords(t *testing.T) {
+	// No dead letter prefix, permanent failures are dropped
+	currentConfig = &config.ParsedConfig{}
+
+	errs := map[string]error{
+		"forwarded":     nil,
+		"handled":       failure.AsHandled(errors.New("already processed")),
+		"dead-lettered": failure.AsPermanent(errors.New("invalid sender")),
+		"retry":         failure.AsTransient(errors.New("throttled")),
+	}
+
+	records := make([]ingress.Record, 0)
+	for _, id := range []string{"forwarded", "handled", "dead-lettered", "retry", "forwarded"} {
+		records = append(records, ingress.Record{Bucket: "bucket", Key: "in/new/" + id})
+	}
+
+	var mu sync.Mutex
+	calls := 0
+	forward := func(ctx context.Context, record ingress.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return errs[record.MessageId()]
+	}
+
+	results := processRecords(context.Background(), records, 2, forward)
+
+	if want, got := len(records), calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+
+	outcomes := make([]string, 0)
+	for _, result := range results {
+		outcomes = append(outcomes, result.Outcome)
+	}
+	want := []string{outcomeForwarded, outcomeHandled, outcomeDeadLettered, outcomeRetry, outcomeForwarded}
+	if diff := cmp.Diff(want, outcomes); diff != "" {
+		t.Errorf("outcomes (-want +got):\n%s", diff)
+	}
+}
+
+func TestBatchItemFailures(t *testing.T) {
+	records := []ingress.Record{
+		{Key: "in/new/message-1", SQSMessageId: "sqs-1"},
+		{Key: "in/new/message-2", SQSMessageId: "sqs-2"},
+		{Key: "in/new/message-3", SQSMessageId: "sqs-2"},
+		{Key: "in/new/message-4", SQSMessageId: "sqs-3"},
+	}
+	results := []recordResult{
+		{MessageId: "message-1", Outcome: outcomeRetry},
+		{MessageId: "message-2", Outcome: outcomeRetry},
+		{MessageId: "message-3", Outcome: outcomeRetry},
+		{MessageId: "message-4", Outcome: outcomeForwarded},
+	}
+
+	response := batchItemFailures(records, results)
+	if response == nil {
+		t.Fatalf("Expected response, got nil")
+	}
+	want := []events.SQSBatchItemFailure{{ItemIdentifier: "sqs-1"}, {ItemIdentifier: "sqs-2"}}
+	if diff := cmp.Diff(want, response.BatchItemFailures); diff != "" {
+		t.Errorf("batch item failures (-want +got):\n%s", diff)
+	}
+
+	if response := batchItemFailures([]ingress.Record{{Key: "in/new/message-1"}}, results[:1]); response != nil {
+		t.Errorf("expected no response for records not delivered through SQS, got %+v", response)
+	}
+}
+
+type fakeSource struct {
+	config *config.ParsedConfig
+}
+
+func (s *fakeSource) Config() (*config.ParsedConfig, error) {
+	return s.config, nil
+}
+
+func TestRefreshForwarderKeepsCurrentConfig(t *testing.T) {
+	source := &fakeSource{config: &config.ParsedConfig{}}
+	configSource, currentConfig, rejectedConfig, f, st = source, nil, nil, nil, nil
+
+	if err := refreshForwarder(); err != nil {
+		t.Fatal(err)
+	}
+	valid, validForwarder := currentConfig, f
+
+	// The forwarder cannot be created, as the webhook secret is missing
+	invalid := &config.ParsedConfig{Webhook: config.WebhookConfig{SecretFile: filepath.Join(t.TempDir(), "missing")}}
+	source.config = invalid
+	if err := refreshForwarder(); err != nil {
+		t.Fatalf("Expected the current forwarder to be kept, got %v", err)
+	}
+	if currentConfig != valid || f != validForwarder {
+		t.Errorf("Expected the current config to be kept")
+	}
+
+	// Without a current forwarder (cold start), the config is rejected
+	currentConfig, rejectedConfig, f = nil, nil, nil
+	if err := refreshForwarder(); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
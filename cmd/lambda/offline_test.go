@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/e2e"
+	"github.com/codezombiech/aws-mail-forwarder-test/ingress"
+	"github.com/codezombiech/aws-mail-forwarder-test/internal/awsfake"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Offline counterpart of the e2e suite: fixture messages are stored in a fake
+// S3 bucket, HandleRequest is invoked with a synthesized SES receipt and the
+// messages sent through a fake SES endpoint are validated like the ones
+// received by testmail.app
+
+const offlineTestdata = "testdata/offline/"
+
+// Receipt fields that differ from the ones recovered from the fixture headers
+type receiptOverrides struct {
+	Recipients []string
+	Verdicts   map[string]string // Keyed by "spam", "virus", "spf", "dkim" and "dmarc"
+}
+
+// Synthesize the SES event SES would invoke the function with for the message
+func synthesizeEvent(messageId string, header mail.Header, overrides receiptOverrides) events.SimpleEmailEvent {
+	ses := ingress.EventFromHeader(messageId, header)
+	ses.Mail.Destination = ses.Receipt.Recipients
+	ses.Mail.HeadersTruncated = false
+	for key, values := range header {
+		for _, value := range values {
+			ses.Mail.Headers = append(ses.Mail.Headers, events.SimpleEmailHeader{Name: key, Value: value})
+		}
+	}
+
+	if overrides.Recipients != nil {
+		ses.Receipt.Recipients = overrides.Recipients
+	}
+	verdicts := map[string]*events.SimpleEmailVerdict{
+		"spam":  &ses.Receipt.SpamVerdict,
+		"virus": &ses.Receipt.VirusVerdict,
+		"spf":   &ses.Receipt.SPFVerdict,
+		"dkim":  &ses.Receipt.DKIMVerdict,
+		"dmarc": &ses.Receipt.DMARCVerdict,
+	}
+	for name, status := range overrides.Verdicts {
+		verdicts[name].Status = status
+	}
+
+	return events.SimpleEmailEvent{Records: []events.SimpleEmailRecord{{
+		EventVersion: "1.0",
+		EventSource:  "aws:ses",
+		SES:          ses,
+	}}}
+}
+
+func TestOffline(t *testing.T) {
+	tests := map[string]struct {
+		fixture   string
+		overrides receiptOverrides
+		want      []e2e.Expectation // Expected messages in the order sent
+		wantTo    []string          // Expected destinations of all sent messages
+		wantKeys  []string          // Expected keys in the bucket afterwards
+	}{
+		"plain": {
+			fixture: "plain.eml",
+			want: []e2e.Expectation{{
+				Subject: "FORWARDER: Test subject 1669144560000",
+				From:    "\"e2e Test Sender at sender@e2e-test.aws-mail-forwarder.org\" <recipient@e2e-test.aws-mail-forwarder.org>",
+				To:      "e2e Test Recipient <recipient@e2e-test.aws-mail-forwarder.org>",
+			}},
+			wantTo:   []string{"<e2e.test@inbox.testmail.app>"},
+			wantKeys: []string{"in/forwarded/plain", "out/sent/plain"},
+		},
+		"multipart with cc": {
+			fixture: "multipart.eml",
+			want: []e2e.Expectation{{
+				Subject: "FORWARDER: =?UTF-8?Q?Gr=C3=BCezi_1669144560000?=",
+				From:    "\"sender@e2e-test.aws-mail-forwarder.org\" <recipient@e2e-test.aws-mail-forwarder.org>",
+				To:      "e2e Test Recipient <recipient@e2e-test.aws-mail-forwarder.org>",
+			}},
+			wantTo:   []string{"<e2e.test@inbox.testmail.app>", "<e2e.info@inbox.testmail.app>"},
+			wantKeys: []string{"in/forwarded/multipart", "out/sent/multipart"},
+		},
+		"spam": {
+			fixture:  "spam.eml",
+			wantKeys: []string{"in/spam-virus/spam"},
+		},
+		"virus (receipt override)": {
+			fixture:   "plain.eml",
+			overrides: receiptOverrides{Verdicts: map[string]string{"virus": "FAIL"}},
+			wantKeys:  []string{"in/spam-virus/plain"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s3 := awsfake.NewS3(t, "e2e-test")
+			ses := awsfake.NewSES(t)
+
+			// The globals the handler is initialized with by main
+			awsConfig = awsfake.Config(s3, ses)
+			configSource = config.NewFileSource(offlineTestdata + "config.json")
+
+			data, err := os.ReadFile(offlineTestdata + tc.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixture, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messageId := strings.TrimSuffix(tc.fixture, filepath.Ext(tc.fixture))
+			s3.PutObject("e2e-test", "in/new/"+messageId, data)
+
+			payload, err := json.Marshal(synthesizeEvent(messageId, fixture.Header, tc.overrides))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := HandleRequest(ctx, payload); err != nil {
+				t.Fatal(err)
+			}
+
+			sent := ses.Sent()
+			if want, got := len(tc.want), len(sent); want != got {
+				t.Fatalf("sent messages: want %d, got %d", want, got)
+			}
+			var gotTo []string
+			for i, want := range tc.want {
+				gotTo = append(gotTo, sent[i].To...)
+				message, err := mail.ReadMessage(bytes.NewReader(sent[i].Data))
+				if err != nil {
+					t.Fatalf("Failed to parse sent message: %v", err)
+				}
+				e2e.ValidateMail(t, message, want)
+			}
+			if diff := cmp.Diff(tc.wantTo, gotTo); diff != "" {
+				t.Errorf("destinations (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tc.wantKeys, s3.Keys("e2e-test")); diff != "" {
+				t.Errorf("keys (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
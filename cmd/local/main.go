@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/forwarder"
+	"github.com/codezombiech/aws-mail-forwarder-test/ingress"
+	"github.com/codezombiech/aws-mail-forwarder-test/sender"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+const (
+	ConfigInvalidOrMissingExitCode = -1
+	ForwardingFailedExitCode       = -3
+	InvalidArgumentsExitCode       = -4
+)
+
+// Repeatable flag of verdicts like "spam=FAIL"
+type verdictFlags map[string]string
+
+func (v verdictFlags) String() string {
+	verdicts := make([]string, 0, len(v))
+	for name, verdict := range v {
+		verdicts = append(verdicts, name+"="+verdict)
+	}
+	return strings.Join(verdicts, ",")
+}
+
+func (v verdictFlags) Set(value string) error {
+	name, verdict, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid verdict %s (expected e.g. spam=FAIL)", value)
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "spam", "virus", "spf", "dkim", "dmarc":
+	default:
+		return fmt.Errorf("invalid verdict %s (allowed: spam, virus, spf, dkim, dmarc)", name)
+	}
+	v[name] = strings.ToUpper(verdict)
+	return nil
+}
+
+// Storage printing the changes made by the forwarder
+type printingStorage struct {
+	*storage.FileStorage
+}
+
+func (s printingStorage) Put(key string, reader io.Reader) (*string, error) {
+	etag, err := s.FileStorage.Put(key, reader)
+	if err == nil {
+		fmt.Printf("put    %s\n", key)
+	}
+	return etag, err
+}
+
+func (s printingStorage) Move(sourceKey string, targetKey string) error {
+	err := s.FileStorage.Move(sourceKey, targetKey)
+	if err == nil {
+		fmt.Printf("move   %s -> %s\n", sourceKey, targetKey)
+	}
+	return err
+}
+
+func (s printingStorage) Delete(key string) error {
+	err := s.FileStorage.Delete(key)
+	if err == nil {
+		fmt.Printf("delete %s\n", key)
+	}
+	return err
+}
+
+func (s printingStorage) SetState(key string, state string, at time.Time) error {
+	err := s.FileStorage.SetState(key, state, at)
+	if err == nil {
+		fmt.Printf("state  %s = %s\n", key, state)
+	}
+	return err
+}
+
+// Sender printing the envelope of the sent messages and keeping their paths
+type printingSender struct {
+	*sender.FileSender
+	sent []string
+}
+
+func (s *printingSender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
+	messageId, err := s.FileSender.SendMessage(ctx, source, destinations, data)
+	if err == nil {
+		path := s.FileSender.Path(*messageId)
+		fmt.Printf("send   %s -> %s (%s)\n", source, strings.Join(destinations, ", "), path)
+		s.sent = append(s.sent, path)
+	}
+	return messageId, err
+}
+
+// Build the SES event of the message like SES would, overriding the recipients
+// and verdicts if given
+func buildEvent(messageId string, header mail.Header, recipients []string, verdicts map[string]string) events.SimpleEmailService {
+	event := ingress.EventFromHeader(messageId, header)
+	if len(recipients) > 0 {
+		event.Receipt.Recipients = recipients
+	}
+
+	statuses := map[string]*string{
+		"spam":  &event.Receipt.SpamVerdict.Status,
+		"virus": &event.Receipt.VirusVerdict.Status,
+		"spf":   &event.Receipt.SPFVerdict.Status,
+		"dkim":  &event.Receipt.DKIMVerdict.Status,
+		"dmarc": &event.Receipt.DMARCVerdict.Status,
+	}
+	for name, status := range statuses {
+		if verdict, ok := verdicts[name]; ok {
+			*status = verdict
+		} else if *status == "" {
+			// No header added by SES, e.g. a message saved from a mail client
+			*status = "PASS"
+		}
+	}
+
+	return event
+}
+
+// Replays a message through the forwarder without AWS: the message is stored
+// in a directory instead of S3 and sent messages are written to files instead
+// of being sent by SES. Prints the storage changes, the sent messages and the
+// outcome.
+//
+// Usage: local -config config.json [-recipients a@example.com,b@example.com] [-verdict spam=FAIL] message.eml
+func main() {
+	log.SetFlags(0)
+
+	verdicts := verdictFlags{}
+	configPath := flag.String("config", "", "path of the config to use (required)")
+	recipients := flag.String("recipients", "", "comma-separated envelope recipients (default: To and Cc of the message)")
+	flag.Var(verdicts, "verdict", "verdict like spam=FAIL (repeatable, missing verdicts default to PASS)")
+	dir := flag.String("dir", "", "directory for the storage and the sent messages (default: a new temporary directory)")
+	flag.Parse()
+
+	if *configPath == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(InvalidArgumentsExitCode)
+	}
+	messagePath := flag.Arg(0)
+
+	cfg, err := config.LoadAndParseConfig(*configPath)
+	if err != nil {
+		log.Print(err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+	if cfg.S3.Encryption != nil && cfg.S3.Encryption.KeyProvider != "" {
+		log.Print("Ignoring s3.encryption, stored objects are not encrypted locally")
+	}
+
+	if *dir == "" {
+		if *dir, err = os.MkdirTemp("", "forwarder-"); err != nil {
+			log.Printf("Failed to create directory: %v", err)
+			os.Exit(InvalidArgumentsExitCode)
+		}
+	}
+	log.Printf("Using directory %s", *dir)
+
+	data, err := os.ReadFile(messagePath)
+	if err != nil {
+		log.Printf("Failed to read message: %v", err)
+		os.Exit(InvalidArgumentsExitCode)
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to parse message: %v", err)
+		os.Exit(InvalidArgumentsExitCode)
+	}
+
+	st := printingStorage{storage.NewFileStorage(filepath.Join(*dir, cfg.S3.BucketName))}
+	sd := &printingSender{FileSender: sender.NewFileSender(filepath.Join(*dir, "sent"))}
+
+	// Store the message like SES would
+	messageId := strings.TrimSuffix(filepath.Base(messagePath), filepath.Ext(messagePath))
+	if _, err := st.Put(cfg.S3.Incoming.NewPrefix+messageId, bytes.NewReader(data)); err != nil {
+		log.Printf("Failed to store message: %v", err)
+		os.Exit(ForwardingFailedExitCode)
+	}
+
+	var envelopeRecipients []string
+	if *recipients != "" {
+		envelopeRecipients = strings.Split(*recipients, ",")
+	}
+	event := buildEvent(messageId, message.Header, envelopeRecipients, verdicts)
+
+	f, err := forwarder.NewForwarderWith(cfg, st, sd)
+	if err != nil {
+		log.Print(err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+	err = f.Forward(context.Background(), event)
+
+	for _, path := range sd.sent {
+		sent, readErr := os.ReadFile(path)
+		if readErr != nil {
+			log.Printf("Failed to read sent message: %v", readErr)
+			continue
+		}
+		fmt.Printf("\n--- %s\n%s\n", path, sent)
+	}
+
+	if err != nil {
+		fmt.Printf("\nFailed (%s): %v\n", failure.Classify(err), err)
+		os.Exit(ForwardingFailedExitCode)
+	}
+	fmt.Println("\nSucceeded")
+}
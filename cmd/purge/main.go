@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/forwarder"
+	"github.com/codezombiech/aws-mail-forwarder-test/retention"
+)
+
+const (
+	ConfigInvalidOrMissingExitCode = -1
+	LoadingAwsConfigFailedExitCode = -2
+	PurgeFailedExitCode            = -3
+)
+
+// Event of a scheduled invocation, e.g. by an EventBridge schedule
+type PurgeEvent struct {
+	DryRun bool `json:"dryRun"`
+}
+
+var (
+	awsConfig    aws.Config
+	configSource config.Source
+)
+
+func HandleRequest(ctx context.Context, event PurgeEvent) (*retention.Result, error) {
+	return purge(event.DryRun)
+}
+
+func purge(dryRun bool) (*retention.Result, error) {
+	cfg, err := configSource.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := forwarder.NewStorage(cfg, awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		log.Print("Dry run, no objects are deleted")
+	}
+	return retention.NewPurger(cfg.S3, storage, dryRun).Purge(time.Now())
+}
+
+// Deletes the objects older than the retention configured for their prefix
+// (see s3.retentionDays).
+//
+// Runs as a Lambda function if deployed as such, otherwise once from the
+// command line. The config is loaded the same way as by the forwarder.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	dryRun := flag.Bool("dry-run", false, "list the expired objects without deleting them")
+	flag.Parse()
+
+	var err error
+	awsConfig, err = awsconfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Printf("Failed to load AWS config: %v", err)
+		os.Exit(LoadingAwsConfigFailedExitCode)
+	}
+
+	configSource, err = config.SourceFromEnv(awsConfig)
+	if err != nil {
+		log.Printf("Failed to create config source: %v", err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		lambda.Start(HandleRequest)
+		return
+	}
+
+	if _, err := purge(*dryRun); err != nil {
+		log.Print(err)
+		os.Exit(PurgeFailedExitCode)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/forwarder"
+	"github.com/codezombiech/aws-mail-forwarder-test/metadata"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+const (
+	ConfigInvalidOrMissingExitCode = -1
+	LoadingAwsConfigFailedExitCode = -2
+	SearchFailedExitCode           = -3
+	InvalidArgumentsExitCode       = -4
+)
+
+// Repeatable flag of verdicts like "spam=FAIL"
+type verdictFlags map[string]string
+
+func (v verdictFlags) String() string {
+	verdicts := make([]string, 0, len(v))
+	for name, verdict := range v {
+		verdicts = append(verdicts, name+"="+verdict)
+	}
+	return strings.Join(verdicts, ",")
+}
+
+func (v verdictFlags) Set(value string) error {
+	name, verdict, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid verdict %s (expected e.g. spam=FAIL)", value)
+	}
+	v[strings.ToLower(name)] = strings.ToUpper(verdict)
+	return nil
+}
+
+// Parse a date like "2022-11-22" (UTC) or a time like "2022-11-22T19:16:00+01:00"
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Searches the metadata records of processed messages (see s3.metadataPrefix)
+// and optionally fetches the raw messages of the matching records.
+//
+// The config is loaded the same way as by the forwarder.
+func main() {
+	log.SetFlags(0)
+
+	verdicts := verdictFlags{}
+	since := flag.String("since", "", "received at or after the date (2006-01-02) or time (RFC 3339)")
+	until := flag.String("until", "", "received before the date (2006-01-02) or time (RFC 3339)")
+	address := flag.String("address", "", "part of a sender, recipient or target address")
+	outcome := flag.String("outcome", "", "outcome of the processing, e.g. forwarded or failed")
+	flag.Var(verdicts, "verdict", "verdict like spam=FAIL (repeatable)")
+	asJson := flag.Bool("json", false, "print the matching records as JSON lines")
+	fetch := flag.String("fetch", "", "directory to save the raw messages of the matching records to")
+	flag.Parse()
+
+	filter := &metadata.Filter{Address: *address, Outcome: *outcome, Verdicts: verdicts}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		log.Printf("Invalid -since: %v", err)
+		os.Exit(InvalidArgumentsExitCode)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		log.Printf("Invalid -until: %v", err)
+		os.Exit(InvalidArgumentsExitCode)
+	}
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		log.Printf("Failed to load AWS config: %v", err)
+		os.Exit(LoadingAwsConfigFailedExitCode)
+	}
+
+	configSource, err := config.SourceFromEnv(awsConfig)
+	if err != nil {
+		log.Printf("Failed to create config source: %v", err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+	cfg, err := configSource.Config()
+	if err != nil {
+		log.Print(err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+	if cfg.S3.MetadataPrefix == "" {
+		log.Print("No metadata prefix configured (s3.metadataPrefix)")
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+
+	st, err := forwarder.NewStorage(cfg, awsConfig)
+	if err != nil {
+		log.Print(err)
+		os.Exit(ConfigInvalidOrMissingExitCode)
+	}
+
+	records, err := metadata.Search(st, cfg.S3.MetadataPrefix, filter)
+	if err != nil {
+		log.Print(err)
+		os.Exit(SearchFailedExitCode)
+	}
+
+	for _, record := range records {
+		printRecord(record, *asJson)
+
+		if *fetch != "" {
+			if err := fetchMessage(st, record, *fetch); err != nil {
+				log.Printf("Failed to fetch message %s: %v", record.MessageId, err)
+			}
+		}
+	}
+}
+
+func printRecord(record *metadata.Record, asJson bool) {
+	if asJson {
+		data, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("Failed to serialize record %s: %v", record.MessageId, err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Printf(
+		"%s  %-19s  %s -> %s  %q  (%s)\n",
+		record.ReceivedAt.Format(time.RFC3339), record.Outcome,
+		strings.Join(record.From, ", "), strings.Join(record.Recipients, ", "),
+		record.Subject, record.MessageId,
+	)
+}
+
+// Save the raw message of the record as <dir>/<message ID>.eml
+func fetchMessage(st *storage.Storage, record *metadata.Record, dir string) error {
+	if record.MessageKey == "" {
+		return fmt.Errorf("message not kept (outcome %s)", record.Outcome)
+	}
+
+	body, _, err := st.Get(record.MessageKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	path := filepath.Join(dir, record.MessageId+".eml")
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, body); err != nil {
+		return err
+	}
+
+	log.Printf("Saved %s to %s", record.MessageKey, path)
+	return nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// Format of the start and end dates of an auto-reply
+const AutoReplyDateFormat = "2006-01-02"
+
+// Default minimum time between two auto-replies to the same sender
+const defaultAutoReplyIntervalDays = 7
+
+const defaultAutoReplySubject = "Auto: $subject"
+
+// Configuration of auto-replies, e.g. vacation or "no longer monitored"
+// responses, keyed by forwardMapping key. The placeholders $subject (the
+// original subject), $recipient (the original recipient) and $sender (the
+// original sender) are replaced in subject and body.
+type AutoReplyConfig struct {
+	Prefix string                   `json:"prefix,omitempty"` // Prefix (directory) of the time of the last reply per sender (required if there are rules)
+	Rules  map[string]AutoReplyRule `json:"rules,omitempty"`
+}
+
+// Auto-reply to the senders of messages matching a forwardMapping key
+type AutoReplyRule struct {
+	FromEmail    string `json:"fromEmail,omitempty"`    // Sender of the reply (defaults to the original recipient)
+	Subject      string `json:"subject,omitempty"`      // Defaults to "Auto: $subject"
+	Body         string `json:"body"`                   // Required
+	Start        string `json:"start,omitempty"`        // First day the rule is active, e.g. "2023-07-01" (UTC, active from the start if empty)
+	End          string `json:"end,omitempty"`          // Last day the rule is active, e.g. "2023-07-31" (UTC, active indefinitely if empty)
+	IntervalDays int    `json:"intervalDays,omitempty"` // Reply at most once per sender within this number of days (defaults to 7)
+}
+
+// Whether the rule is active at the given time. The dates must be valid,
+// which is ensured by ParseConfig.
+func (r AutoReplyRule) ActiveAt(t time.Time) bool {
+	day := t.UTC().Format(AutoReplyDateFormat)
+	// Dates in this format compare like strings
+	return (r.Start == "" || r.Start <= day) && (r.End == "" || day <= r.End)
+}
+
+func parseAutoReplyConfig(autoReply AutoReplyConfig, normalization NormalizationConfig, mapping map[string][]*mail.Address) (AutoReplyConfig, error) {
+	if len(autoReply.Rules) == 0 {
+		return autoReply, nil
+	}
+	if autoReply.Prefix == "" {
+		return autoReply, errors.New("auto-reply rules require a prefix (autoReply.prefix)")
+	}
+
+	rules := make(map[string]AutoReplyRule, len(autoReply.Rules))
+	for rawKey, rule := range autoReply.Rules {
+		key, err := parseMappingKey(normalization, mapping, "auto-reply", rawKey)
+		if err != nil {
+			return autoReply, err
+		}
+
+		if rule.Body == "" {
+			return autoReply, fmt.Errorf("auto-reply %s requires a body", rawKey)
+		}
+		if rule.FromEmail != "" {
+			if _, err := mail.ParseAddress(rule.FromEmail); err != nil {
+				return autoReply, fmt.Errorf("invalid fromEmail of auto-reply %s: %w", rawKey, err)
+			}
+		}
+		for _, date := range []string{rule.Start, rule.End} {
+			if date == "" {
+				continue
+			}
+			if _, err := time.Parse(AutoReplyDateFormat, date); err != nil {
+				return autoReply, fmt.Errorf("invalid date %q of auto-reply %s (expected e.g. 2023-07-31)", date, rawKey)
+			}
+		}
+		if rule.Start != "" && rule.End != "" && rule.End < rule.Start {
+			return autoReply, fmt.Errorf("auto-reply %s ends before it starts", rawKey)
+		}
+
+		if rule.IntervalDays < 0 {
+			return autoReply, fmt.Errorf("invalid intervalDays %d of auto-reply %s", rule.IntervalDays, rawKey)
+		}
+		if rule.IntervalDays == 0 {
+			rule.IntervalDays = defaultAutoReplyIntervalDays
+		}
+		if rule.Subject == "" {
+			rule.Subject = defaultAutoReplySubject
+		}
+
+		rules[key] = rule
+	}
+	autoReply.Rules = rules
+
+	return autoReply, nil
+}
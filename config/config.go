@@ -2,9 +2,12 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/mail"
+	"net/textproto"
 	"os"
+	"strings"
 )
 
 // Forwarder configuration
@@ -13,8 +16,154 @@ type RawConfig struct {
 	ToEmail        string              `json:"toEmail"`        // Email address the To header will be overwritten to (if specified)
 	SubjectPrefix  string              `json:"subjectPrefix"`  // A prefix that will be added to the Subject header (if specified)
 	AllowPlusSign  bool                `json:"allowPlusSign"`  // Allow "+" (plus) sign in recipient addresses (part after "+" will be removed)
-	ForwardMapping map[string][]string `json:"forwardMapping"` // Mapping of incoming recipients to forwarded recipients
+	ForwardMapping map[string][]string `json:"forwardMapping"` // Mapping of incoming recipients to forwarded recipients, or to webhooks (https://...) and mailboxes (s3://bucket/prefix/)
 	S3             S3Config            `json:"s3"`
+
+	// Characters separating a sub-address tag from the local part (any of "+", "-" and "."),
+	// e.g. "+-" for "user+tag@" and "user-tag@". Takes precedence over allowPlusSign if set.
+	SubAddressDelimiters string `json:"subAddressDelimiters,omitempty"`
+
+	// The optional sections below are nil if not configured, see ParsedConfig
+	// for their values with the defaults applied.
+
+	// Normalization applied to recipient addresses and forwardMapping keys
+	Normalization *NormalizationConfig `json:"normalization,omitempty"`
+
+	// How forwarded messages are delivered to their targets
+	Delivery *DeliveryConfig `json:"delivery,omitempty"`
+
+	// How recipients not matching any forwardMapping key are handled
+	Unmapped *UnmappedConfig `json:"unmapped,omitempty"`
+
+	// Verdict policy of the synchronous disposition handler
+	Disposition *DispositionConfig `json:"disposition,omitempty"`
+
+	// Signing and timeout of webhook targets
+	Webhook *WebhookConfig `json:"webhook,omitempty"`
+
+	// Digest delivery of low-priority forwardMapping keys
+	Digest *DigestConfig `json:"digest,omitempty"`
+
+	// Auto-replies to the senders of messages to forwardMapping keys
+	AutoReply *AutoReplyConfig `json:"autoReply,omitempty"`
+
+	// Relay of replies through the alias, hiding the original sender
+	Relay *RelayConfig `json:"relay,omitempty"`
+
+	// Allow and deny rules of senders, global and per forwardMapping key
+	SenderRules *SenderRulesConfig `json:"senderRules,omitempty"`
+
+	// Per-domain profiles overriding the global settings above, keyed by the
+	// domain of the original recipient (e.g. "example.com")
+	Profiles map[string]DomainProfileConfig `json:"profiles,omitempty"`
+}
+
+// Settings overriding the global configuration for a single recipient domain.
+// Unset (null) fields fall back to the global configuration.
+type DomainProfileConfig struct {
+	FromEmail     *string `json:"fromEmail,omitempty"`
+	ToEmail       *string `json:"toEmail,omitempty"`
+	SubjectPrefix *string `json:"subjectPrefix,omitempty"`
+	AllowPlusSign *bool   `json:"allowPlusSign,omitempty"`
+
+	SubAddressDelimiters *string `json:"subAddressDelimiters,omitempty"`
+
+	// Overrides for single mapping rules of this domain, keyed by the forwardMapping key
+	Rules map[string]RuleProfileConfig `json:"rules,omitempty"`
+}
+
+// Settings overriding the domain profile for a single forwardMapping rule.
+// Unset (null) fields fall back to the domain profile.
+type RuleProfileConfig struct {
+	FromEmail     *string `json:"fromEmail,omitempty"`
+	ToEmail       *string `json:"toEmail,omitempty"`
+	SubjectPrefix *string `json:"subjectPrefix,omitempty"`
+}
+
+// Delivery modes
+const (
+	DeliveryModeBatch     = "batch"     // A single SES call for all targets, chunked to the per-call recipient limit (default)
+	DeliveryModePerTarget = "perTarget" // One SES call per target, allowing personalized headers
+)
+
+// Delivery backends
+const (
+	DeliveryBackendSES     = "ses"     // Send messages through SES (default)
+	DeliveryBackendMaildir = "maildir" // Deliver messages into local Maildirs, one per target address
+	DeliveryBackendMbox    = "mbox"    // Append messages to a local mbox file
+)
+
+// Maximum number of recipients SES accepts per SendEmail call
+const MaxRecipientsPerCall = 50
+
+// Delivery configuration
+type DeliveryConfig struct {
+	Backend              string `json:"backend,omitempty"`              // Delivery backend, one of the DeliveryBackend* constants (defaults to "ses")
+	Path                 string `json:"path,omitempty"`                 // Root directory of the Maildirs (maildir backend) or path of the mbox file (mbox backend)
+	Mode                 string `json:"mode,omitempty"`                 // Delivery mode, "batch" (default) or "perTarget"
+	MaxRecipientsPerCall int    `json:"maxRecipientsPerCall,omitempty"` // Maximum number of targets per SES call in batch mode (defaults to the SES limit of 50)
+
+	// Headers set per target in perTarget mode, e.g. {"X-Forwarded-To": "$target"}.
+	// The placeholders $target, $recipient (original recipient) and $tag are replaced.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Policies for recipients not matching any forwardMapping key
+const (
+	UnmappedPolicyFail       = "fail"       // Mark the message as failed if no recipient is mapped (default)
+	UnmappedPolicyDrop       = "drop"       // Silently drop unmapped recipients, messages without any mapped recipient are deleted
+	UnmappedPolicyQuarantine = "quarantine" // Move messages without any mapped recipient to the unmapped prefix
+	UnmappedPolicyCatchAll   = "catchAll"   // Forward unmapped recipients to the catch-all targets
+	UnmappedPolicyNotify     = "notify"     // Send the original sender a non-delivery notice and quarantine messages without any mapped recipient
+)
+
+// Configuration of the handling of unmapped recipients
+type UnmappedConfig struct {
+	Policy   string   `json:"policy,omitempty"`   // Policy, one of the UnmappedPolicy* constants (defaults to "fail")
+	CatchAll []string `json:"catchAll,omitempty"` // Targets for the catchAll policy
+
+	// Non-delivery notice of the notify policy. The placeholders $recipients
+	// (the unmapped recipients) and $subject (the original subject) are replaced.
+	NoticeFromEmail string `json:"noticeFromEmail,omitempty"` // Sender of the notice (defaults to the first unmapped recipient)
+	NoticeSubject   string `json:"noticeSubject,omitempty"`
+	NoticeBody      string `json:"noticeBody,omitempty"`
+}
+
+// Verdict policy applied by the synchronous disposition handler before the
+// message is stored. Messages failing the policy are dropped.
+type DispositionConfig struct {
+	DropSpam            bool `json:"dropSpam,omitempty"`            // Drop messages flagged as spam
+	DropVirus           bool `json:"dropVirus,omitempty"`           // Drop messages flagged as virus
+	DropUnauthenticated bool `json:"dropUnauthenticated,omitempty"` // Drop messages that neither passed SPF nor DKIM
+}
+
+// Default timeout of webhook requests
+const defaultWebhookTimeoutSeconds = 10
+
+// Configuration of webhook targets. Payloads are signed with HMAC-SHA256, see
+// package webhook.
+type WebhookConfig struct {
+	SecretFile     string `json:"secretFile,omitempty"`     // Path of the file containing the signing secret (required if there are webhook targets)
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // Timeout of a webhook request (defaults to 10 seconds)
+}
+
+// Digest formats
+const (
+	DigestFormatMIME    = "mime"    // A multipart/digest with a summary and the messages as message/rfc822 parts (default)
+	DigestFormatSummary = "summary" // A plain text summary with links to the stored messages
+)
+
+// Default minimum time between two digests to the same target (daily)
+const defaultDigestIntervalMinutes = 24 * 60
+
+// Configuration of digest delivery. Messages to the email targets of the
+// digest keys are queued instead of sent, a scheduled invocation (see
+// cmd/digest) sends a single digest per target.
+type DigestConfig struct {
+	Keys            []string `json:"keys,omitempty"`            // forwardMapping keys delivered as digest, e.g. "newsletter@example.com"
+	Prefix          string   `json:"prefix,omitempty"`          // Prefix (directory) of the queued messages and the digest state (required if there are keys)
+	IntervalMinutes int      `json:"intervalMinutes,omitempty"` // Minimum time between two digests to the same target (defaults to 1440, daily)
+	Format          string   `json:"format,omitempty"`          // Format, one of the DigestFormat* constants (defaults to "mime")
 }
 
 // AWS S3 configuration
@@ -22,6 +171,39 @@ type S3Config struct {
 	BucketName string           `json:"bucketName"` // Name of the S3 bucket
 	Incoming   S3IncomingConfig `json:"incoming"`
 	Outgoing   S3OutgoingConfig `json:"outgoing"`
+
+	DeadLetterPrefix string `json:"deadLetterPrefix,omitempty"` // Prefix (directory) for events that failed permanently (if specified)
+
+	// Client-side encryption of stored messages (disabled if no key provider is specified)
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+
+	// Days objects are retained per prefix, e.g. {"in/spam-virus/": 14, "out/sent/": 90}.
+	// Objects of prefixes not listed (e.g. failed messages to be reviewed) are kept forever.
+	RetentionDays map[string]int `json:"retentionDays,omitempty"`
+
+	// Prefix (directory) for the JSON metadata records of processed messages (if specified)
+	MetadataPrefix string `json:"metadataPrefix,omitempty"`
+
+	// Prefix (directory) of legal hold markers. A marker object <prefix><message ID>
+	// exempts all objects of the message from retention.
+	LegalHoldPrefix string `json:"legalHoldPrefix,omitempty"`
+}
+
+// Key providers for client-side encryption
+const (
+	KeyProviderFile = "file" // Key read from a local file
+)
+
+// State tracking of incoming messages
+const (
+	StateTrackingMove = "move" // Move messages to the prefix of their state (default)
+	StateTrackingTags = "tags" // Keep messages at the new prefix and record their state with object tags (retention of incoming messages requires lifecycle rules filtering by tag, not supported with encryption)
+)
+
+// Client-side envelope encryption of stored objects
+type EncryptionConfig struct {
+	KeyProvider string `json:"keyProvider,omitempty"` // Provider of the key wrapping the data keys, one of the KeyProvider* constants
+	KeyFile     string `json:"keyFile,omitempty"`     // Path of the file containing the base64 encoded 256 bit key (file provider)
 }
 
 // AWS S3 configuration for storing incoming messages according to their states
@@ -30,6 +212,12 @@ type S3IncomingConfig struct {
 	SpamVirusPrefix string `json:"spamVirusPrefix"` // Prefix (directory) for messages that were flagged as spam or/and virus
 	ForwardedPrefix string `json:"forwardedPrefix"` // Prefix (directory) for messages that were successfully forwarded
 	FailedPrefix    string `json:"failedPrefix"`    // Prefix (directory) for messages that failed to be forwarded
+
+	UnmappedPrefix string `json:"unmappedPrefix,omitempty"` // Prefix (directory) for messages without any mapped recipient (quarantine and notify policy)
+	BlockedPrefix  string `json:"blockedPrefix,omitempty"`  // Prefix (directory) for messages denied by the sender rules
+
+	// How the state of processed messages is recorded, one of the StateTracking* constants
+	StateTracking string `json:"stateTracking,omitempty"`
 }
 
 // AWS S3 configuration for storing outgoing messages according to their states
@@ -40,7 +228,43 @@ type S3OutgoingConfig struct {
 
 type ParsedConfig struct {
 	RawConfig
-	ForwardMapping map[string][]*mail.Address
+
+	// The optional sections of RawConfig with their defaults applied
+	Normalization NormalizationConfig
+	Delivery      DeliveryConfig
+	Unmapped      UnmappedConfig
+	Disposition   DispositionConfig
+	Webhook       WebhookConfig
+	Digest        DigestConfig
+	AutoReply     AutoReplyConfig
+	Relay         RelayConfig
+	SenderRules   SenderRulesConfig
+
+	ForwardMapping   map[string][]*mail.Address
+	ForwardTargets   map[string][]Target // Non-email targets of the forwardMapping keys
+	UnmappedCatchAll []*mail.Address
+	Senders          *SenderRules // Nil if there are no sender rules
+}
+
+// Whether mail to the given domain is received, i.e. it is the domain of a
+// forwardMapping key (e.g. "info@example.com" or "@example.com"), a profile
+// or the relay. Keys without a domain (e.g. "info" or "@") match any domain,
+// but do not make it a receiving domain.
+func (c *ParsedConfig) IsReceivingDomain(domain string) bool {
+	normalizedDomain, err := c.Normalization.NormalizeDomain(domain)
+	if err != nil {
+		return false
+	}
+
+	for key := range c.ForwardMapping {
+		if at := strings.LastIndex(key, "@"); at >= 0 && key[at+1:] != "" && strings.EqualFold(key[at+1:], normalizedDomain) {
+			return true
+		}
+	}
+	if _, ok := c.Profiles[normalizedDomain]; ok {
+		return true
+	}
+	return c.Relay.Domain != "" && strings.EqualFold(c.Relay.Domain, domain)
 }
 
 func LoadAndParseConfig(path string) (*ParsedConfig, error) {
@@ -58,21 +282,400 @@ func LoadAndParseConfig(path string) (*ParsedConfig, error) {
 }
 
 func ParseConfig(config *RawConfig) (*ParsedConfig, error) {
+	normalization := valueOrZero(config.Normalization)
+	if err := normalization.validate(); err != nil {
+		return nil, err
+	}
+
 	parsedMapping := make(map[string][]*mail.Address, 0)
+	parsedTargets := make(map[string][]Target, 0)
+	hasWebhooks := false
+	originalKeys := make(map[string]string, 0)
+
+	for rawKey, mapping := range config.ForwardMapping {
+		// Normalize keys the same way recipients are normalized to keep lookups consistent
+		key, err := normalization.NormalizeKey(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in mapping: %s, %w", rawKey, err)
+		}
+		if originalKey, exists := originalKeys[key]; exists {
+			return nil, fmt.Errorf("duplicate key in mapping: %s and %s both normalize to %s", originalKey, rawKey, key)
+		}
+		originalKeys[key] = rawKey
 
-	for key, mapping := range config.ForwardMapping {
 		parsedMappingRecipients := make([]*mail.Address, 0)
 		for _, mappingRecipient := range mapping {
+			if isTarget(mappingRecipient) {
+				target, err := ParseTarget(mappingRecipient)
+				if err != nil {
+					return nil, fmt.Errorf("invalid target in mapping: %s => %s, %w", rawKey, mappingRecipient, err)
+				}
+				hasWebhooks = hasWebhooks || target.Kind == TargetKindWebhook
+				parsedTargets[key] = append(parsedTargets[key], target)
+				continue
+			}
+
 			parsedMappingRecipient, err := mail.ParseAddress(mappingRecipient)
 			if err != nil {
-				return nil, fmt.Errorf("invalid address in mapping: %s => %s, %w", key, mappingRecipient, err)
+				return nil, fmt.Errorf("invalid address in mapping: %s => %s, %w", rawKey, mappingRecipient, err)
 			}
 			parsedMappingRecipients = append(parsedMappingRecipients, parsedMappingRecipient)
 		}
 		parsedMapping[key] = parsedMappingRecipients
 	}
 
-	return &ParsedConfig{RawConfig: *config, ForwardMapping: parsedMapping}, nil
+	if err := validateSubAddressDelimiters(config.SubAddressDelimiters); err != nil {
+		return nil, err
+	}
+
+	webhook := valueOrZero(config.Webhook)
+	if hasWebhooks && webhook.SecretFile == "" {
+		return nil, errors.New("webhook targets require a signing secret (webhook.secretFile)")
+	}
+	if webhook.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("invalid webhook timeoutSeconds %d", webhook.TimeoutSeconds)
+	}
+	if webhook.TimeoutSeconds == 0 {
+		webhook.TimeoutSeconds = defaultWebhookTimeoutSeconds
+	}
+
+	parsedDelivery, err := parseDeliveryConfig(valueOrZero(config.Delivery))
+	if err != nil {
+		return nil, err
+	}
+
+	parsedProfiles := make(map[string]DomainProfileConfig, len(config.Profiles))
+	for domain, profile := range config.Profiles {
+		if profile.SubAddressDelimiters != nil {
+			if err := validateSubAddressDelimiters(*profile.SubAddressDelimiters); err != nil {
+				return nil, fmt.Errorf("invalid profile %s: %w", domain, err)
+			}
+		}
+		if profile.FromEmail != nil && *profile.FromEmail != "" {
+			if _, err := mail.ParseAddress(*profile.FromEmail); err != nil {
+				return nil, fmt.Errorf("invalid fromEmail in profile %s: %w", domain, err)
+			}
+		}
+		for rule, ruleProfile := range profile.Rules {
+			if ruleProfile.FromEmail != nil && *ruleProfile.FromEmail != "" {
+				if _, err := mail.ParseAddress(*ruleProfile.FromEmail); err != nil {
+					return nil, fmt.Errorf("invalid fromEmail in profile %s, rule %s: %w", domain, rule, err)
+				}
+			}
+		}
+
+		normalizedDomain, err := normalization.NormalizeDomain(domain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile %s: %w", domain, err)
+		}
+		if len(profile.Rules) > 0 {
+			normalizedRules := make(map[string]RuleProfileConfig, len(profile.Rules))
+			for rule, ruleProfile := range profile.Rules {
+				normalizedRule, err := normalization.NormalizeKey(rule)
+				if err != nil {
+					return nil, fmt.Errorf("invalid profile %s, rule %s: %w", domain, rule, err)
+				}
+				normalizedRules[normalizedRule] = ruleProfile
+			}
+			profile.Rules = normalizedRules
+		}
+		parsedProfiles[normalizedDomain] = profile
+	}
+
+	if err := validateEncryptionConfig(valueOrZero(config.S3.Encryption)); err != nil {
+		return nil, err
+	}
+
+	digest := valueOrZero(config.Digest)
+	autoReply := valueOrZero(config.AutoReply)
+	relay := valueOrZero(config.Relay)
+	if err := validateRetention(config.S3, digest.Prefix, autoReply.Prefix, relay.Prefix); err != nil {
+		return nil, err
+	}
+
+	parsedDigest, err := parseDigestConfig(digest, normalization, parsedMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedAutoReply, err := parseAutoReplyConfig(autoReply, normalization, parsedMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedRelay, err := parseRelayConfig(relay)
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := parseSenderRulesConfig(valueOrZero(config.SenderRules), config.S3, normalization, parsedMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	stateTracking := config.S3.Incoming.StateTracking
+	switch stateTracking {
+	case "":
+		stateTracking = StateTrackingMove
+	case StateTrackingMove, StateTrackingTags:
+	default:
+		return nil, fmt.Errorf("invalid state tracking %q (allowed: %s, %s)", stateTracking, StateTrackingMove, StateTrackingTags)
+	}
+	if stateTracking == StateTrackingTags && valueOrZero(config.S3.Encryption).KeyProvider != "" {
+		// Messages stored by SES are only encrypted when moved
+		return nil, fmt.Errorf("state tracking %s does not support s3.encryption, messages would be kept unencrypted", StateTrackingTags)
+	}
+	if stateTracking == StateTrackingTags {
+		if err := validateTagsRetention(config.S3); err != nil {
+			return nil, err
+		}
+	}
+
+	parsedUnmapped, catchAll, err := parseUnmappedConfig(valueOrZero(config.Unmapped), config.S3)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedConfig := &ParsedConfig{RawConfig: *config, ForwardMapping: parsedMapping, ForwardTargets: parsedTargets, UnmappedCatchAll: catchAll, Senders: senders}
+	parsedConfig.Normalization = normalization
+	parsedConfig.Disposition = valueOrZero(config.Disposition)
+	parsedConfig.SenderRules = valueOrZero(config.SenderRules)
+	parsedConfig.Webhook = webhook
+	parsedConfig.Digest = parsedDigest
+	parsedConfig.AutoReply = parsedAutoReply
+	parsedConfig.Relay = parsedRelay
+	parsedConfig.Unmapped = parsedUnmapped
+	parsedConfig.Profiles = parsedProfiles
+	parsedConfig.Delivery = parsedDelivery
+	parsedConfig.S3.Incoming.StateTracking = stateTracking
+
+	return parsedConfig, nil
+}
+
+// Returns the value of an optional configuration section, the zero value if it is not configured
+func valueOrZero[T any](value *T) T {
+	if value == nil {
+		var zero T
+		return zero
+	}
+	return *value
+}
+
+// Normalize a key of a configuration section the same way as the forwardMapping
+// keys and check that it is one of them. The section names the key in errors,
+// e.g. "digest" for "digest key a@example.com is not a forwardMapping key".
+func parseMappingKey(normalization NormalizationConfig, mapping map[string][]*mail.Address, section string, rawKey string) (string, error) {
+	key, err := normalization.NormalizeKey(rawKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s key %s: %w", section, rawKey, err)
+	}
+	if _, ok := mapping[key]; !ok {
+		return "", fmt.Errorf("%s key %s is not a forwardMapping key", section, rawKey)
+	}
+	return key, nil
+}
+
+func parseDeliveryConfig(delivery DeliveryConfig) (DeliveryConfig, error) {
+	switch delivery.Backend {
+	case "":
+		delivery.Backend = DeliveryBackendSES
+	case DeliveryBackendSES:
+	case DeliveryBackendMaildir, DeliveryBackendMbox:
+		if delivery.Path == "" {
+			return delivery, fmt.Errorf("delivery backend %s requires a path", delivery.Backend)
+		}
+	default:
+		return delivery, fmt.Errorf(
+			"invalid delivery backend %q (allowed: %s, %s, %s)",
+			delivery.Backend, DeliveryBackendSES, DeliveryBackendMaildir, DeliveryBackendMbox,
+		)
+	}
+
+	switch delivery.Mode {
+	case "":
+		delivery.Mode = DeliveryModeBatch
+	case DeliveryModeBatch, DeliveryModePerTarget:
+	default:
+		return delivery, fmt.Errorf("invalid delivery mode %q (allowed: %s, %s)", delivery.Mode, DeliveryModeBatch, DeliveryModePerTarget)
+	}
+
+	if delivery.MaxRecipientsPerCall < 0 || delivery.MaxRecipientsPerCall > MaxRecipientsPerCall {
+		return delivery, fmt.Errorf("invalid delivery maxRecipientsPerCall %d (allowed: 1-%d)", delivery.MaxRecipientsPerCall, MaxRecipientsPerCall)
+	}
+	if delivery.MaxRecipientsPerCall == 0 {
+		delivery.MaxRecipientsPerCall = MaxRecipientsPerCall
+	}
+
+	// Use the canonical header keys, like mail.Header does
+	headers := make(map[string]string, len(delivery.Headers))
+	for key, value := range delivery.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(key)] = value
+	}
+	delivery.Headers = headers
+
+	return delivery, nil
+}
+
+const (
+	defaultNoticeSubject = "Undeliverable: $subject"
+	defaultNoticeBody    = `Your message could not be delivered to the following recipients,
+as there is no such address:
+
+$recipients
+
+This is an automatically generated message, please do not reply.
+`
+)
+
+func parseUnmappedConfig(unmapped UnmappedConfig, s3 S3Config) (UnmappedConfig, []*mail.Address, error) {
+	switch unmapped.Policy {
+	case "":
+		unmapped.Policy = UnmappedPolicyFail
+	case UnmappedPolicyFail, UnmappedPolicyDrop, UnmappedPolicyCatchAll:
+	case UnmappedPolicyQuarantine, UnmappedPolicyNotify:
+		if s3.Incoming.UnmappedPrefix == "" && s3.Incoming.StateTracking != StateTrackingTags {
+			return unmapped, nil, fmt.Errorf("unmapped policy %s requires s3.incoming.unmappedPrefix", unmapped.Policy)
+		}
+	default:
+		return unmapped, nil, fmt.Errorf("invalid unmapped policy %q", unmapped.Policy)
+	}
+
+	catchAll := make([]*mail.Address, 0, len(unmapped.CatchAll))
+	for _, target := range unmapped.CatchAll {
+		address, err := mail.ParseAddress(target)
+		if err != nil {
+			return unmapped, nil, fmt.Errorf("invalid catch-all address %s: %w", target, err)
+		}
+		catchAll = append(catchAll, address)
+	}
+	if unmapped.Policy == UnmappedPolicyCatchAll && len(catchAll) == 0 {
+		return unmapped, nil, fmt.Errorf("unmapped policy %s requires catch-all targets", unmapped.Policy)
+	}
+
+	if unmapped.NoticeFromEmail != "" {
+		if _, err := mail.ParseAddress(unmapped.NoticeFromEmail); err != nil {
+			return unmapped, nil, fmt.Errorf("invalid unmapped noticeFromEmail: %w", err)
+		}
+	}
+	if unmapped.NoticeSubject == "" {
+		unmapped.NoticeSubject = defaultNoticeSubject
+	}
+	if unmapped.NoticeBody == "" {
+		unmapped.NoticeBody = defaultNoticeBody
+	}
+
+	return unmapped, catchAll, nil
+}
+
+func validateEncryptionConfig(encryption EncryptionConfig) error {
+	switch encryption.KeyProvider {
+	case "":
+		return nil
+	case KeyProviderFile:
+		if encryption.KeyFile == "" {
+			return fmt.Errorf("key provider %s requires s3.encryption.keyFile", encryption.KeyProvider)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid key provider %q", encryption.KeyProvider)
+	}
+}
+
+// Validate the retention, the objects at the protected prefixes (if not empty) are never purged
+func validateRetention(s3 S3Config, protectedPrefixes ...string) error {
+	for prefix, days := range s3.RetentionDays {
+		if days < 1 {
+			return fmt.Errorf("invalid retention of %d days for prefix %q (omit the prefix to keep its objects)", days, prefix)
+		}
+
+		// Never purge messages still to be processed or the legal hold markers
+		for _, protected := range append([]string{s3.Incoming.NewPrefix, s3.LegalHoldPrefix}, protectedPrefixes...) {
+			if strings.HasPrefix(protected, prefix) && (protected != "" || prefix == "") {
+				return fmt.Errorf("retention prefix %q covers protected prefix %q", prefix, protected)
+			}
+		}
+
+		for other := range s3.RetentionDays {
+			if other != prefix && strings.HasPrefix(other, prefix) {
+				return fmt.Errorf("retention prefixes %q and %q overlap", prefix, other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate the retention with state tracking by tags, which keeps incoming
+// messages at the new prefix. Retention of the prefixes of their states would
+// silently never purge anything.
+func validateTagsRetention(s3 S3Config) error {
+	incoming := s3.Incoming
+	for prefix := range s3.RetentionDays {
+		for _, statePrefix := range []string{incoming.SpamVirusPrefix, incoming.ForwardedPrefix, incoming.FailedPrefix, incoming.UnmappedPrefix, incoming.BlockedPrefix} {
+			if statePrefix != "" && (strings.HasPrefix(statePrefix, prefix) || strings.HasPrefix(prefix, statePrefix)) {
+				return fmt.Errorf("retention of prefix %q is not supported with state tracking %s, messages are kept at the new prefix (use lifecycle rules filtering by the forwarder-state tag)", prefix, StateTrackingTags)
+			}
+		}
+	}
+	return nil
+}
+
+// Supported sub-address delimiters
+const allowedSubAddressDelimiters = "+-."
+
+func parseDigestConfig(digest DigestConfig, normalization NormalizationConfig, mapping map[string][]*mail.Address) (DigestConfig, error) {
+	if len(digest.Keys) == 0 {
+		return digest, nil
+	}
+	if digest.Prefix == "" {
+		return digest, errors.New("digest keys require a prefix (digest.prefix)")
+	}
+
+	keys := make([]string, 0, len(digest.Keys))
+	for _, rawKey := range digest.Keys {
+		key, err := parseMappingKey(normalization, mapping, "digest", rawKey)
+		if err != nil {
+			return digest, err
+		}
+		keys = append(keys, key)
+	}
+	digest.Keys = keys
+
+	if digest.IntervalMinutes < 0 {
+		return digest, fmt.Errorf("invalid digest intervalMinutes %d", digest.IntervalMinutes)
+	}
+	if digest.IntervalMinutes == 0 {
+		digest.IntervalMinutes = defaultDigestIntervalMinutes
+	}
+
+	switch digest.Format {
+	case "":
+		digest.Format = DigestFormatMIME
+	case DigestFormatMIME, DigestFormatSummary:
+	default:
+		return digest, fmt.Errorf("invalid digest format %q (allowed: %s, %s)", digest.Format, DigestFormatMIME, DigestFormatSummary)
+	}
+
+	return digest, nil
+}
+
+// Whether messages matching the forwardMapping key are delivered as digest
+func (c *ParsedConfig) IsDigestKey(key string) bool {
+	for _, digestKey := range c.Digest.Keys {
+		if digestKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+func validateSubAddressDelimiters(delimiters string) error {
+	for _, delimiter := range delimiters {
+		if !strings.ContainsRune(allowedSubAddressDelimiters, delimiter) {
+			return fmt.Errorf("invalid sub-address delimiter %q (allowed: %s)", delimiter, allowedSubAddressDelimiters)
+		}
+	}
+	return nil
 }
 
 func LoadConfig(path string) (*RawConfig, error) {
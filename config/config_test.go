@@ -3,6 +3,7 @@ package config
 import (
 	"net/mail"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -129,3 +130,461 @@ func TestParseConfigError(t *testing.T) {
 		t.Fatalf("want %s, got %s", want, got)
 	}
 }
+
+func TestResolveProfile(t *testing.T) {
+	stringPtr := func(s string) *string { return &s }
+	boolPtr := func(b bool) *bool { return &b }
+
+	config, err := ParseConfig(&RawConfig{
+		FromEmail:     "global@example.net",
+		SubjectPrefix: "GLOBAL: ",
+		AllowPlusSign: false,
+		Profiles: map[string]DomainProfileConfig{
+			"Example.com": {
+				FromEmail:     stringPtr("forwarder@example.com"),
+				SubjectPrefix: stringPtr("[example] "),
+				AllowPlusSign: boolPtr(true),
+				Rules: map[string]RuleProfileConfig{
+					"billing@example.com": {
+						SubjectPrefix: stringPtr("[billing] "),
+					},
+				},
+			},
+			"example.org": {
+				SubjectPrefix:        stringPtr(""),
+				SubAddressDelimiters: stringPtr("+-"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		domain string
+		rule   string
+		want   Profile
+	}{
+		"global": {
+			domain: "example.net",
+			want:   Profile{FromEmail: "global@example.net", SubjectPrefix: "GLOBAL: "},
+		},
+		"domain": {
+			domain: "EXAMPLE.com",
+			rule:   "info@example.com",
+			want:   Profile{FromEmail: "forwarder@example.com", SubjectPrefix: "[example] ", AllowPlusSign: true, SubAddressDelimiters: "+"},
+		},
+		"rule": {
+			domain: "example.com",
+			rule:   "billing@example.com",
+			want:   Profile{FromEmail: "forwarder@example.com", SubjectPrefix: "[billing] ", AllowPlusSign: true, SubAddressDelimiters: "+"},
+		},
+		"cleared setting": {
+			domain: "example.org",
+			want:   Profile{FromEmail: "global@example.net", SubjectPrefix: "", SubAddressDelimiters: "+-"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, config.ResolveProfile(tc.domain, tc.rule)); diff != "" {
+				t.Errorf("profile (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseConfigProfileError(t *testing.T) {
+	fromEmail := "forwarder@example@com"
+	config := RawConfig{
+		Profiles: map[string]DomainProfileConfig{
+			"example.com": {FromEmail: &fromEmail},
+		},
+	}
+
+	if _, err := ParseConfig(&config); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestParseConfigSubAddressDelimitersError(t *testing.T) {
+	config := RawConfig{
+		SubAddressDelimiters: "+_",
+	}
+
+	_, err := ParseConfig(&config)
+	if err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+
+	if want, got := "invalid sub-address delimiter '_' (allowed: +-.)", err.Error(); want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestParseConfigDelivery(t *testing.T) {
+	parsedConfig, err := ParseConfig(&RawConfig{
+		Delivery: &DeliveryConfig{
+			Headers: map[string]string{"x-forwarded-to": "$target"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DeliveryConfig{
+		Backend:              DeliveryBackendSES,
+		Mode:                 DeliveryModeBatch,
+		MaxRecipientsPerCall: MaxRecipientsPerCall,
+		Headers:              map[string]string{"X-Forwarded-To": "$target"},
+	}
+	if diff := cmp.Diff(want, parsedConfig.Delivery); diff != "" {
+		t.Errorf("delivery (-want +got):\n%s", diff)
+	}
+
+	invalid := map[string]DeliveryConfig{
+		"mode":              {Mode: "broadcast"},
+		"too many per call": {MaxRecipientsPerCall: 51},
+		"backend":           {Backend: "smtp"},
+		"maildir w/o path":  {Backend: DeliveryBackendMaildir},
+		"mbox w/o path":     {Backend: DeliveryBackendMbox},
+	}
+	for name, delivery := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&RawConfig{Delivery: &delivery}); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigUnmapped(t *testing.T) {
+	parsedConfig, err := ParseConfig(&RawConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := UnmappedPolicyFail, parsedConfig.Unmapped.Policy; want != got {
+		t.Errorf("policy: want %v, got %v", want, got)
+	}
+
+	invalid := map[string]RawConfig{
+		"policy":                 {Unmapped: &UnmappedConfig{Policy: "ignore"}},
+		"quarantine w/o prefix":  {Unmapped: &UnmappedConfig{Policy: UnmappedPolicyQuarantine}},
+		"notify w/o prefix":      {Unmapped: &UnmappedConfig{Policy: UnmappedPolicyNotify}},
+		"catch-all w/o targets":  {Unmapped: &UnmappedConfig{Policy: UnmappedPolicyCatchAll}},
+		"invalid catch-all":      {Unmapped: &UnmappedConfig{Policy: UnmappedPolicyCatchAll, CatchAll: []string{"catch@all@example.com"}}},
+		"invalid notice address": {Unmapped: &UnmappedConfig{NoticeFromEmail: "notice@example@com"}},
+	}
+	for name, rawConfig := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&rawConfig); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigEncryption(t *testing.T) {
+	valid := EncryptionConfig{KeyProvider: KeyProviderFile, KeyFile: "/etc/forwarder/key"}
+	if _, err := ParseConfig(&RawConfig{S3: S3Config{Encryption: &valid}}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]EncryptionConfig{
+		"key provider":     {KeyProvider: "vault"},
+		"missing key file": {KeyProvider: KeyProviderFile},
+	}
+	for name, encryption := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&RawConfig{S3: S3Config{Encryption: &encryption}}); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+
+	t.Run("state tracking tags", func(t *testing.T) {
+		s3 := S3Config{Encryption: &valid, Incoming: S3IncomingConfig{StateTracking: StateTrackingTags}}
+		if _, err := ParseConfig(&RawConfig{S3: s3}); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+	})
+}
+
+func TestParseConfigRetention(t *testing.T) {
+	incoming := S3IncomingConfig{NewPrefix: "in/new/"}
+
+	valid := S3Config{
+		Incoming:        incoming,
+		RetentionDays:   map[string]int{"in/spam-virus/": 14, "out/sent/": 90},
+		LegalHoldPrefix: "legal-hold/",
+	}
+	if _, err := ParseConfig(&RawConfig{S3: valid}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]S3Config{
+		"zero days":    {Incoming: incoming, RetentionDays: map[string]int{"out/sent/": 0}},
+		"new prefix":   {Incoming: incoming, RetentionDays: map[string]int{"in/": 14}},
+		"whole bucket": {RetentionDays: map[string]int{"": 14}},
+		"legal holds":  {Incoming: incoming, RetentionDays: map[string]int{"legal-hold/": 14}, LegalHoldPrefix: "legal-hold/"},
+		"overlapping":  {Incoming: incoming, RetentionDays: map[string]int{"out/": 14, "out/sent/": 90}},
+	}
+	for name, s3 := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&RawConfig{S3: s3}); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigStateTracking(t *testing.T) {
+	parsedConfig, err := ParseConfig(&RawConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := StateTrackingMove, parsedConfig.S3.Incoming.StateTracking; want != got {
+		t.Errorf("state tracking: want %v, got %v", want, got)
+	}
+
+	// No unmapped prefix needed, as messages are not moved
+	_, err = ParseConfig(&RawConfig{
+		S3:       S3Config{Incoming: S3IncomingConfig{StateTracking: StateTrackingTags}},
+		Unmapped: &UnmappedConfig{Policy: UnmappedPolicyQuarantine},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseConfig(&RawConfig{S3: S3Config{Incoming: S3IncomingConfig{StateTracking: "rename"}}}); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+
+	// Messages are kept at the new prefix, so retention of their states would never purge them
+	incoming := S3IncomingConfig{NewPrefix: "in/new/", SpamVirusPrefix: "in/spam-virus/", ForwardedPrefix: "in/forwarded/", StateTracking: StateTrackingTags}
+	if _, err := ParseConfig(&RawConfig{S3: S3Config{Incoming: incoming, RetentionDays: map[string]int{"in/spam-virus/": 14}}}); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+	if _, err := ParseConfig(&RawConfig{S3: S3Config{Incoming: incoming, RetentionDays: map[string]int{"out/sent/": 90}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigTargets(t *testing.T) {
+	parsedConfig, err := ParseConfig(&RawConfig{
+		ForwardMapping: map[string][]string{
+			"alerts@example.com": {
+				"https://hooks.example.com/mail?token=secret",
+				"s3://mailboxes/alerts",
+				"oncall@example.net",
+			},
+		},
+		Webhook: &WebhookConfig{SecretFile: "/etc/forwarder/webhook-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Target{
+		{Kind: TargetKindWebhook, URL: "https://hooks.example.com/mail?token=secret"},
+		{Kind: TargetKindMailbox, Bucket: "mailboxes", Prefix: "alerts/"},
+	}
+	if diff := cmp.Diff(want, parsedConfig.ForwardTargets["alerts@example.com"]); diff != "" {
+		t.Errorf("targets (-want +got):\n%s", diff)
+	}
+	if want, got := 1, len(parsedConfig.ForwardMapping["alerts@example.com"]); want != got {
+		t.Errorf("addresses: want %d, got %d", want, got)
+	}
+	if want, got := "https://hooks.example.com/mail", want[0].String(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	invalid := map[string]RawConfig{
+		"http":           {ForwardMapping: map[string][]string{"alerts": {"http://hooks.example.com/mail"}}, Webhook: &WebhookConfig{SecretFile: "secret"}},
+		"missing bucket": {ForwardMapping: map[string][]string{"alerts": {"s3:///alerts/"}}},
+		"missing secret": {ForwardMapping: map[string][]string{"alerts": {"https://hooks.example.com/mail"}}},
+	}
+	for name, rawConfig := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&rawConfig); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigDigest(t *testing.T) {
+	mapping := map[string][]string{"Newsletter@Example.com": {"jane@example.net"}}
+
+	parsedConfig, err := ParseConfig(&RawConfig{
+		ForwardMapping: mapping,
+		Digest:         &DigestConfig{Keys: []string{"NEWSLETTER@example.com"}, Prefix: "digest/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DigestConfig{Keys: []string{"newsletter@example.com"}, Prefix: "digest/", IntervalMinutes: 1440, Format: DigestFormatMIME}
+	if diff := cmp.Diff(want, parsedConfig.Digest); diff != "" {
+		t.Errorf("digest (-want +got):\n%s", diff)
+	}
+	if !parsedConfig.IsDigestKey("newsletter@example.com") {
+		t.Errorf("expected newsletter@example.com to be a digest key")
+	}
+
+	invalid := map[string]RawConfig{
+		"missing prefix": {ForwardMapping: mapping, Digest: &DigestConfig{Keys: []string{"newsletter@example.com"}}},
+		"unknown key":    {ForwardMapping: mapping, Digest: &DigestConfig{Keys: []string{"news@example.com"}, Prefix: "digest/"}},
+		"format":         {ForwardMapping: mapping, Digest: &DigestConfig{Keys: []string{"newsletter@example.com"}, Prefix: "digest/", Format: "html"}},
+		"retention":      {ForwardMapping: mapping, Digest: &DigestConfig{Keys: []string{"newsletter@example.com"}, Prefix: "digest/"}, S3: S3Config{RetentionDays: map[string]int{"digest/": 7}}},
+	}
+	for name, rawConfig := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&rawConfig); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigAutoReply(t *testing.T) {
+	mapping := map[string][]string{"Info@Example.com": {"jane@example.net"}}
+	rule := AutoReplyRule{Body: "Away", Start: "2023-07-01", End: "2023-07-31"}
+
+	parsedConfig, err := ParseConfig(&RawConfig{
+		ForwardMapping: mapping,
+		AutoReply:      &AutoReplyConfig{Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{"INFO@example.com": rule}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := AutoReplyConfig{Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{
+		"info@example.com": {Subject: "Auto: $subject", Body: "Away", Start: "2023-07-01", End: "2023-07-31", IntervalDays: 7},
+	}}
+	if diff := cmp.Diff(want, parsedConfig.AutoReply); diff != "" {
+		t.Errorf("autoReply (-want +got):\n%s", diff)
+	}
+
+	active := map[string]bool{"2023-06-30T23:59:59Z": false, "2023-07-01T00:00:00Z": true, "2023-07-31T23:59:59Z": true, "2023-08-01T00:00:00Z": false}
+	for at, wantActive := range active {
+		parsedAt, _ := time.Parse(time.RFC3339, at)
+		if got := rule.ActiveAt(parsedAt); got != wantActive {
+			t.Errorf("ActiveAt(%s) = %v, want %v", at, got, wantActive)
+		}
+	}
+
+	invalid := map[string]AutoReplyConfig{
+		"missing prefix":   {Rules: map[string]AutoReplyRule{"info@example.com": rule}},
+		"unknown key":      {Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{"sales@example.com": rule}},
+		"missing body":     {Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{"info@example.com": {}}},
+		"date":             {Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{"info@example.com": {Body: "Away", Start: "07/01/2023"}}},
+		"end before start": {Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{"info@example.com": {Body: "Away", Start: "2023-07-31", End: "2023-07-01"}}},
+		"from email":       {Prefix: "auto-reply/", Rules: map[string]AutoReplyRule{"info@example.com": {Body: "Away", FromEmail: "invalid"}}},
+	}
+	for name, autoReply := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&RawConfig{ForwardMapping: mapping, AutoReply: &autoReply}); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigRelay(t *testing.T) {
+	parsedConfig, err := ParseConfig(&RawConfig{
+		Relay: &RelayConfig{Domain: "Bücher.example", SecretFile: "relay-secret", Prefix: "relay/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := RelayConfig{Domain: "xn--bcher-kva.example", LocalPart: "reply", SecretFile: "relay-secret", Prefix: "relay/"}
+	if diff := cmp.Diff(want, parsedConfig.Relay); diff != "" {
+		t.Errorf("relay (-want +got):\n%s", diff)
+	}
+
+	invalid := map[string]RawConfig{
+		"missing secret": {Relay: &RelayConfig{Domain: "example.com", Prefix: "relay/"}},
+		"missing prefix": {Relay: &RelayConfig{Domain: "example.com", SecretFile: "relay-secret"}},
+		"local part":     {Relay: &RelayConfig{Domain: "example.com", LocalPart: "reply+", SecretFile: "relay-secret", Prefix: "relay/"}},
+		"retention":      {Relay: &RelayConfig{Domain: "example.com", SecretFile: "relay-secret", Prefix: "relay/"}, S3: S3Config{RetentionDays: map[string]int{"relay/": 30}}},
+	}
+	for name, rawConfig := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&rawConfig); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseConfigSenderRules(t *testing.T) {
+	mapping := map[string][]string{"Info@Example.com": {"jane@example.net"}, "sales@example.com": {"jim@example.net"}}
+	s3 := S3Config{Incoming: S3IncomingConfig{BlockedPrefix: "in/blocked/"}}
+
+	parsedConfig, err := ParseConfig(&RawConfig{
+		ForwardMapping: mapping,
+		S3:             s3,
+		SenderRules: &SenderRulesConfig{
+			Rules: []SenderRule{
+				{Action: SenderActionDeny, Domain: "Spam.example"},
+				{Name: "newsletters", Action: SenderActionDeny, Regex: `news(letter)?@.*`},
+				{Action: SenderActionAllow, Address: "friend@spam.example"},
+			},
+			Mappings: map[string][]SenderRule{
+				"INFO@example.com": {
+					{Action: SenderActionAllow, Address: "news@example.org", Priority: 1},
+					{Action: SenderActionDeny, Regex: ".*", Priority: -1},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		key           string
+		senders       []string
+		authenticated []string
+		want          string
+	}{
+		"no match":               {key: "sales@example.com", senders: []string{"jane@example.org"}},
+		"domain":                 {key: "sales@example.com", senders: []string{"bulk@SPAM.example"}, want: "deny domain Spam.example"},
+		"subdomain":              {key: "sales@example.com", senders: []string{"bulk@mail.spam.example"}, want: "deny domain Spam.example"},
+		"deny before allow":      {key: "sales@example.com", senders: []string{"friend@spam.example"}, authenticated: []string{"friend@spam.example"}, want: "deny domain Spam.example"},
+		"regex":                  {key: "sales@example.com", senders: []string{"Newsletter@example.org"}, want: "newsletters"},
+		"any sender":             {key: "sales@example.com", senders: []string{"jane@example.org", "news@example.org"}, want: "newsletters"},
+		"mapping priority":       {key: "info@example.com", senders: []string{"news@example.org"}, authenticated: []string{"news@example.org"}, want: "allow address news@example.org"},
+		"mapping lower priority": {key: "info@example.com", senders: []string{"jane@example.org"}, want: "deny regex .*"},
+		"allow unauthenticated":  {key: "info@example.com", senders: []string{"news@example.org"}, want: "newsletters"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got string
+			if rule := parsedConfig.Senders.Match(tc.key, Senders{Addresses: tc.senders, Authenticated: tc.authenticated}); rule != nil {
+				got = rule.Name
+			}
+			if got != tc.want {
+				t.Errorf("Expected rule %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	invalid := map[string]RawConfig{
+		"missing prefix": {ForwardMapping: mapping, SenderRules: &SenderRulesConfig{Rules: []SenderRule{{Action: SenderActionDeny, Domain: "spam.example"}}}},
+		"action":         {ForwardMapping: mapping, S3: s3, SenderRules: &SenderRulesConfig{Rules: []SenderRule{{Action: "block", Domain: "spam.example"}}}},
+		"no criteria":    {ForwardMapping: mapping, S3: s3, SenderRules: &SenderRulesConfig{Rules: []SenderRule{{Action: SenderActionDeny}}}},
+		"two criteria":   {ForwardMapping: mapping, S3: s3, SenderRules: &SenderRulesConfig{Rules: []SenderRule{{Action: SenderActionDeny, Domain: "spam.example", Address: "a@spam.example"}}}},
+		"regex":          {ForwardMapping: mapping, S3: s3, SenderRules: &SenderRulesConfig{Rules: []SenderRule{{Action: SenderActionDeny, Regex: "("}}}},
+		"unknown key":    {ForwardMapping: mapping, S3: s3, SenderRules: &SenderRulesConfig{Mappings: map[string][]SenderRule{"support@example.com": {{Action: SenderActionDeny, Domain: "spam.example"}}}}},
+	}
+	for name, rawConfig := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig(&rawConfig); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// Default time after which a config loaded from S3 is revalidated
+const defaultConfigTTL = 1 * time.Minute
+
+// Create the config source based on the environment.
+//
+// If CONFIG_BUCKET and CONFIG_KEY are set, the config is loaded from the given
+// S3 object and revalidated after CONFIG_TTL (a duration like "5m").
+// Otherwise the config is expected to be present at config(.<env>).json
+func SourceFromEnv(awsConfig aws.Config) (Source, error) {
+	bucket, key := os.Getenv("CONFIG_BUCKET"), os.Getenv("CONFIG_KEY")
+	if bucket != "" && key != "" {
+		ttl := defaultConfigTTL
+		if rawTTL := os.Getenv("CONFIG_TTL"); rawTTL != "" {
+			parsedTTL, err := time.ParseDuration(rawTTL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CONFIG_TTL %s: %w", rawTTL, err)
+			}
+			ttl = parsedTTL
+		}
+
+		log.Printf("Loading config from s3://%s/%s (TTL %s)", bucket, key, ttl)
+		return NewObjectSource(storage.NewStorage(awsConfig, bucket), key, ttl), nil
+	}
+
+	configFile := "config.json"
+	env := os.Getenv("ENVIRONMENT")
+	if env != "" {
+		configFile = fmt.Sprintf("config.%s.json", env)
+	}
+
+	log.Printf("Loading config file %s", configFile)
+	return NewFileSource(configFile), nil
+}
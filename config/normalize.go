@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Case handling of an address part
+const (
+	CaseFold     = "fold"     // Compare case-insensitively (default)
+	CasePreserve = "preserve" // Compare case-sensitively
+)
+
+// Policy used to normalize recipient addresses and forwardMapping keys before lookups.
+// The zero value folds the case of both the local part and the domain.
+type NormalizationConfig struct {
+	// Case handling of the local part, "fold" (default) or "preserve".
+	// According to RFC 5321 the local part may be case-sensitive, see
+	// https://www.rfc-editor.org/rfc/rfc5321#section-2.3.11
+	LocalPartCase string `json:"localPartCase,omitempty"`
+
+	// Case handling of the domain, "fold" (default) or "preserve"
+	DomainCase string `json:"domainCase,omitempty"`
+
+	// Apply Unicode normalization form C to the whole address
+	UnicodeNFC bool `json:"unicodeNFC,omitempty"`
+
+	// Compare internationalized domains in their ASCII (punycode) form, e.g.
+	// "bücher.example" => "xn--bcher-kva.example", instead of their Unicode form.
+	// Either way, domains given in one form match the other.
+	PunycodeDomains bool `json:"punycodeDomains,omitempty"`
+
+	// Target domains ignoring dots in the local part (like gmail.com). Targets
+	// only differing in dots, e.g. "j.doe@gmail.com" and "jdoe@gmail.com", are
+	// the same mailbox and receive a message only once.
+	DotInsensitiveDomains []string `json:"dotInsensitiveDomains,omitempty"`
+}
+
+func (n *NormalizationConfig) validate() error {
+	if err := validateCase("localPartCase", n.LocalPartCase); err != nil {
+		return err
+	}
+	return validateCase("domainCase", n.DomainCase)
+}
+
+func validateCase(name string, value string) error {
+	if value != "" && value != CaseFold && value != CasePreserve {
+		return fmt.Errorf("invalid normalization %s %q (allowed: %s, %s)", name, value, CaseFold, CasePreserve)
+	}
+	return nil
+}
+
+// Normalize a full address like "Info@Example.com"
+func (n *NormalizationConfig) NormalizeAddress(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", fmt.Errorf("failed to split address %s", address)
+	}
+
+	domain, err := n.NormalizeDomain(address[at+1:])
+	if err != nil {
+		return "", err
+	}
+	localPart := n.normalizeLocalPart(address[:at])
+
+	return localPart + "@" + domain, nil
+}
+
+// Normalize a forwardMapping key, which is either a full address
+// ("info@example.com"), a domain ("@example.com"), a local part ("info")
+// or the wildcard ("@")
+func (n *NormalizationConfig) NormalizeKey(key string) (string, error) {
+	switch {
+	case key == "@":
+		return key, nil
+	case strings.HasPrefix(key, "@"):
+		domain, err := n.NormalizeDomain(key[1:])
+		if err != nil {
+			return "", err
+		}
+		return "@" + domain, nil
+	case strings.Contains(key, "@"):
+		return n.NormalizeAddress(key)
+	default:
+		return n.normalizeLocalPart(key), nil
+	}
+}
+
+// Normalize a domain like "Bücher.example"
+func (n *NormalizationConfig) NormalizeDomain(domain string) (string, error) {
+	if n.UnicodeNFC {
+		domain = norm.NFC.String(domain)
+	}
+
+	// Internationalized domains might be given in either form, so they are
+	// converted to the configured one
+	if n.PunycodeDomains && !isASCII(domain) {
+		asciiDomain, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return "", fmt.Errorf("invalid domain %s: %w", domain, err)
+		}
+		domain = asciiDomain
+	} else if !n.PunycodeDomains && isPunycode(domain) {
+		unicodeDomain, err := idna.Lookup.ToUnicode(domain)
+		if err != nil {
+			return "", fmt.Errorf("invalid domain %s: %w", domain, err)
+		}
+		domain = unicodeDomain
+	}
+
+	if n.DomainCase != CasePreserve {
+		domain = strings.ToLower(domain)
+	}
+
+	return domain, nil
+}
+
+// Normalize a local part
+func (n *NormalizationConfig) normalizeLocalPart(localPart string) string {
+	if n.UnicodeNFC {
+		localPart = norm.NFC.String(localPart)
+	}
+
+	if n.LocalPartCase != CasePreserve {
+		localPart = strings.ToLower(localPart)
+	}
+
+	return localPart
+}
+
+// Returns the key identifying the mailbox of a target address, targets with
+// the same key are delivered to only once. Mailboxes are compared
+// case-insensitively, ignoring the dots of dot-insensitive domains.
+func (n *NormalizationConfig) TargetKey(address string) string {
+	key := strings.ToLower(address)
+	at := strings.LastIndex(key, "@")
+	if at < 0 || !n.isDotInsensitive(key[at+1:]) {
+		return key
+	}
+	return strings.ReplaceAll(key[:at], ".", "") + key[at:]
+}
+
+func (n *NormalizationConfig) isDotInsensitive(domain string) bool {
+	for _, dotInsensitiveDomain := range n.DotInsensitiveDomains {
+		if strings.EqualFold(dotInsensitiveDomain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any label of the domain is in its ASCII (punycode) form, e.g. "xn--bcher-kva.example"
+func isPunycode(domain string) bool {
+	domain = strings.ToLower(domain)
+	return strings.HasPrefix(domain, "xn--") || strings.Contains(domain, ".xn--")
+}
+
+// Whether the string only consists of ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
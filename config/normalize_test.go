@@ -0,0 +1,115 @@
+package config
+
+import "testing"
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := map[string]struct {
+		policy  NormalizationConfig
+		address string
+		want    string
+	}{
+		"default":                {policy: NormalizationConfig{}, address: "Info@Example.COM", want: "info@example.com"},
+		"preserve local part":    {policy: NormalizationConfig{LocalPartCase: CasePreserve}, address: "Info@Example.COM", want: "Info@example.com"},
+		"preserve domain":        {policy: NormalizationConfig{DomainCase: CasePreserve}, address: "Info@Example.COM", want: "info@Example.COM"},
+		"nfc":                    {policy: NormalizationConfig{UnicodeNFC: true}, address: "jürgen@example.com", want: "jürgen@example.com"},
+		"without nfc":            {policy: NormalizationConfig{}, address: "jürgen@example.com", want: "jürgen@example.com"},
+		"unicode":                {policy: NormalizationConfig{}, address: "info@Bücher.example", want: "info@bücher.example"},
+		"unicode from punycode":  {policy: NormalizationConfig{}, address: "info@XN--BCHER-KVA.example", want: "info@bücher.example"},
+		"punycode":               {policy: NormalizationConfig{PunycodeDomains: true}, address: "info@Bücher.example", want: "info@xn--bcher-kva.example"},
+		"punycode already ascii": {policy: NormalizationConfig{PunycodeDomains: true}, address: "info@XN--BCHER-KVA.example", want: "info@xn--bcher-kva.example"},
+		"last at sign is domain": {policy: NormalizationConfig{}, address: "\"a@b\"@Example.com", want: "\"a@b\"@example.com"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.policy.NormalizeAddress(tc.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.want; want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestTargetKey(t *testing.T) {
+	policy := NormalizationConfig{DotInsensitiveDomains: []string{"gmail.com"}}
+
+	tests := map[string]string{
+		"J.Doe@GMail.com":   "jdoe@gmail.com",
+		"jdoe@gmail.com":    "jdoe@gmail.com",
+		"J.Doe@example.com": "j.doe@example.com",
+		"invalid":           "invalid",
+	}
+
+	for address, want := range tests {
+		t.Run(address, func(t *testing.T) {
+			if got := policy.TargetKey(address); want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	policy := NormalizationConfig{PunycodeDomains: true}
+
+	tests := map[string]string{
+		"@":                   "@",
+		"@Bücher.example":     "@xn--bcher-kva.example",
+		"Info":                "info",
+		"Info@Bücher.example": "info@xn--bcher-kva.example",
+	}
+
+	for key, want := range tests {
+		t.Run(key, func(t *testing.T) {
+			got, err := policy.NormalizeKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestParseConfigNormalizesKeys(t *testing.T) {
+	config, err := ParseConfig(&RawConfig{
+		ForwardMapping: map[string][]string{
+			"Info@Example.com": {"info@example.net"},
+			"@EXAMPLE.org":     {"domain@example.net"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"info@example.com", "@example.org"} {
+		if _, ok := config.ForwardMapping[key]; !ok {
+			t.Errorf("expected normalized key %s", key)
+		}
+	}
+}
+
+func TestParseConfigDuplicateNormalizedKeys(t *testing.T) {
+	_, err := ParseConfig(&RawConfig{
+		ForwardMapping: map[string][]string{
+			"Info@Example.com": {"info@example.net"},
+			"info@example.com": {"other@example.net"},
+		},
+	})
+	if err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestParseConfigInvalidNormalization(t *testing.T) {
+	_, err := ParseConfig(&RawConfig{
+		Normalization: &NormalizationConfig{LocalPartCase: "upper"},
+	})
+	if err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import "strings"
+
+// The effective settings for a recipient after applying the global
+// configuration, the domain profile and the rule profile (in this order)
+type Profile struct {
+	FromEmail     string
+	ToEmail       string
+	SubjectPrefix string
+	AllowPlusSign bool
+
+	// Effective sub-address delimiters (derived from allowPlusSign if not set explicitly)
+	SubAddressDelimiters string
+}
+
+// Resolve the effective profile for the given recipient domain and the
+// forwardMapping key (rule) the recipient matched. Rule may be empty if the
+// recipient has not been matched (yet).
+func (c *ParsedConfig) ResolveProfile(domain string, rule string) Profile {
+	profile := Profile{
+		FromEmail:     c.FromEmail,
+		ToEmail:       c.ToEmail,
+		SubjectPrefix: c.SubjectPrefix,
+		AllowPlusSign: c.AllowPlusSign,
+	}
+	profile.SubAddressDelimiters = subAddressDelimiters(c.SubAddressDelimiters, c.AllowPlusSign)
+
+	normalizedDomain, err := c.Normalization.NormalizeDomain(domain)
+	if err != nil {
+		normalizedDomain = strings.ToLower(domain)
+	}
+
+	domainProfile, ok := c.Profiles[normalizedDomain]
+	if !ok {
+		return profile
+	}
+
+	overrideString(&profile.FromEmail, domainProfile.FromEmail)
+	overrideString(&profile.ToEmail, domainProfile.ToEmail)
+	overrideString(&profile.SubjectPrefix, domainProfile.SubjectPrefix)
+	if domainProfile.AllowPlusSign != nil {
+		profile.AllowPlusSign = *domainProfile.AllowPlusSign
+		profile.SubAddressDelimiters = subAddressDelimiters("", profile.AllowPlusSign)
+	}
+	overrideString(&profile.SubAddressDelimiters, domainProfile.SubAddressDelimiters)
+
+	if ruleProfile, ok := domainProfile.Rules[rule]; ok && rule != "" {
+		overrideString(&profile.FromEmail, ruleProfile.FromEmail)
+		overrideString(&profile.ToEmail, ruleProfile.ToEmail)
+		overrideString(&profile.SubjectPrefix, ruleProfile.SubjectPrefix)
+	}
+
+	return profile
+}
+
+func subAddressDelimiters(delimiters string, allowPlusSign bool) string {
+	if delimiters == "" && allowPlusSign {
+		return "+"
+	}
+	return delimiters
+}
+
+func overrideString(target *string, override *string) {
+	if override != nil {
+		*target = *override
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Default local part of the reverse addresses of the relay
+const defaultRelayLocalPart = "reply"
+
+// Configuration of the reply relay (see package relay). If enabled, Reply-To
+// of forwarded messages is replaced with a reverse address on the relay
+// domain, replies to it are delivered to the original sender from the alias.
+type RelayConfig struct {
+	Domain     string `json:"domain,omitempty"`     // Domain of the reverse addresses, e.g. "example.com" (enables the relay, must be a receiving domain of SES)
+	LocalPart  string `json:"localPart,omitempty"`  // Local part of the reverse addresses before the token (defaults to "reply")
+	SecretFile string `json:"secretFile,omitempty"` // Path of the file containing the token secret (required)
+	Prefix     string `json:"prefix,omitempty"`     // Prefix (directory) of the reverse address entries (required)
+}
+
+// Whether the reply relay is enabled
+func (r RelayConfig) Enabled() bool {
+	return r.Domain != ""
+}
+
+func parseRelayConfig(relay RelayConfig) (RelayConfig, error) {
+	if !relay.Enabled() {
+		return relay, nil
+	}
+
+	// Reverse addresses are used as Reply-To, so in their ASCII form
+	domain, err := idna.Lookup.ToASCII(relay.Domain)
+	if err != nil {
+		return relay, fmt.Errorf("invalid relay domain %s: %w", relay.Domain, err)
+	}
+	relay.Domain = strings.ToLower(domain)
+
+	if relay.LocalPart == "" {
+		relay.LocalPart = defaultRelayLocalPart
+	}
+	if strings.ContainsAny(relay.LocalPart, "+@ ") {
+		return relay, fmt.Errorf("invalid relay localPart %q", relay.LocalPart)
+	}
+	relay.LocalPart = strings.ToLower(relay.LocalPart)
+
+	if relay.SecretFile == "" {
+		return relay, errors.New("relay requires a token secret (relay.secretFile)")
+	}
+	if relay.Prefix == "" {
+		return relay, errors.New("relay requires a prefix (relay.prefix)")
+	}
+
+	return relay, nil
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Actions of sender rules
+const (
+	SenderActionAllow = "allow"
+	SenderActionDeny  = "deny"
+)
+
+// Allow and deny rules of senders, applied before the message is fetched.
+// Messages denied for all recipients are moved to s3.incoming.blockedPrefix.
+//
+// The global rules and the rules of the forwardMapping key a recipient
+// matched are applied by priority, the first matching rule decides. Senders
+// not matched by any rule are allowed. To only allow known senders, add allow
+// rules and a deny rule with a lower priority matching all senders (regex ".*").
+//
+// Deny rules match the envelope sender and the From addresses. Allow rules
+// only match authenticated addresses, as the addresses can be forged: the
+// envelope sender if SPF passed and the From addresses if DMARC passed.
+// Replies to reverse addresses of the relay are subject to the global rules.
+type SenderRulesConfig struct {
+	Rules    []SenderRule            `json:"rules,omitempty"`    // Global rules
+	Mappings map[string][]SenderRule `json:"mappings,omitempty"` // Rules per forwardMapping key
+}
+
+// A sender rule matching exactly one of address, domain or regex
+type SenderRule struct {
+	Name     string `json:"name,omitempty"`     // Recorded if the rule matched (defaults to e.g. "deny domain example.org")
+	Action   string `json:"action"`             // One of the SenderAction* constants
+	Address  string `json:"address,omitempty"`  // Exact address, e.g. "spam@example.org"
+	Domain   string `json:"domain,omitempty"`   // Domain including its subdomains, e.g. "example.org"
+	Regex    string `json:"regex,omitempty"`    // Regular expression matched against the whole address (case-insensitive)
+	Priority int    `json:"priority,omitempty"` // Rules with a higher priority are applied first, deny before allow on equal priority
+}
+
+// The addresses of the sender of a message matched by the sender rules
+type Senders struct {
+	Addresses     []string // All addresses, matched by deny rules
+	Authenticated []string // The authenticated addresses, matched by allow rules
+}
+
+// The parsed sender rules, see SenderRulesConfig
+type SenderRules struct {
+	global   []senderMatcher
+	mappings map[string][]senderMatcher
+}
+
+type senderMatcher struct {
+	rule  SenderRule
+	regex *regexp.Regexp
+}
+
+func (m senderMatcher) matches(address string) bool {
+	address = strings.ToLower(address)
+	switch {
+	case m.rule.Address != "":
+		return address == m.rule.Address
+	case m.rule.Domain != "":
+		domain := address[strings.LastIndex(address, "@")+1:]
+		return domain == m.rule.Domain || strings.HasSuffix(domain, "."+m.rule.Domain)
+	default:
+		return m.regex.MatchString(address)
+	}
+}
+
+// Returns the rule deciding about the senders of a message to a recipient
+// that matched the given forwardMapping key (may be empty), nil if no rule
+// matched. A deny rule matches if it matches any of the addresses, an allow
+// rule if it matches any of the authenticated addresses.
+func (r *SenderRules) Match(key string, senders Senders) *SenderRule {
+	if r == nil {
+		return nil
+	}
+
+	matchers := append(append([]senderMatcher{}, r.global...), r.mappings[key]...)
+	sort.SliceStable(matchers, func(i, j int) bool {
+		if matchers[i].rule.Priority != matchers[j].rule.Priority {
+			return matchers[i].rule.Priority > matchers[j].rule.Priority
+		}
+		return matchers[i].rule.Action == SenderActionDeny && matchers[j].rule.Action != SenderActionDeny
+	})
+
+	for _, matcher := range matchers {
+		addresses := senders.Addresses
+		if matcher.rule.Action == SenderActionAllow {
+			addresses = senders.Authenticated
+		}
+		for _, sender := range addresses {
+			if matcher.matches(sender) {
+				rule := matcher.rule
+				return &rule
+			}
+		}
+	}
+	return nil
+}
+
+func parseSenderRulesConfig(senderRules SenderRulesConfig, s3 S3Config, normalization NormalizationConfig, mapping map[string][]*mail.Address) (*SenderRules, error) {
+	if len(senderRules.Rules) == 0 && len(senderRules.Mappings) == 0 {
+		return nil, nil
+	}
+	if s3.Incoming.BlockedPrefix == "" && s3.Incoming.StateTracking != StateTrackingTags {
+		return nil, errors.New("sender rules require s3.incoming.blockedPrefix")
+	}
+
+	global, err := parseSenderRules(senderRules.Rules)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &SenderRules{global: global, mappings: make(map[string][]senderMatcher, len(senderRules.Mappings))}
+
+	for rawKey, rules := range senderRules.Mappings {
+		key, err := parseMappingKey(normalization, mapping, "sender rules", rawKey)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.mappings[key], err = parseSenderRules(rules); err != nil {
+			return nil, fmt.Errorf("invalid sender rules of %s: %w", rawKey, err)
+		}
+	}
+
+	return parsed, nil
+}
+
+func parseSenderRules(rules []SenderRule) ([]senderMatcher, error) {
+	matchers := make([]senderMatcher, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Action != SenderActionAllow && rule.Action != SenderActionDeny {
+			return nil, fmt.Errorf("invalid action %q of sender rule %d (allowed: %s, %s)", rule.Action, i+1, SenderActionAllow, SenderActionDeny)
+		}
+
+		matcher := senderMatcher{rule: rule}
+		criteria := 0
+		if rule.Address != "" {
+			criteria++
+			matcher.rule.Address = strings.ToLower(rule.Address)
+			if matcher.rule.Name == "" {
+				matcher.rule.Name = rule.Action + " address " + rule.Address
+			}
+		}
+		if rule.Domain != "" {
+			criteria++
+			matcher.rule.Domain = strings.ToLower(strings.TrimPrefix(rule.Domain, "@"))
+			if matcher.rule.Name == "" {
+				matcher.rule.Name = rule.Action + " domain " + rule.Domain
+			}
+		}
+		if rule.Regex != "" {
+			criteria++
+			regex, err := regexp.Compile("(?i)^(?:" + rule.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex of sender rule %d: %w", i+1, err)
+			}
+			matcher.regex = regex
+			if matcher.rule.Name == "" {
+				matcher.rule.Name = rule.Action + " regex " + rule.Regex
+			}
+		}
+		if criteria != 1 {
+			return nil, fmt.Errorf("sender rule %d must have exactly one of address, domain or regex", i+1)
+		}
+
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
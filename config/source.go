@@ -0,0 +1,134 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// A source the forwarder configuration can be loaded from
+type Source interface {
+	// Returns the current configuration
+	Config() (*ParsedConfig, error)
+}
+
+// Source loading the configuration from a file once
+type FileSource struct {
+	path   string
+	mu     sync.Mutex
+	config *ParsedConfig
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Config() (*ParsedConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config != nil {
+		return s.config, nil
+	}
+
+	config, err := LoadAndParseConfig(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.config = config
+
+	return s.config, nil
+}
+
+// Conditional access to an object, implemented by storage.Storage
+type ObjectReader interface {
+	// Must return storage.ErrNotModified if the object still matches the given ETag
+	GetIfNoneMatch(key string, etag string) (io.ReadCloser, string, error)
+}
+
+// Source loading the configuration from an object in the storage bucket.
+//
+// The loaded configuration is cached and revalidated against the ETag of the
+// object once the TTL expired. If a new version of the object fails to load
+// or parse, the last good configuration is kept.
+type ObjectSource struct {
+	reader ObjectReader
+	key    string
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	config    *ParsedConfig
+	etag      string
+	checkedAt time.Time
+}
+
+func NewObjectSource(reader ObjectReader, key string, ttl time.Duration) *ObjectSource {
+	return &ObjectSource{
+		reader: reader,
+		key:    key,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+func (s *ObjectSource) Config() (*ParsedConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.config != nil && now.Sub(s.checkedAt) < s.ttl {
+		return s.config, nil
+	}
+
+	config, etag, err := s.load()
+	if err != nil {
+		if s.config == nil {
+			return nil, err
+		}
+		if !errors.Is(err, storage.ErrNotModified) {
+			log.Printf("Keeping last good config (ETag %s): %v", s.etag, err)
+		}
+		s.checkedAt = now
+		return s.config, nil
+	}
+
+	log.Printf("Loaded config %s (ETag %s)", s.key, etag)
+	s.config, s.etag, s.checkedAt = config, etag, now
+
+	return s.config, nil
+}
+
+func (s *ObjectSource) load() (*ParsedConfig, string, error) {
+	body, etag, err := s.reader.GetIfNoneMatch(s.key, s.etag)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotModified) {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("failed to read config object %s: %w", s.key, err)
+	}
+	defer body.Close()
+
+	bytes, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read config object %s: %w", s.key, err)
+	}
+
+	rawConfig := RawConfig{}
+	if err := json.Unmarshal(bytes, &rawConfig); err != nil {
+		return nil, "", fmt.Errorf("failed to deserialize config object: %w", err)
+	}
+
+	config, err := ParseConfig(&rawConfig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return config, etag, nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+type fakeObjectReader struct {
+	content string
+	etag    string
+	err     error
+	calls   int
+}
+
+func (r *fakeObjectReader) GetIfNoneMatch(key string, etag string) (io.ReadCloser, string, error) {
+	r.calls++
+	if r.err != nil {
+		return nil, "", r.err
+	}
+	if etag == r.etag {
+		return nil, etag, storage.ErrNotModified
+	}
+	return io.NopCloser(strings.NewReader(r.content)), r.etag, nil
+}
+
+func TestObjectSource(t *testing.T) {
+	reader := &fakeObjectReader{
+		content: `{"fromEmail": "v1@example.net", "forwardMapping": {"info": ["info@example.net"]}}`,
+		etag:    "v1",
+	}
+
+	now := time.Date(2022, 11, 22, 19, 16, 0, 0, time.UTC)
+	source := NewObjectSource(reader, "config.json", time.Minute)
+	source.now = func() time.Time { return now }
+
+	assertFromEmail := func(want string) {
+		t.Helper()
+		config, err := source.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := config.FromEmail; want != got {
+			t.Errorf("FromEmail: want %v, got %v", want, got)
+		}
+	}
+
+	assertFromEmail("v1@example.net")
+
+	// Cached within TTL
+	reader.content, reader.etag = `{"fromEmail": "v2@example.net"}`, "v2"
+	assertFromEmail("v1@example.net")
+	if want, got := 1, reader.calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+
+	// Reloaded after TTL
+	now = now.Add(time.Minute)
+	assertFromEmail("v2@example.net")
+
+	// Invalid version keeps last good config
+	now = now.Add(time.Minute)
+	reader.content, reader.etag = `{"forwardMapping": {"info": ["info@example@net"]}}`, "v3"
+	assertFromEmail("v2@example.net")
+
+	// Failing storage keeps last good config
+	now = now.Add(time.Minute)
+	reader.err = errors.New("access denied")
+	assertFromEmail("v2@example.net")
+}
+
+func TestObjectSourceNotModified(t *testing.T) {
+	reader := &fakeObjectReader{
+		content: `{"fromEmail": "v1@example.net"}`,
+		etag:    "v1",
+	}
+
+	now := time.Date(2022, 11, 22, 19, 16, 0, 0, time.UTC)
+	source := NewObjectSource(reader, "config.json", time.Minute)
+	source.now = func() time.Time { return now }
+
+	first, err := source.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Minute)
+	second, err := source.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Errorf("expected unchanged config to be reused")
+	}
+	if want, got := 2, reader.calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+}
+
+func TestObjectSourceInitialError(t *testing.T) {
+	reader := &fakeObjectReader{
+		content: `{"forwardMapping": {"info": ["info@example@net"]}}`,
+		etag:    "v1",
+	}
+
+	source := NewObjectSource(reader, "config.json", time.Minute)
+	if _, err := source.Config(); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Kinds of non-email forward targets
+const (
+	TargetKindWebhook = "webhook" // POST a signed JSON payload to an HTTPS URL
+	TargetKindMailbox = "mailbox" // Store the raw message at a S3 prefix
+)
+
+// A non-email forward target, e.g. "https://hooks.example.com/mail" or
+// "s3://bucket/mailboxes/alerts/"
+type Target struct {
+	Kind   string
+	URL    string // The URL of a webhook
+	Bucket string // The bucket of a mailbox
+	Prefix string // The prefix of a mailbox (might be empty)
+}
+
+// Returns the target without credentials and query, which might contain secrets
+func (t Target) String() string {
+	switch t.Kind {
+	case TargetKindWebhook:
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return "https://?"
+		}
+		u.User = nil
+		u.RawQuery = ""
+		u.Fragment = ""
+		return u.String()
+	default:
+		return "s3://" + t.Bucket + "/" + t.Prefix
+	}
+}
+
+// Whether a forwardMapping value is a non-email target (a URL)
+func isTarget(value string) bool {
+	return strings.Contains(value, "://")
+}
+
+// Parse a non-email forward target
+func ParseTarget(value string) (Target, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return Target{}, err
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return Target{}, fmt.Errorf("missing host")
+		}
+		return Target{Kind: TargetKindWebhook, URL: value}, nil
+	case "s3":
+		if u.Host == "" {
+			return Target{}, fmt.Errorf("missing bucket")
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return Target{Kind: TargetKindMailbox, Bucket: u.Host, Prefix: prefix}, nil
+	default:
+		return Target{}, fmt.Errorf("unsupported scheme %q (allowed: https, s3)", u.Scheme)
+	}
+}
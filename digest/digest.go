@@ -0,0 +1,311 @@
+// Package digest sends the messages queued for digest delivery (see
+// config.DigestConfig) as a single message per target.
+//
+// Queued messages are stored as JSON entries at
+// <prefix>pending/<target>/<messageId>.json, the time the last digest has
+// been sent to a target at <prefix>sent/<target> (RFC 3339).
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// Maximum total size of the messages included in a MIME digest, further
+// messages are only listed in the summary (SES allows 40MB per message)
+const maxDigestMessagesSize = 30 * 1024 * 1024
+
+// Storage of the queued messages, implemented by storage.Storage
+type digestStorage interface {
+	Get(key string) (io.ReadCloser, int64, error)
+	Put(key string, reader io.Reader) (*string, error)
+	Delete(key string) error
+	List(prefix string) ([]storage.ObjectInfo, error)
+}
+
+// Sending of raw messages, implemented by sender.Sender
+type messageSender interface {
+	SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error)
+}
+
+// A message queued for the digest of a target
+type Entry struct {
+	MessageId  string    `json:"messageId"`  // The SES message ID
+	MessageKey string    `json:"messageKey"` // The key the message is stored at after processing
+	Recipient  string    `json:"recipient"`  // The original recipient
+	Target     string    `json:"target"`     // The target address the digest is sent to
+	Rule       string    `json:"rule"`       // The forwardMapping key that matched the recipient
+	From       []string  `json:"from"`
+	Subject    string    `json:"subject"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Returns the key of the queued message to the given target
+func PendingKey(prefix string, target string, messageId string) string {
+	return pendingPrefix(prefix) + strings.ToLower(target) + "/" + messageId + ".json"
+}
+
+func pendingPrefix(prefix string) string {
+	return prefix + "pending/"
+}
+
+func sentKey(prefix string, target string) string {
+	return prefix + "sent/" + target
+}
+
+// Outcome of a digest run
+type Result struct {
+	Targets  int // Targets with queued messages
+	Sent     int // Digests sent
+	Messages int // Queued messages included in the sent digests
+	Skipped  int // Targets whose interval has not elapsed yet
+}
+
+// Sends the digests of the queued messages
+type Digester struct {
+	config  *config.ParsedConfig
+	storage digestStorage
+	sender  messageSender
+}
+
+func NewDigester(config *config.ParsedConfig, storage digestStorage, sender messageSender) *Digester {
+	return &Digester{config: config, storage: storage, sender: sender}
+}
+
+// Send a digest to each target with queued messages whose interval has
+// elapsed at the given time, or to all of them if forced. Sending continues
+// with the next target if it fails for a target.
+func (d *Digester) Run(ctx context.Context, now time.Time, force bool) (*Result, error) {
+	prefix := d.config.Digest.Prefix
+	if prefix == "" {
+		log.Print("No digest prefix configured")
+		return &Result{}, nil
+	}
+
+	pending, err := d.pendingKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]string, 0, len(pending))
+	for target := range pending {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	result := &Result{Targets: len(targets)}
+	interval := time.Duration(d.config.Digest.IntervalMinutes) * time.Minute
+	var errs []error
+	for _, target := range targets {
+		if !force {
+			last, err := d.lastSent(target)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if now.Sub(last) < interval {
+				log.Printf("Skipping digest to %s (last sent %s)", target, last.Format(time.RFC3339))
+				result.Skipped++
+				continue
+			}
+		}
+
+		sent, err := d.send(ctx, now, target, pending[target])
+		if err != nil {
+			log.Printf("Failed to send digest to %s: %v", target, err)
+			errs = append(errs, err)
+			continue
+		}
+		result.Sent++
+		result.Messages += sent
+	}
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("failed to send %d of %d digests: %w", len(errs), len(targets), errs[0])
+	}
+	return result, nil
+}
+
+// Returns the keys of the queued messages by target
+func (d *Digester) pendingKeys() (map[string][]string, error) {
+	prefix := pendingPrefix(d.config.Digest.Prefix)
+	objects, err := d.storage.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queued messages: %w", err)
+	}
+
+	pending := make(map[string][]string)
+	for _, object := range objects {
+		target, name, ok := strings.Cut(object.Key[len(prefix):], "/")
+		if !ok || !strings.HasSuffix(name, ".json") {
+			log.Printf("Ignoring unexpected object %s", object.Key)
+			continue
+		}
+		pending[target] = append(pending[target], object.Key)
+	}
+	return pending, nil
+}
+
+// Returns the time the last digest has been sent to the target (zero if never)
+func (d *Digester) lastSent(target string) (time.Time, error) {
+	key := sentKey(d.config.Digest.Prefix, target)
+	data, err := d.read(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time at %s: %w", key, err)
+	}
+	return last, nil
+}
+
+// Send the digest of the given queued messages, returns the number of messages
+func (d *Digester) send(ctx context.Context, now time.Time, target string, keys []string) (int, error) {
+	entries := make([]*Entry, 0, len(keys))
+	for _, key := range keys {
+		data, err := d.read(key)
+		if err != nil {
+			return 0, err
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return 0, fmt.Errorf("invalid queued message at %s: %w", key, err)
+		}
+		entries = append(entries, &entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ReceivedAt.Before(entries[j].ReceivedAt)
+	})
+
+	to, err := mail.ParseAddress(entries[0].Target)
+	if err != nil {
+		return 0, fmt.Errorf("invalid digest target %s: %w", entries[0].Target, err)
+	}
+	from, err := d.fromAddress(entries[0])
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := d.build(from, to, entries, now)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Sending digest of %d messages to %s...", len(entries), target)
+	messageId, err := d.sender.SendMessage(ctx, from.String(), []string{to.String()}, data)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Sending digest succeeded with message ID %s", *messageId)
+
+	key := sentKey(d.config.Digest.Prefix, target)
+	if _, err := d.storage.Put(key, strings.NewReader(now.UTC().Format(time.RFC3339))); err != nil {
+		return 0, fmt.Errorf("failed to store digest state at %s: %w", key, err)
+	}
+
+	for _, key := range keys {
+		if err := d.storage.Delete(key); err != nil {
+			// Sent again with the next digest
+			log.Printf("Failed to delete queued message %s: %v", key, err)
+		}
+	}
+
+	return len(entries), nil
+}
+
+// Returns the sender of the digest: the from email of the profile of the
+// first message or its original recipient
+func (d *Digester) fromAddress(entry *Entry) (*mail.Address, error) {
+	address := entry.Recipient
+	domain := address[strings.LastIndex(address, "@")+1:]
+	if profile := d.config.ResolveProfile(domain, entry.Rule); profile.FromEmail != "" {
+		address = profile.FromEmail
+	}
+
+	from, err := mail.ParseAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest sender %s: %w", address, err)
+	}
+
+	from, err = envelope.SourceAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest sender %s: %w", address, err)
+	}
+	return from, nil
+}
+
+// Build the digest in the configured format
+func (d *Digester) build(from *mail.Address, to *mail.Address, entries []*Entry, now time.Time) ([]byte, error) {
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "%d messages received since the last digest:\n", len(entries))
+
+	var messages [][]byte
+	size := 0
+	for i, entry := range entries {
+		fmt.Fprintf(&summary, "\n%d. %s\n   From: %s\n   To: %s\n   Date: %s\n",
+			i+1, entry.Subject, strings.Join(entry.From, ", "), entry.Recipient, entry.ReceivedAt.Format(time.RFC1123Z))
+
+		if d.config.Digest.Format == config.DigestFormatSummary {
+			fmt.Fprintf(&summary, "   s3://%s/%s\n", d.config.S3.BucketName, entry.MessageKey)
+			continue
+		}
+
+		data, err := d.read(entry.MessageKey)
+		if errors.Is(err, storage.ErrNotFound) {
+			summary.WriteString("   (no longer available)\n")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if size+len(data) > maxDigestMessagesSize {
+			fmt.Fprintf(&summary, "   (not included due to its size, see s3://%s/%s)\n", d.config.S3.BucketName, entry.MessageKey)
+			continue
+		}
+		size += len(data)
+		messages = append(messages, data)
+	}
+
+	data, err := message.BuildDigest(&message.Digest{
+		From:     from,
+		To:       to,
+		Subject:  fmt.Sprintf("Digest of %d messages", len(entries)),
+		Summary:  summary.String(),
+		Messages: messages,
+	}, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build digest: %w", err)
+	}
+	return data, nil
+}
+
+func (d *Digester) read(key string) ([]byte, error) {
+	reader, _, err := d.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(reader); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,236 @@
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+	"github.com/google/go-cmp/cmp"
+)
+
+type sentMessage struct {
+	source       string
+	destinations []string
+	data         []byte
+}
+
+type fakeSender struct {
+	sent []sentMessage
+}
+
+func (s *fakeSender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
+	s.sent = append(s.sent, sentMessage{source: source, destinations: destinations, data: data})
+	messageId := fmt.Sprintf("sent-%d", len(s.sent))
+	return &messageId, nil
+}
+
+func parseConfig(t *testing.T, format string) *config.ParsedConfig {
+	cfg, err := config.ParseConfig(&config.RawConfig{
+		S3: config.S3Config{
+			BucketName: "mail",
+			Incoming:   config.S3IncomingConfig{NewPrefix: "in/new/", ForwardedPrefix: "in/forwarded/"},
+		},
+		ForwardMapping: map[string][]string{"news@example.com": {"me@example.net"}},
+		Digest:         &config.DigestConfig{Keys: []string{"news@example.com"}, Prefix: "digest/", Format: format},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func queue(t *testing.T, st *storage.FileStorage, messageId string, receivedAt time.Time) {
+	data, err := json.Marshal(&Entry{
+		MessageId:  messageId,
+		MessageKey: "in/forwarded/" + messageId,
+		Recipient:  "news@example.com",
+		Target:     "me@example.net",
+		Rule:       "news@example.com",
+		From:       []string{"sender@example.org"},
+		Subject:    "Subject of " + messageId,
+		ReceivedAt: receivedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Put(PendingKey("digest/", "me@example.net", messageId), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func keys(t *testing.T, st *storage.FileStorage, prefix string) []string {
+	objects, err := st.List(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+func TestRun(t *testing.T) {
+	now := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		lastSent    string
+		force       bool
+		wantResult  Result
+		wantPending []string
+	}{
+		"never sent": {
+			wantResult:  Result{Targets: 1, Sent: 1, Messages: 2},
+			wantPending: []string{},
+		},
+		"interval elapsed": {
+			lastSent:    "2023-05-09T08:00:00Z",
+			wantResult:  Result{Targets: 1, Sent: 1, Messages: 2},
+			wantPending: []string{},
+		},
+		"interval not elapsed": {
+			lastSent:    "2023-05-09T09:00:00Z",
+			wantResult:  Result{Targets: 1, Skipped: 1},
+			wantPending: []string{"digest/pending/me@example.net/message-1.json", "digest/pending/me@example.net/message-2.json"},
+		},
+		"forced": {
+			lastSent:    "2023-05-09T09:00:00Z",
+			force:       true,
+			wantResult:  Result{Targets: 1, Sent: 1, Messages: 2},
+			wantPending: []string{},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			st := storage.NewFileStorage(t.TempDir())
+			queue(t, st, "message-2", now.Add(-time.Hour))
+			queue(t, st, "message-1", now.Add(-2*time.Hour))
+			if tc.lastSent != "" {
+				st.Put("digest/sent/me@example.net", strings.NewReader(tc.lastSent))
+			}
+
+			sender := &fakeSender{}
+			result, err := NewDigester(parseConfig(t, ""), st, sender).Run(context.Background(), now, tc.force)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.wantResult, *result); diff != "" {
+				t.Errorf("result (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantPending, keys(t, st, "digest/pending/")); diff != "" {
+				t.Errorf("pending (-want +got):\n%s", diff)
+			}
+			if len(sender.sent) != tc.wantResult.Sent {
+				t.Errorf("Expected %d sent digests, got %d", tc.wantResult.Sent, len(sender.sent))
+			}
+		})
+	}
+}
+
+func TestRunMIME(t *testing.T) {
+	now := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+	st := storage.NewFileStorage(t.TempDir())
+	queue(t, st, "message-2", now.Add(-time.Hour))
+	queue(t, st, "message-1", now.Add(-2*time.Hour))
+	st.Put("in/forwarded/message-1", strings.NewReader("Subject: Subject of message-1\r\n\r\nFirst\r\n"))
+
+	sender := &fakeSender{}
+	if _, err := NewDigester(parseConfig(t, ""), st, sender).Run(context.Background(), now, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected a single digest, got %d", len(sender.sent))
+	}
+	sent := sender.sent[0]
+	if diff := cmp.Diff([]string{"<me@example.net>"}, sent.destinations); diff != "" {
+		t.Errorf("destinations (-want +got):\n%s", diff)
+	}
+	if sent.source != "<news@example.com>" {
+		t.Errorf("Expected source <news@example.com>, got %s", sent.source)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(sent.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Auto-Submitted"); got != "auto-generated" {
+		t.Errorf("Expected Auto-Submitted auto-generated, got %q", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/digest" {
+		t.Fatalf("Expected multipart/digest, got %s", mediaType)
+	}
+
+	var parts []string
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(data))
+	}
+
+	if len(parts) != 2 {
+		t.Fatalf("Expected summary and one message part, got %d parts", len(parts))
+	}
+	for _, want := range []string{"1. Subject of message-1", "2. Subject of message-2", "(no longer available)"} {
+		if !strings.Contains(parts[0], want) {
+			t.Errorf("Expected summary to contain %q, got:\n%s", want, parts[0])
+		}
+	}
+	if want := "Subject: Subject of message-1\r\n\r\nFirst\r\n"; parts[1] != want {
+		t.Errorf("Expected message part %q, got %q", want, parts[1])
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	now := time.Date(2023, 5, 10, 8, 0, 0, 0, time.UTC)
+	st := storage.NewFileStorage(t.TempDir())
+	queue(t, st, "message-1", now.Add(-time.Hour))
+
+	sender := &fakeSender{}
+	if _, err := NewDigester(parseConfig(t, config.DigestFormatSummary), st, sender).Run(context.Background(), now, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected a single digest, got %d", len(sender.sent))
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(sender.sent[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type")); mediaType != "text/plain" {
+		t.Errorf("Expected text/plain, got %s", mediaType)
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "s3://mail/in/forwarded/message-1"; !strings.Contains(string(body), want) {
+		t.Errorf("Expected body to contain %q, got:\n%s", want, body)
+	}
+}
@@ -1,6 +1,6 @@
 //go:build e2e
 
-package main
+package e2e
 
 import (
 	"context"
@@ -19,7 +19,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sesv2"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
 	"github.com/aws/smithy-go"
-	"github.com/codezombiech/aws-mail-forwarder-test/message"
 )
 
 type testMailAppResponse struct {
@@ -131,17 +130,11 @@ func receiveTestMail(t *testing.T, config testConfig, timestamp int64) *mail.Mes
 }
 
 func validateMail(t *testing.T, config testConfig, mail *mail.Message, timestamp int64) {
-	if expected, actual := fmt.Sprintf("FORWARDER: Test subject %d", timestamp), mail.Header.Get(message.SubjectKey); expected != actual {
-		t.Errorf("expected %s, got %s", expected, actual)
-	}
-
-	if expected, actual := "\"e2e Test Sender at sender@e2e-test.aws-mail-forwarder.org\" <recipient@e2e-test.aws-mail-forwarder.org>", mail.Header.Get(message.FromKey); expected != actual {
-		t.Errorf("expected %s, got %s", expected, actual)
-	}
-
-	if expected, actual := "e2e Test Recipient <recipient@e2e-test.aws-mail-forwarder.org>", mail.Header.Get(message.ToKey); expected != actual {
-		t.Errorf("expected %s, got %s", expected, actual)
-	}
+	ValidateMail(t, mail, Expectation{
+		Subject: fmt.Sprintf("FORWARDER: Test subject %d", timestamp),
+		From:    "\"e2e Test Sender at sender@e2e-test.aws-mail-forwarder.org\" <recipient@e2e-test.aws-mail-forwarder.org>",
+		To:      "e2e Test Recipient <recipient@e2e-test.aws-mail-forwarder.org>",
+	})
 }
 
 type testConfig struct {
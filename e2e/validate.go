@@ -0,0 +1,35 @@
+// Package e2e contains the end-to-end tests run against a deployed forwarder
+// (build tag e2e) and the validation rules shared with the offline suite in
+// cmd/lambda.
+package e2e
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+)
+
+// Expected headers of a forwarded message
+type Expectation struct {
+	Subject string // Including the subject prefix
+	From    string // The rewritten sender
+	To      string // The original recipients, which are kept
+}
+
+// Validate the headers of a forwarded message as received by the target
+func ValidateMail(t testing.TB, mail *mail.Message, want Expectation) {
+	t.Helper()
+
+	if expected, actual := want.Subject, mail.Header.Get(message.SubjectKey); expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	if expected, actual := want.From, mail.Header.Get(message.FromKey); expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	if expected, actual := want.To, mail.Header.Get(message.ToKey); expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,35 @@
+package envelope
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+)
+
+// Matches all errors caused by an invalid sender or recipient address
+var ErrInvalidAddress = errors.New("invalid address")
+
+// Error returned for an invalid sender or recipient address.
+// Invalid addresses won't become valid when retried, so the error is permanent.
+type AddressError struct {
+	Role    string // "sender" or "recipient"
+	Address string
+	Err     error
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("invalid %s address %v: %v", e.Role, e.Address, e.Err)
+}
+
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AddressError) Is(target error) bool {
+	return target == ErrInvalidAddress
+}
+
+func (e *AddressError) FailureClass() failure.Class {
+	return failure.Permanent
+}
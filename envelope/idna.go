@@ -0,0 +1,69 @@
+package envelope
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Convert the domain of an address to its ASCII (punycode) form, e.g.
+// "jürgen@bücher.example" => "jürgen@xn--bcher-kva.example".
+// The local part is left as is, since there is no ASCII form of it (RFC 6531).
+func ToASCIIDomain(address string) (string, error) {
+	localPart, domain, err := splitAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	if isASCII(domain) {
+		return address, nil
+	}
+
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain in address %s: %w", address, err)
+	}
+
+	return localPart + "@" + asciiDomain, nil
+}
+
+// Same as ToASCIIDomain, keeping the name of the address
+func ToASCIIDomainAddress(address *mail.Address) (*mail.Address, error) {
+	asciiAddress, err := ToASCIIDomain(address.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &mail.Address{Name: address.Name, Address: asciiAddress}, nil
+}
+
+// Returns the address to send a message from (the envelope sender), without
+// name. SES requires internationalized domains in their ASCII form.
+func SourceAddress(address *mail.Address) (*mail.Address, error) {
+	asciiAddress, err := ToASCIIDomain(address.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &mail.Address{Address: asciiAddress}, nil
+}
+
+// Whether the local part of an address requires SMTPUTF8 (RFC 6531)
+func RequiresSMTPUTF8(address string) bool {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return !isASCII(address)
+	}
+	return !isASCII(address[:at])
+}
+
+// Whether the string only consists of ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package envelope
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Placeholder replaced by the sub-address tag in targets and header templates
+const TagPlaceholder = "$tag"
+
+// Split a local part into its base and its sub-address tag at the first of
+// the given delimiters, e.g. "user+billing" => "user", "billing".
+// Returns the unmodified local part and an empty tag if there is no tag.
+func SplitTag(localPart string, delimiters string) (string, string) {
+	if delimiters == "" {
+		return localPart, ""
+	}
+
+	i := strings.IndexAny(localPart, delimiters)
+	if i <= 0 || i == len(localPart)-1 {
+		// No delimiter, no base ("+tag") or no tag ("user+")
+		return localPart, ""
+	}
+
+	return localPart[:i], localPart[i+1:]
+}
+
+// Replace the tag placeholder in a header template
+func ExpandTag(template string, tag string) string {
+	return strings.ReplaceAll(template, TagPlaceholder, tag)
+}
+
+// Replace the tag placeholder in a target address, e.g. "me+$tag@example.com".
+// Without a tag, the placeholder is removed along with a preceding delimiter.
+// Tags that are no dot-atom (e.g. of a quoted local part like "a@b c") are
+// treated as absent, they would not result in a valid address.
+func expandTagInAddress(address *mail.Address, tag string) *mail.Address {
+	if !strings.Contains(address.Address, TagPlaceholder) {
+		return address
+	}
+
+	if tag != "" && !isDotAtom(tag) {
+		log.Printf("Ignoring tag %q, it is not a dot-atom", tag)
+		tag = ""
+	}
+
+	expanded := address.Address
+	if tag == "" {
+		for _, delimiter := range []string{"+", "-", "."} {
+			expanded = strings.ReplaceAll(expanded, delimiter+TagPlaceholder, "")
+		}
+	}
+	expanded = ExpandTag(expanded, tag)
+
+	return &mail.Address{
+		Name:    ExpandTag(address.Name, tag),
+		Address: expanded,
+	}
+}
+
+// Whether the string is a dot-atom of RFC 5322 (atext separated by single
+// dots), allowing non-ASCII characters of internationalized addresses
+func isDotAtom(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if r < utf8.RuneSelf && !isAtext(byte(r)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Whether the ASCII character is an atext character of RFC 5322
+func isAtext(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+	}
+}
@@ -0,0 +1,97 @@
+package envelope
+
+import (
+	"testing"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplitTag(t *testing.T) {
+	tests := map[string]struct {
+		localPart  string
+		delimiters string
+		wantBase   string
+		wantTag    string
+	}{
+		"no delimiters":      {localPart: "user+tag", delimiters: "", wantBase: "user+tag", wantTag: ""},
+		"plus":               {localPart: "user+tag", delimiters: "+", wantBase: "user", wantTag: "tag"},
+		"dash":               {localPart: "user-tag", delimiters: "+-", wantBase: "user", wantTag: "tag"},
+		"dot":                {localPart: "first.last", delimiters: ".", wantBase: "first", wantTag: "last"},
+		"first delimiter":    {localPart: "user-a+b", delimiters: "+-", wantBase: "user", wantTag: "a+b"},
+		"other delimiter":    {localPart: "user-tag", delimiters: "+", wantBase: "user-tag", wantTag: ""},
+		"empty base":         {localPart: "+tag", delimiters: "+", wantBase: "+tag", wantTag: ""},
+		"trailing delimiter": {localPart: "user+", delimiters: "+", wantBase: "user+", wantTag: ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			base, tag := SplitTag(tc.localPart, tc.delimiters)
+			if base != tc.wantBase || tag != tc.wantTag {
+				t.Errorf("want %q, %q, got %q, %q", tc.wantBase, tc.wantTag, base, tag)
+			}
+		})
+	}
+}
+
+func TestTransformRecipientsTagRouting(t *testing.T) {
+	rawConfig := config.RawConfig{
+		SubAddressDelimiters: "+-",
+		ForwardMapping: map[string][]string{
+			"user@example.com": {
+				"me+$tag@example.net",
+			},
+			"user+billing@example.com": {
+				"accounting@example.net",
+			},
+			"no-reply@example.com": {
+				"no-reply@example.net",
+			},
+			"support": {
+				"support-$tag@example.net",
+			},
+		},
+	}
+
+	config, err := config.ParseConfig(&rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		input    string
+		wantRule string
+		wantTag  string
+		want     []string
+	}{
+		"untagged":                 {input: "user@example.com", wantRule: "user@example.com", wantTag: "", want: []string{"me@example.net"}},
+		"tag substitution":         {input: "user+shop@example.com", wantRule: "user@example.com", wantTag: "shop", want: []string{"me+shop@example.net"}},
+		"tagged rule":              {input: "user+billing@example.com", wantRule: "user+billing@example.com", wantTag: "", want: []string{"accounting@example.net"}},
+		"tagged rule other delim":  {input: "user-billing@example.com", wantRule: "user@example.com", wantTag: "billing", want: []string{"me+billing@example.net"}},
+		"delimiter in exact match": {input: "no-reply@example.com", wantRule: "no-reply@example.com", wantTag: "", want: []string{"no-reply@example.net"}},
+		"local part fallback":      {input: "support+urgent@example.org", wantRule: "support", wantTag: "urgent", want: []string{"support-urgent@example.net"}},
+		"local part without tag":   {input: "support@example.org", wantRule: "support", wantTag: "", want: []string{"support@example.net"}},
+		"quoted tag":               {input: `"user+a@b c"@example.com`, wantRule: "user@example.com", wantTag: "a@b c", want: []string{"me@example.net"}},
+		"tag with dots":            {input: "user+a.b@example.com", wantRule: "user@example.com", wantTag: "a.b", want: []string{"me+a.b@example.net"}},
+		"tag with trailing dot":    {input: `"user+a."@example.com`, wantRule: "user@example.com", wantTag: "a.", want: []string{"me@example.net"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			transformed, err := TransformRecipients(config, []string{tc.input})
+			if err != nil {
+				t.Fatalf("transformation failed: %v\n", err)
+			}
+
+			if want, got := tc.wantRule, transformed[0].Rule; want != got {
+				t.Errorf("rule: want %v, got %v", want, got)
+			}
+			if want, got := tc.wantTag, transformed[0].Tag; want != got {
+				t.Errorf("tag: want %v, got %v", want, got)
+			}
+			if diff := cmp.Diff(tc.want, toStringAddresses(transformed[0].Transformed)); diff != "" {
+				t.Errorf("targets (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
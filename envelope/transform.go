@@ -1,10 +1,10 @@
 package envelope
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/mail"
-	"regexp"
 	"strings"
 
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
@@ -13,6 +13,25 @@ import (
 type TransformationResult struct {
 	Source      *mail.Address
 	Transformed []*mail.Address
+	Targets     []config.Target // The non-email targets (webhooks, mailboxes)
+	Rule        string          // The forwardMapping key that matched the source address (empty if none matched)
+	Tag         string          // The sub-address tag of the source address, e.g. "billing" for "user+billing@example.com"
+}
+
+// Resolve the profile of the first original recipient
+func ResolveProfile(config *config.ParsedConfig, transformations []TransformationResult) config.Profile {
+	if len(transformations) == 0 || transformations[0].Source == nil {
+		return config.ResolveProfile("", "")
+	}
+
+	// There might me multiple original recipients
+	// For the sake of simplicity, we take the first one
+	transformation := transformations[0]
+	_, domain, err := splitAddress(transformation.Source.Address)
+	if err != nil {
+		return config.ResolveProfile("", "")
+	}
+	return config.ResolveProfile(domain, transformation.Rule)
 }
 
 // Transform the original senders to a single new sender for the new message to send
@@ -26,15 +45,20 @@ func TransformSenders(config *config.ParsedConfig, senders []string, transformat
 	for _, sender := range senders {
 		senderAddress, err := mail.ParseAddress(sender)
 		if err != nil {
-			return nil, fmt.Errorf("invalid sender address %v: %w", sender, err)
+			return nil, &AddressError{Role: "sender", Address: sender, Err: err}
 		}
 		senderAddresses = append(senderAddresses, senderAddress)
 	}
 
+	if len(senderAddresses) == 0 {
+		return nil, &AddressError{Role: "sender", Err: errors.New("no sender")}
+	}
+
 	// Calculate address part
+	profile := ResolveProfile(config, transformations)
 	var addressPart string
-	if len(config.FromEmail) > 0 {
-		addressPart = config.FromEmail
+	if len(profile.FromEmail) > 0 {
+		addressPart = profile.FromEmail
 	} else {
 		// There might me multiple original recipients
 		// For the sake of simplicity, we take the first one
@@ -52,6 +76,15 @@ func TransformSenders(config *config.ParsedConfig, senders []string, transformat
 		namePart = fromAddress.Address
 	}
 
+	// SES requires the domain of the sender in its ASCII form
+	addressPart, err := ToASCIIDomain(addressPart)
+	if err != nil {
+		return nil, &AddressError{Role: "sender", Address: addressPart, Err: err}
+	}
+	if RequiresSMTPUTF8(addressPart) {
+		log.Printf("Sender address %v has a non-ASCII local part, sending will most likely fail", addressPart)
+	}
+
 	return &mail.Address{
 		Name:    namePart,
 		Address: addressPart,
@@ -65,7 +98,7 @@ func TransformRecipients(config *config.ParsedConfig, recipients []string) ([]Tr
 	for _, recipient := range recipients {
 		recipientAddress, err := mail.ParseAddress(recipient)
 		if err != nil {
-			return nil, fmt.Errorf("invalid recipient address %v: %w", recipient, err)
+			return nil, &AddressError{Role: "recipient", Address: recipient, Err: err}
 		}
 		recipientAddresses = append(recipientAddresses, recipientAddress)
 	}
@@ -75,48 +108,63 @@ func TransformRecipients(config *config.ParsedConfig, recipients []string) ([]Tr
 	for _, recipient := range recipientAddresses {
 		mappingsForRecipient := make([]*mail.Address, 0)
 
-		// TODO: Check if it is smart to be case insensitive => At least document it!
-		// According to specs user part can be case sensitive:
-		// - https://stackoverflow.com/a/9808332/548020
-		// - https://www.rfc-editor.org/rfc/rfc5321#section-2.3.11
-		recipientAddress := strings.ToLower(recipient.Address)
-
-		if config.AllowPlusSign {
-			log.Printf("Replacing + sign from recipient %v", recipientAddress)
-			var re = regexp.MustCompile(`\+.*?@`)
-			recipientAddress = re.ReplaceAllString(recipientAddress, `@`)
-			log.Printf("Replaced + sign to %v", recipientAddress)
+		// Normalize according to the configured policy (case insensitive by default).
+		// Mapping keys have been normalized the same way by config.ParseConfig.
+		recipientAddress, err := config.Normalization.NormalizeAddress(recipient.Address)
+		if err != nil {
+			return nil, &AddressError{Role: "recipient", Address: recipient.Address, Err: err}
 		}
 
-		if mapping, ok := config.ForwardMapping[recipientAddress]; ok {
-			// Exact match
-			mappingsForRecipient = append(mappingsForRecipient, mapping...)
-		} else {
-			// Test for partial matches
-
-			// TODO: Check if it would be better to replace the matching strategy by regex?
+		localPart, domain, err := splitAddress(recipientAddress)
+		if err != nil {
+			return nil, &AddressError{Role: "recipient", Address: recipient.Address, Err: err}
+		}
 
-			localPart, domain, err := splitAddress(recipientAddress)
-			if err != nil {
-				return nil, err
-			}
+		// Sub-addressing, e.g. "user+tag@example.com"
+		baseLocalPart, tag := SplitTag(localPart, config.ResolveProfile(domain, "").SubAddressDelimiters)
+		if tag != "" {
+			log.Printf("Found tag %v in recipient %v", tag, recipientAddress)
+		}
 
-			if mapping, ok := config.ForwardMapping["@"+domain]; ok {
-				// domain match, e.g. "@example.com"
-				mappingsForRecipient = append(mappingsForRecipient, mapping...)
-			} else if mapping, ok := config.ForwardMapping[localPart]; ok {
-				// local part match, e.g. "info"
-				mappingsForRecipient = append(mappingsForRecipient, mapping...)
-			} else if mapping, ok := config.ForwardMapping["@"]; ok {
-				// Wildcard match, "@"
-				mappingsForRecipient = append(mappingsForRecipient, mapping...)
+		// Candidate keys by priority. The tagged variants take precedence
+		// over the tag-stripped ones, so "user+billing@" can be routed
+		// differently from "user@".
+		// TODO: Check if it would be better to replace the matching strategy by regex?
+		candidates := []string{recipientAddress}
+		if tag != "" {
+			candidates = append(candidates, baseLocalPart+"@"+domain)
+		}
+		candidates = append(candidates, "@"+domain, localPart)
+		if tag != "" {
+			candidates = append(candidates, baseLocalPart)
+		}
+		candidates = append(candidates, "@")
+
+		var rule string
+		for _, candidate := range candidates {
+			if mapping, ok := config.ForwardMapping[candidate]; ok {
+				rule = candidate
+				if candidate == recipientAddress || candidate == localPart {
+					// The tag is part of the matched key (e.g. "no-reply@"), so it is no tag
+					tag = ""
+				}
+				for _, target := range mapping {
+					mappingsForRecipient = append(mappingsForRecipient, expandTagInAddress(target, tag))
+				}
+				break
 			}
 		}
 
-		transformations = append(transformations, TransformationResult{
+		transformation := TransformationResult{
 			Source:      recipient,
 			Transformed: mappingsForRecipient,
-		})
+			Rule:        rule,
+			Tag:         tag,
+		}
+		if rule != "" {
+			transformation.Targets = config.ForwardTargets[rule]
+		}
+		transformations = append(transformations, transformation)
 	}
 
 	return transformations, nil
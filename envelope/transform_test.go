@@ -2,6 +2,7 @@ package envelope
 
 import (
 	"net/mail"
+	"strings"
 	"testing"
 
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
@@ -305,3 +306,143 @@ func TestTransformSendersWithConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestTransformWithProfiles(t *testing.T) {
+	fromEmail := "forwarder@example.org"
+	allowPlusSign := false
+	rawConfig := getRawConfig()
+	rawConfig.ForwardMapping["@example.org"] = []string{"domain-match@example.com"}
+	rawConfig.Profiles = map[string]config.DomainProfileConfig{
+		"example.org": {
+			FromEmail:     &fromEmail,
+			AllowPlusSign: &allowPlusSign,
+		},
+	}
+
+	config, err := config.ParseConfig(rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transformed, err := TransformRecipients(config, []string{"info+tag@example.org"})
+	if err != nil {
+		t.Fatalf("transformation failed: %v\n", err)
+	}
+
+	// Plus sign is not stripped for example.org, so the local part rule "info" does not match
+	if want, got := "@example.org", transformed[0].Rule; want != got {
+		t.Errorf("rule: want %v, got %v", want, got)
+	}
+
+	newSender, err := TransformSenders(config, []string{"sender@example.net"}, transformed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff("\"sender@example.net\" <forwarder@example.org>", newSender.String()); diff != "" {
+		t.Errorf("new sender (-want +got):\n%s", diff)
+	}
+}
+
+func TestTransformRecipientsNormalization(t *testing.T) {
+	rawConfig := config.RawConfig{
+		Normalization: &config.NormalizationConfig{
+			LocalPartCase: config.CasePreserve,
+		},
+		ForwardMapping: map[string][]string{
+			"Info@Bücher.example": {
+				"case-match@example.com",
+			},
+			"@BÜCHER.example": {
+				"domain-match@example.com",
+			},
+		},
+	}
+
+	config, err := config.ParseConfig(&rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		input string
+		want  []string
+	}{
+		"exact case":     {input: "Info@xn--bcher-kva.example", want: []string{"case-match@example.com"}},
+		"different case": {input: "info@xn--bcher-kva.example", want: []string{"domain-match@example.com"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			transformed, err := TransformRecipients(config, []string{tc.input})
+			if err != nil {
+				t.Fatalf("transformation failed: %v\n", err)
+			}
+			if diff := cmp.Diff(tc.want, toStringAddresses(transformed[0].Transformed)); diff != "" {
+				t.Errorf("targets (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTransformInternationalizedAddresses(t *testing.T) {
+	rawConfig := config.RawConfig{
+		ForwardMapping: map[string][]string{
+			"jürgen@bücher.example": {
+				"Jürgen <ich@münchen.example>",
+			},
+		},
+	}
+
+	config, err := config.ParseConfig(&rawConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"unicode":    "jürgen@bücher.example",
+		"punycode":   "jürgen@xn--bcher-kva.example",
+		"upper case": "JÜRGEN@BÜCHER.example",
+		"with name":  "Jürgen <jürgen@bücher.example>",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			transformed, err := TransformRecipients(config, []string{input})
+			if err != nil {
+				t.Fatalf("transformation failed: %v\n", err)
+			}
+			if diff := cmp.Diff([]string{"ich@münchen.example"}, toStringAddresses(transformed[0].Transformed)); diff != "" {
+				t.Errorf("targets (-want +got):\n%s", diff)
+			}
+
+			newSender, err := TransformSenders(config, []string{"Sender <sender@example.com>"}, transformed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(newSender.Address, "@xn--bcher-kva.example") {
+				t.Errorf("expected ASCII domain, got %v", newSender.Address)
+			}
+		})
+	}
+}
+
+func TestToASCIIDomain(t *testing.T) {
+	tests := map[string]string{
+		"info@example.com":      "info@example.com",
+		"info@bücher.example":   "info@xn--bcher-kva.example",
+		"jürgen@bücher.example": "jürgen@xn--bcher-kva.example",
+	}
+
+	for input, want := range tests {
+		t.Run(input, func(t *testing.T) {
+			got, err := ToASCIIDomain(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Package failure groups errors by how an event causing them should be treated.
+package failure
+
+import "errors"
+
+// The class of an error, deciding whether the event causing it is retried
+type Class int
+
+const (
+	// The error might not occur again, the event should be retried (default)
+	Transient Class = iota
+	// The error will occur again, the event must not be retried
+	Permanent
+	// The error has already been handled (e.g. the message has been moved), nothing to do
+	Handled
+)
+
+func (c Class) String() string {
+	switch c {
+	case Permanent:
+		return "permanent"
+	case Handled:
+		return "handled"
+	default:
+		return "transient"
+	}
+}
+
+// Implemented by errors that know their class
+type classifier interface {
+	FailureClass() Class
+}
+
+type classifiedError struct {
+	class Class
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) FailureClass() Class {
+	return e.class
+}
+
+// Mark an error as transient
+func AsTransient(err error) error {
+	return wrap(Transient, err)
+}
+
+// Mark an error as permanent
+func AsPermanent(err error) error {
+	return wrap(Permanent, err)
+}
+
+// Mark an error as already handled
+func AsHandled(err error) error {
+	return wrap(Handled, err)
+}
+
+func wrap(class Class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// Returns the class of an error. The outermost classified error in the chain
+// takes precedence, unclassified errors are considered transient.
+func Classify(err error) Class {
+	var c classifier
+	if errors.As(err, &c) {
+		return c.FailureClass()
+	}
+	return Transient
+}
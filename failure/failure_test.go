@@ -0,0 +1,33 @@
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var errTest = errors.New("test")
+
+func TestClassify(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want Class
+	}{
+		"unclassified": {err: errTest, want: Transient},
+		"permanent":    {err: AsPermanent(errTest), want: Permanent},
+		"handled":      {err: AsHandled(errTest), want: Handled},
+		"wrapped":      {err: fmt.Errorf("context: %w", AsPermanent(errTest)), want: Permanent},
+		"reclassified": {err: AsHandled(fmt.Errorf("context: %w", AsPermanent(errTest))), want: Handled},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if want, got := tc.want, Classify(tc.err); want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+			if !errors.Is(tc.err, errTest) {
+				t.Errorf("expected original error to be preserved")
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// Returns why no auto-reply must be sent for a message with the given header
+// (empty if it may be replied to). Automatically generated messages and
+// mailing list messages are never replied to, see RFC 3834 section 2.
+func autoReplySuppressed(header mail.Header) string {
+	if value := strings.ToLower(strings.TrimSpace(header.Get(message.AutoSubmittedKey))); value != "" && value != "no" {
+		return message.AutoSubmittedKey + ": " + value
+	}
+
+	switch precedence := strings.ToLower(strings.TrimSpace(header.Get("Precedence"))); precedence {
+	case "bulk", "list", "junk":
+		return "Precedence: " + precedence
+	}
+
+	for key := range header {
+		if strings.HasPrefix(strings.ToLower(key), "list-") {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// Returns the key of the time the given rule last replied to the sender
+func (f *Forwarder) autoReplyStateKey(rule string, sender string) string {
+	return f.config.AutoReply.Prefix + rule + "/" + strings.ToLower(sender)
+}
+
+// Whether the rule replied to the sender within its interval
+func (f *Forwarder) repliedRecently(key string, rule config.AutoReplyRule, now time.Time) (bool, error) {
+	reader, _, err := f.storage.Get(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return false, err
+	}
+	last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return false, err
+	}
+
+	return now.Sub(last) < time.Duration(rule.IntervalDays)*24*time.Hour, nil
+}
+
+// Send the auto-replies of the active rules matching the recipients, at most
+// once per rule and sender within the interval of the rule. Must only be
+// called once the message reached its final state, so a retried event does
+// not reply twice. Failures are only logged, as replies are best effort.
+func (f *Forwarder) autoReply(ctx context.Context, event *events.SimpleEmailService, transformedRecipients []envelope.TransformationResult, header mail.Header) {
+	if len(f.config.AutoReply.Rules) == 0 {
+		return
+	}
+
+	now := time.Now()
+	replied := make(map[string]bool)
+	for _, transformation := range transformedRecipients {
+		rule, ok := f.config.AutoReply.Rules[transformation.Rule]
+		if !ok || replied[transformation.Rule] || !rule.ActiveAt(now) {
+			continue
+		}
+		replied[transformation.Rule] = true
+
+		if reason := autoReplySuppressed(header); reason != "" {
+			log.Printf("Not sending auto-reply to automatic or list message (%s)", reason)
+			return
+		}
+
+		// Only authenticated senders, so the alias does not reply to forged ones
+		to, ok := noticeRecipient(event)
+		if !ok {
+			return
+		}
+
+		f.sendAutoReply(ctx, event, transformation, rule, to, now)
+	}
+}
+
+func (f *Forwarder) sendAutoReply(ctx context.Context, event *events.SimpleEmailService, transformation envelope.TransformationResult, rule config.AutoReplyRule, to *mail.Address, now time.Time) {
+	key := f.autoReplyStateKey(transformation.Rule, to.Address)
+	recently, err := f.repliedRecently(key, rule, now)
+	if err != nil {
+		// Rather not reply than reply too often
+		log.Printf("Failed to get auto-reply state at %s: %v", key, err)
+		return
+	}
+	if recently {
+		log.Printf("Not sending auto-reply to %s (replied within %d days)", to.Address, rule.IntervalDays)
+		return
+	}
+
+	from := transformation.Source
+	if rule.FromEmail != "" {
+		parsedFrom, err := mail.ParseAddress(rule.FromEmail)
+		if err != nil {
+			log.Printf("Invalid auto-reply sender %s: %v", rule.FromEmail, err)
+			return
+		}
+		from = parsedFrom
+	}
+
+	source, err := envelope.SourceAddress(from)
+	if err != nil {
+		log.Printf("Invalid auto-reply sender %s: %v", from.Address, err)
+		return
+	}
+
+	replacer := strings.NewReplacer(
+		"$subject", event.Mail.CommonHeaders.Subject,
+		"$recipient", transformation.Source.Address,
+		"$sender", to.Address,
+	)
+
+	data, err := message.BuildNotice(&message.Notice{
+		From:      source,
+		To:        to,
+		Subject:   replacer.Replace(rule.Subject),
+		Body:      replacer.Replace(rule.Body),
+		InReplyTo: event.Mail.CommonHeaders.MessageID,
+	}, now)
+	if err != nil {
+		log.Printf("Failed to build auto-reply: %v", err)
+		return
+	}
+
+	if _, err := f.sendMessage(ctx, source.Address, []*mail.Address{to}, data); err != nil {
+		log.Printf("Failed to send auto-reply to %s: %v", to.Address, err)
+		return
+	}
+	log.Printf("Sent auto-reply of %s to %s", transformation.Rule, to.Address)
+
+	if _, err := f.storage.Put(key, strings.NewReader(now.UTC().Format(time.RFC3339))); err != nil {
+		log.Printf("Failed to store auto-reply state at %s: %v", key, err)
+	}
+}
@@ -0,0 +1,244 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+)
+
+// A target address a message is delivered to
+type deliveryTarget struct {
+	Address   *mail.Address // The target address
+	Recipient *mail.Address // The original recipient the target was mapped from
+	Tag       string        // The sub-address tag of the original recipient
+	ReplyTo   string        // The reverse address of the relay replacing the Reply-To (empty if none)
+}
+
+// The outcome of delivering a message to a single target
+type DeliveryResult struct {
+	Recipient string // The target address
+	MessageId string // The ID of the sent message (if succeeded)
+	Err       error  // The error (if failed)
+}
+
+// Collect the targets of all transformed recipients, ignoring duplicates
+func (f *Forwarder) collectTargets(transformedRecipients []envelope.TransformationResult) []deliveryTarget {
+	targets := make([]deliveryTarget, 0)
+	seen := make(map[string]bool)
+
+	for _, transformation := range transformedRecipients {
+		for _, target := range transformation.Transformed {
+			key := f.config.Normalization.TargetKey(target.Address)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			targets = append(targets, deliveryTarget{
+				Address:   target,
+				Recipient: transformation.Source,
+				Tag:       transformation.Tag,
+			})
+		}
+	}
+
+	return targets
+}
+
+// Deliver the message to all targets according to the configured delivery mode
+func (f *Forwarder) deliver(ctx context.Context, source string, targets []deliveryTarget, originalMessageId string, msg *message.BufferedMessage) ([]DeliveryResult, error) {
+	log.Printf("Delivering message to %d targets (mode %s)...", len(targets), f.config.Delivery.Mode)
+
+	var results []DeliveryResult
+	var err error
+	if f.config.Delivery.Mode == config.DeliveryModePerTarget {
+		results, err = f.deliverPerTarget(ctx, source, targets, originalMessageId, msg)
+	} else {
+		results, err = f.deliverBatched(ctx, source, targets, originalMessageId, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("Delivery to %s failed: %v", result.Recipient, result.Err)
+		} else {
+			log.Printf("Delivery to %s succeeded with message ID %s", result.Recipient, result.MessageId)
+		}
+	}
+
+	return results, nil
+}
+
+// Send a single message to all targets with the same Reply-To, chunked to the
+// maximum number of recipients per call
+func (f *Forwarder) deliverBatched(ctx context.Context, source string, targets []deliveryTarget, originalMessageId string, msg *message.BufferedMessage) ([]DeliveryResult, error) {
+	chunkSize := f.config.Delivery.MaxRecipientsPerCall
+	if chunkSize < 1 {
+		chunkSize = config.MaxRecipientsPerCall
+	}
+
+	groups := groupByReplyTo(targets)
+	results := make([]DeliveryResult, 0, len(targets))
+	for _, group := range groups {
+		header := msg.Header
+		if group[0].ReplyTo != "" {
+			header = message.CloneHeader(msg.Header)
+			message.SetRelayReplyTo(header, group[0].ReplyTo)
+		}
+
+		data, err := f.buildMessage(&message.BufferedMessage{Header: header, Body: msg.Body})
+		if err != nil {
+			// Other groups might have been sent already, which a retry would repeat
+			for _, target := range group {
+				results = append(results, DeliveryResult{Recipient: target.Address.Address, Err: err})
+			}
+			continue
+		}
+
+		groupResults := make([]DeliveryResult, 0, len(group))
+		for start := 0; start < len(group); start += chunkSize {
+			end := start + chunkSize
+			if end > len(group) {
+				end = len(group)
+			}
+
+			addresses := make([]*mail.Address, 0, end-start)
+			for _, target := range group[start:end] {
+				addresses = append(addresses, target.Address)
+			}
+
+			messageId, err := f.sendMessage(ctx, source, addresses, data)
+			for _, address := range addresses {
+				groupResults = append(groupResults, DeliveryResult{Recipient: address.Address, MessageId: messageId, Err: err})
+			}
+		}
+
+		name := originalMessageId
+		if len(groups) > 1 {
+			name += "/" + group[0].Recipient.Address
+		}
+		f.storeOutgoingMessage(name, groupResults, data)
+		results = append(results, groupResults...)
+	}
+
+	return results, nil
+}
+
+// Group the targets by their Reply-To, keeping their order
+func groupByReplyTo(targets []deliveryTarget) [][]deliveryTarget {
+	groups := make([][]deliveryTarget, 0, 1)
+	indexes := make(map[string]int)
+	for _, target := range targets {
+		i, ok := indexes[target.ReplyTo]
+		if !ok {
+			i = len(groups)
+			indexes[target.ReplyTo] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], target)
+	}
+	return groups
+}
+
+// Send a personalized message to each target
+func (f *Forwarder) deliverPerTarget(ctx context.Context, source string, targets []deliveryTarget, originalMessageId string, msg *message.BufferedMessage) ([]DeliveryResult, error) {
+	results := make([]DeliveryResult, 0, len(targets))
+
+	for _, target := range targets {
+		header := message.CloneHeader(msg.Header)
+		message.SetTargetHeaders(header, f.config.Delivery.Headers, target.Address, target.Recipient, target.Tag)
+		if target.ReplyTo != "" {
+			message.SetRelayReplyTo(header, target.ReplyTo)
+		}
+
+		data, err := f.buildMessage(&message.BufferedMessage{Header: header, Body: msg.Body})
+		if err != nil {
+			// Recorded like a failed send, as the previous targets have been
+			// sent the message already, which a retry would repeat
+			results = append(results, DeliveryResult{Recipient: target.Address.Address, Err: err})
+			continue
+		}
+
+		messageId, err := f.sendMessage(ctx, source, []*mail.Address{target.Address}, data)
+		result := DeliveryResult{Recipient: target.Address.Address, MessageId: messageId, Err: err}
+		results = append(results, result)
+
+		f.storeOutgoingMessage(originalMessageId+"/"+target.Address.Address, []DeliveryResult{result}, data)
+	}
+
+	return results, nil
+}
+
+// Store the outgoing message according to the results of its delivery
+func (f *Forwarder) storeOutgoingMessage(name string, results []DeliveryResult, data []byte) {
+	succeeded, failed := false, false
+	for _, result := range results {
+		if result.Err != nil {
+			failed = true
+		} else {
+			succeeded = true
+		}
+	}
+
+	if succeeded {
+		key := f.config.S3.Outgoing.SentPrefix + name
+		if err := f.storeMessage(key, data); err != nil {
+			log.Printf("Failed to store sent message at %s: %v", key, err)
+		}
+	}
+
+	if failed {
+		key := f.config.S3.Outgoing.FailedPrefix + name
+		if err := f.storeMessage(key, data); err != nil {
+			log.Printf("Failed to store failed message at %s: %v", key, err)
+		}
+	}
+}
+
+// Returns the failed results
+func failedResults(results []DeliveryResult) []DeliveryResult {
+	failed := make([]DeliveryResult, 0)
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Error returned if the delivery failed for all targets
+type DeliveryError struct {
+	Results []DeliveryResult
+}
+
+func (e *DeliveryError) Error() string {
+	if len(e.Results) == 0 {
+		return "failed to deliver message: no targets"
+	}
+	return fmt.Sprintf("failed to deliver message to %d targets: %v", len(e.Results), e.Results[0].Err)
+}
+
+// The delivery is only retried if it failed transiently for at least one target
+func (e *DeliveryError) FailureClass() failure.Class {
+	for _, result := range e.Results {
+		if failure.Classify(result.Err) == failure.Transient {
+			return failure.Transient
+		}
+	}
+	return failure.Permanent
+}
+
+func (e *DeliveryError) Unwrap() error {
+	if len(e.Results) == 0 {
+		return nil
+	}
+	return e.Results[0].Err
+}
@@ -0,0 +1,85 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/digest"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/metadata"
+)
+
+// Split the transformed recipients into the ones delivered immediately and
+// the ones queued for the digest. Non-email targets of digest keys are still
+// delivered immediately.
+func (f *Forwarder) splitDigest(transformedRecipients []envelope.TransformationResult) ([]envelope.TransformationResult, []envelope.TransformationResult) {
+	immediate := make([]envelope.TransformationResult, 0, len(transformedRecipients))
+	queued := make([]envelope.TransformationResult, 0)
+
+	for _, transformation := range transformedRecipients {
+		if transformation.Rule == "" || !f.config.IsDigestKey(transformation.Rule) || len(transformation.Transformed) == 0 {
+			immediate = append(immediate, transformation)
+			continue
+		}
+
+		queued = append(queued, transformation)
+		if len(transformation.Targets) > 0 {
+			transformation.Transformed = nil
+			immediate = append(immediate, transformation)
+		}
+	}
+
+	return immediate, queued
+}
+
+// Queue the message for the digest of the email targets of the given
+// recipients. The message ID of the results is the key of the queued entry.
+func (f *Forwarder) queueForDigest(event *events.SimpleEmailService, queued []envelope.TransformationResult) []DeliveryResult {
+	results := make([]DeliveryResult, 0)
+	if len(queued) == 0 {
+		return results
+	}
+
+	messageId := event.Mail.MessageID
+	messageKey := f.messageKey(metadata.OutcomeForwarded, messageId)
+	seen := make(map[string]bool)
+
+	for _, transformation := range queued {
+		for _, target := range transformation.Transformed {
+			targetKey := f.config.Normalization.TargetKey(target.Address)
+			if seen[targetKey] {
+				continue
+			}
+			seen[targetKey] = true
+
+			key := digest.PendingKey(f.config.Digest.Prefix, target.Address, messageId)
+			result := DeliveryResult{Recipient: target.Address, MessageId: key}
+
+			data, err := json.Marshal(&digest.Entry{
+				MessageId:  messageId,
+				MessageKey: messageKey,
+				Recipient:  transformation.Source.Address,
+				Target:     target.Address,
+				Rule:       transformation.Rule,
+				From:       event.Mail.CommonHeaders.From,
+				Subject:    event.Mail.CommonHeaders.Subject,
+				ReceivedAt: event.Mail.Timestamp,
+			})
+			if err == nil {
+				_, err = f.storage.Put(key, bytes.NewReader(data))
+			}
+			if err != nil {
+				result.Err = fmt.Errorf("failed to queue message for digest at %s: %w", key, err)
+				log.Printf("Queueing for digest to %s failed: %v", target.Address, result.Err)
+			} else {
+				log.Printf("Queued message for digest to %s at %s", target.Address, key)
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,54 @@
+package forwarder
+
+import (
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+)
+
+// Decide whether SES should continue processing the message of the given
+// event, used by receipt rules invoking the function synchronously.
+//
+// Only the event is inspected (no storage or network access), so the
+// decision is made well within the time limit of SES. Unwanted messages are
+// dropped (STOP_RULE_SET) before the S3 action stores them, everything else
+// is left to the forwarding of the asynchronous invocation (CONTINUE).
+func (f *Forwarder) Disposition(event events.SimpleEmailService) events.SimpleEmailDispositionValue {
+	messageId := event.Mail.MessageID
+	policy := f.config.Disposition
+
+	if policy.DropSpam && event.Receipt.SpamVerdict.Status == "FAIL" {
+		log.Printf("Dropping message %s marked as spam", messageId)
+		return events.SimpleEmailStopRuleSet
+	}
+
+	if policy.DropVirus && event.Receipt.VirusVerdict.Status == "FAIL" {
+		log.Printf("Dropping message %s marked as virus", messageId)
+		return events.SimpleEmailStopRuleSet
+	}
+
+	if policy.DropUnauthenticated && event.Receipt.SPFVerdict.Status != "PASS" && event.Receipt.DKIMVerdict.Status != "PASS" {
+		log.Printf("Dropping unauthenticated message %s", messageId)
+		return events.SimpleEmailStopRuleSet
+	}
+
+	recipients, replies := f.splitRelayRecipients(event.Receipt.Recipients)
+	transformedRecipients, err := f.transformRecipients(recipients)
+	if err != nil {
+		// Let the asynchronous invocation handle (and record) the error
+		log.Printf("Continuing with message %s: %v", messageId, err)
+		return events.SimpleEmailContinue
+	}
+
+	// Only dropped if configured explicitly, for all other policies the
+	// message is stored (and e.g. recorded as failed by the fail policy).
+	// Replies to reverse addresses count as mapped, they are relayed.
+	mapped, _ := splitUnmapped(transformedRecipients)
+	if len(mapped) == 0 && len(replies) == 0 && f.config.Unmapped.Policy == config.UnmappedPolicyDrop {
+		log.Printf("Dropping message %s without any mapped recipient", messageId)
+		return events.SimpleEmailStopRuleSet
+	}
+
+	return events.SimpleEmailContinue
+}
@@ -0,0 +1,101 @@
+package forwarder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+)
+
+func TestDisposition(t *testing.T) {
+	tests := map[string]struct {
+		disposition config.DispositionConfig
+		unmapped    config.UnmappedConfig
+		relay       bool
+		recipients  []string
+		spam        string
+		spf         string
+		want        events.SimpleEmailDispositionValue
+	}{
+		"mapped": {
+			recipients: []string{"info@example.com"},
+			want:       events.SimpleEmailContinue,
+		},
+		"unmapped": {
+			recipients: []string{"unknown@example.com"},
+			want:       events.SimpleEmailContinue,
+		},
+		"unmapped dropped": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyDrop},
+			recipients: []string{"unknown@example.com"},
+			want:       events.SimpleEmailStopRuleSet,
+		},
+		"partly mapped": {
+			recipients: []string{"unknown@example.com", "info@example.com"},
+			want:       events.SimpleEmailContinue,
+		},
+		"reply to reverse address": {
+			relay:      true,
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyDrop},
+			recipients: []string{"reply+aaaaaaaaaaaaaaaaaaaaaaaa@example.com"},
+			want:       events.SimpleEmailContinue,
+		},
+		"unmapped with catch-all": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyCatchAll, CatchAll: []string{"catch-all@example.net"}},
+			recipients: []string{"unknown@example.com"},
+			want:       events.SimpleEmailContinue,
+		},
+		"spam kept": {
+			recipients: []string{"info@example.com"},
+			spam:       "FAIL",
+			want:       events.SimpleEmailContinue,
+		},
+		"spam dropped": {
+			disposition: config.DispositionConfig{DropSpam: true},
+			recipients:  []string{"info@example.com"},
+			spam:        "FAIL",
+			want:        events.SimpleEmailStopRuleSet,
+		},
+		"unauthenticated dropped": {
+			disposition: config.DispositionConfig{DropUnauthenticated: true},
+			recipients:  []string{"info@example.com"},
+			spf:         "FAIL",
+			want:        events.SimpleEmailStopRuleSet,
+		},
+		"authenticated": {
+			disposition: config.DispositionConfig{DropUnauthenticated: true},
+			recipients:  []string{"info@example.com"},
+			spf:         "PASS",
+			want:        events.SimpleEmailContinue,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rawConfig := testRawConfig()
+			rawConfig.Disposition = &tc.disposition
+			rawConfig.Unmapped = &tc.unmapped
+			if tc.relay {
+				secretFile := filepath.Join(t.TempDir(), "relay-secret")
+				if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				rawConfig.Relay = &config.RelayConfig{Domain: "example.com", SecretFile: secretFile, Prefix: "relay/"}
+			}
+
+			forwarder, _, _ := newTestForwarder(t, rawConfig)
+
+			event := testEvent("message-1", tc.recipients...)
+			if tc.spam != "" {
+				event.Receipt.SpamVerdict.Status = tc.spam
+			}
+			event.Receipt.SPFVerdict.Status = tc.spf
+
+			if got := forwarder.Disposition(event); tc.want != got {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -2,94 +2,387 @@ package forwarder
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/mail"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
 	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/ingress"
 	"github.com/codezombiech/aws-mail-forwarder-test/message"
+	"github.com/codezombiech/aws-mail-forwarder-test/metadata"
 	"github.com/codezombiech/aws-mail-forwarder-test/sender"
 	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+	"github.com/codezombiech/aws-mail-forwarder-test/webhook"
 )
 
+// Storage of messages, implemented by storage.Storage
+type messageStorage interface {
+	Get(key string) (io.ReadCloser, int64, error)
+	Put(key string, reader io.Reader) (*string, error)
+	Move(sourceKey string, targetKey string) error
+	Delete(key string) error
+	State(key string) (string, error)
+	SetState(key string, state string, at time.Time) error
+}
+
+// Sending of raw messages, implemented by sender.Sender and the local
+// delivery backends (e.g. sender.MaildirSender)
+type messageSender interface {
+	SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error)
+}
+
+// Returned if none of the recipients is mapped to a target
+var ErrNoRecipients = failure.AsPermanent(errors.New("no recipients after transformation"))
+
+// Returned if a delivered message could not be marked as forwarded. It is not
+// retried, as that would deliver the message again.
+var ErrNotMarkedAsForwarded = failure.AsHandled(errors.New("delivered message could not be marked as forwarded"))
+
 type Forwarder struct {
-	config  *config.ParsedConfig
-	storage *storage.Storage
-	sender  *sender.Sender
+	config      *config.ParsedConfig
+	storage     messageStorage
+	sender      messageSender
+	webhooks    *webhook.Client                    // Nil if no webhook secret is configured
+	relaySecret []byte                             // Nil if the reply relay is disabled
+	mailboxes   func(bucket string) mailboxStorage // Returns the storage of a mailbox target (nil if not supported)
 }
 
-func NewForwarder(config *config.ParsedConfig, awsConfig aws.Config) *Forwarder {
-	return &Forwarder{
+func NewForwarder(config *config.ParsedConfig, awsConfig aws.Config) (*Forwarder, error) {
+	storage, err := NewStorage(config, awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := NewForwarderWith(config, storage, NewSender(config, awsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	// Mailbox targets might be in other buckets
+	f.mailboxes = func(bucket string) mailboxStorage {
+		if bucket == config.S3.BucketName {
+			return storage
+		}
+		mailbox, err := newBucketStorage(config, awsConfig, bucket)
+		if err != nil {
+			log.Printf("Failed to create storage of bucket %s: %v", bucket, err)
+			return nil
+		}
+		return mailbox
+	}
+
+	return f, nil
+}
+
+// Create a forwarder with the given storage and sender, e.g. storage.FileStorage
+// and sender.FileSender to run it locally. Mailbox targets are limited to the
+// configured bucket.
+func NewForwarderWith(config *config.ParsedConfig, storage messageStorage, sender messageSender) (*Forwarder, error) {
+	f := &Forwarder{
 		config:  config,
-		storage: storage.NewStorage(awsConfig, config.S3.BucketName),
-		sender:  sender.NewSender(awsConfig),
+		storage: storage,
+		sender:  sender,
+		mailboxes: func(bucket string) mailboxStorage {
+			if bucket == config.S3.BucketName {
+				return storage
+			}
+			return nil
+		},
+	}
+
+	if config.Webhook.SecretFile != "" {
+		secret, err := os.ReadFile(config.Webhook.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook secret: %w", err)
+		}
+		timeout := time.Duration(config.Webhook.TimeoutSeconds) * time.Second
+		f.webhooks = webhook.NewClient(bytes.TrimSpace(secret), &http.Client{Timeout: timeout})
+	}
+
+	if config.Relay.Enabled() {
+		secret, err := os.ReadFile(config.Relay.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read relay secret: %w", err)
+		}
+		f.relaySecret = bytes.TrimSpace(secret)
 	}
+
+	return f, nil
+}
+
+// Create the storage of the configured bucket, encrypting stored objects if configured
+func NewStorage(cfg *config.ParsedConfig, awsConfig aws.Config) (*storage.Storage, error) {
+	return newBucketStorage(cfg, awsConfig, cfg.S3.BucketName)
 }
 
-func (f *Forwarder) Forward(event events.SimpleEmailService) error {
+func newBucketStorage(cfg *config.ParsedConfig, awsConfig aws.Config, bucket string) (*storage.Storage, error) {
+	if cfg.S3.Encryption == nil {
+		return storage.NewStorage(awsConfig, bucket), nil
+	}
+
+	switch cfg.S3.Encryption.KeyProvider {
+	case config.KeyProviderFile:
+		keys, err := storage.NewFileKeyProvider(cfg.S3.Encryption.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create key provider: %w", err)
+		}
+		return storage.NewEncryptedStorage(awsConfig, bucket, keys), nil
+	default:
+		return storage.NewStorage(awsConfig, bucket), nil
+	}
+}
+
+// Create the sender of the configured delivery backend, e.g. to send digests
+func NewSender(cfg *config.ParsedConfig, awsConfig aws.Config) messageSender {
+	switch cfg.Delivery.Backend {
+	case config.DeliveryBackendMaildir:
+		return sender.NewMaildirSender(cfg.Delivery.Path)
+	case config.DeliveryBackendMbox:
+		return sender.NewMboxSender(cfg.Delivery.Path)
+	default:
+		return sender.NewSender(awsConfig)
+	}
+}
+
+// Forward the message of the given SES event.
+//
+// Returned errors are classified (see package failure): the message is only
+// marked as failed for permanent errors, for transient errors it is left in
+// place, so the event can be retried.
+func (f *Forwarder) Forward(ctx context.Context, event events.SimpleEmailService) error {
+	return f.forward(ctx, event, nil)
+}
+
+// Forward the message stored at the given object (e.g. of a S3 ObjectCreated
+// event). The SES notification is recovered from the headers of the message.
+//
+// Objects outside of the configured bucket and new prefix (or nested below
+// it) are ignored, as they were not stored by SES (e.g. moved by the
+// forwarder itself).
+func (f *Forwarder) ForwardObject(ctx context.Context, bucket string, key string) error {
+	messageId := ingress.MessageIdFromKey(key)
+	if bucket != f.config.S3.BucketName || key != f.config.S3.Incoming.NewPrefix+messageId {
+		return failure.AsHandled(fmt.Errorf("ignoring object s3://%s/%s", bucket, key))
+	}
+
+	message, err := f.fetchMessage(messageId)
+	if err != nil {
+		return f.fail(messageId, err)
+	}
+
+	event := ingress.EventFromHeader(messageId, message.Header)
+	if _, ok := ingress.ReceivedRecipient(message.Header); !ok {
+		event.Receipt.Recipients = f.receivingRecipients(event.Receipt.Recipients)
+	}
+	return f.forward(ctx, event, message)
+}
+
+// Returns the recipients of the receiving domains. Recipients recovered from
+// the To and Cc headers are controlled by the sender, who must not be able to
+// make foreign addresses match forwardMapping keys without a domain.
+func (f *Forwarder) receivingRecipients(recipients []string) []string {
+	receiving := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		domain := recipient[strings.LastIndex(recipient, "@")+1:]
+		if f.config.IsReceivingDomain(domain) {
+			receiving = append(receiving, recipient)
+		} else {
+			log.Printf("Ignoring recipient %s of a foreign domain", recipient)
+		}
+	}
+	return receiving
+}
+
+// Forward the message of the given event, the message is fetched if nil
+func (f *Forwarder) forward(ctx context.Context, event events.SimpleEmailService, message *message.BufferedMessage) (err error) {
 	// For more details about the event, see
 	// https://docs.aws.amazon.com/ses/latest/dg/receiving-email-notifications-contents.html#receiving-email-notifications-contents-mail-object
 
 	messageId := event.Mail.MessageID
 
+	record := newMetadataRecord(&event)
+	defer func() {
+		f.storeMetadata(record, err)
+	}()
+
+	if err := f.checkState(messageId); err != nil {
+		return err
+	}
+
 	if f.isSpamOrVirus(&event) {
 		if err := f.markAsSpamVirus(messageId); err != nil {
 			return err
 		}
+		record.Outcome = metadata.OutcomeSpamVirus
 		return nil
 	}
 
-	transformedRecipients, err := f.transformRecipients(event.Receipt.Recipients)
+	recipients, replies := f.splitRelayRecipients(event.Receipt.Recipients)
+
+	transformedRecipients, err := f.transformRecipients(recipients)
 	if err != nil {
-		f.markAsFailed(messageId)
-		return err
+		return f.fail(messageId, err)
 	}
 
-	transformedSender, err := f.transformSender(event.Mail.CommonHeaders.From, transformedRecipients)
+	transformedRecipients, replies, denied := f.applySenderRules(&event, transformedRecipients, replies)
+	if denied != nil {
+		record.SenderRule = denied.Name
+		if len(transformedRecipients) == 0 && len(replies) == 0 {
+			if err := f.markAsBlocked(messageId); err != nil {
+				return err
+			}
+			record.Outcome = metadata.OutcomeBlocked
+			return nil
+		}
+	}
+
+	transformedRecipients, unmapped, done, err := f.applyUnmappedPolicy(ctx, &event, transformedRecipients, len(replies) > 0)
 	if err != nil {
-		f.markAsFailed(messageId)
+		return f.fail(messageId, err)
+	}
+	if done {
+		record.Outcome = unmappedOutcome(f.config.Unmapped.Policy)
+		return nil
+	}
+	record.Mappings = metadataMappings(transformedRecipients)
+
+	if message == nil {
+		message, err = f.fetchMessage(messageId)
+		if err != nil {
+			return f.fail(messageId, err)
+		}
+	}
+
+	// Non-email targets and relayed replies get the original message
+	original := cloneMessage(message)
+
+	results := make([]DeliveryResult, 0)
+	if len(transformedRecipients) > 0 {
+		delivered, err := f.deliverToRecipients(ctx, &event, transformedRecipients, message, original)
+		if err != nil {
+			return f.fail(messageId, err)
+		}
+		results = append(results, delivered...)
+	}
+
+	// Relayed last and only if the message has been delivered to any other
+	// target, as a failed delivery is retried and would relay them again
+	if len(replies) > 0 {
+		if len(results) > 0 && len(failedResults(results)) == len(results) {
+			log.Printf("Not relaying replies, delivery failed for all %d targets", len(results))
+		} else {
+			results = append(results, f.relayReplies(ctx, &event, replies, original)...)
+		}
+	}
+
+	err = f.completeDelivery(messageId, record, results)
+	if err != nil && !errors.Is(err, ErrNotMarkedAsForwarded) {
 		return err
 	}
 
-	message, err := f.fetchMessage(messageId)
+	// Delivered, so the event is not retried
+	f.notifyUnmapped(ctx, &event, unmapped)
+	f.autoReply(ctx, &event, transformedRecipients, original.Header)
+
+	return err
+}
+
+// Deliver the message to the transformed recipients, immediately or queued
+// for a digest. The header of the given message is processed for the email
+// targets, the original message is delivered to the other targets.
+func (f *Forwarder) deliverToRecipients(ctx context.Context, event *events.SimpleEmailService, transformedRecipients []envelope.TransformationResult, message *message.BufferedMessage, original *message.BufferedMessage) ([]DeliveryResult, error) {
+	messageId := event.Mail.MessageID
+
+	transformedSender, err := f.transformSender(event.Mail.CommonHeaders.From, transformedRecipients)
 	if err != nil {
-		f.markAsFailed(messageId)
-		return err
+		return nil, err
 	}
 
-	err = f.processMessageHeader(message.Header, transformedSender)
+	err = f.processMessageHeader(message.Header, transformedSender, transformedRecipients)
 	if err != nil {
-		f.markAsFailed(messageId)
-		return err
+		return nil, err
 	}
 
 	f.setDebugHeaders(message.Header, event.Mail)
 
-	messageBytes, err := f.buildMessage(message)
+	immediate, queued := f.splitDigest(transformedRecipients)
+
+	replyTos, err := f.relayReplyTos(original.Header, immediate)
 	if err != nil {
-		f.markAsFailed(messageId)
-		return err
+		return nil, err
 	}
 
-	err = f.sendMessage(transformedSender.String(), transformedRecipients[0].Transformed, messageId, messageBytes)
-	if err != nil {
-		f.markAsFailed(messageId)
-		return err
+	results := make([]DeliveryResult, 0)
+	if targets := f.collectTargets(immediate); len(targets) > 0 {
+		for i := range targets {
+			targets[i].ReplyTo = replyTos[targets[i].Recipient.Address]
+		}
+		delivered, err := f.deliver(ctx, transformedSender.String(), targets, messageId, message)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, delivered...)
 	}
+	results = append(results, f.queueForDigest(event, queued)...)
+	results = append(results, f.deliverToTargets(ctx, event, collectNonEmailTargets(immediate), original)...)
 
-	err = f.markAsForwarded(messageId)
-	if err != nil {
-		return err
+	return results, nil
+}
+
+// Record the delivery results and mark the message as forwarded, unless the
+// delivery failed for all targets.
+//
+// If the message has been delivered to some targets, it is not retried, as
+// that would deliver it to these targets again. This includes targets that
+// failed transiently (e.g. a webhook timing out), their deliveries are
+// recorded with the outcome metadata.OutcomeIncomplete to be found and
+// redelivered manually (see cmd/search).
+func (f *Forwarder) completeDelivery(messageId string, record *metadata.Record, results []DeliveryResult) error {
+	record.Deliveries = metadataDeliveries(results)
+
+	record.Outcome = metadata.OutcomeForwarded
+	if failed := failedResults(results); len(failed) == len(results) {
+		return f.fail(messageId, &DeliveryError{Results: failed})
+	} else if len(failed) > 0 {
+		log.Printf("Delivery failed for %d of %d targets", len(failed), len(results))
+		record.Outcome = metadata.OutcomePartiallyForwarded
+		for _, result := range failed {
+			if failure.Classify(result.Err) == failure.Transient {
+				log.Printf("Not retrying transiently failed delivery to %s", result.Recipient)
+				record.Outcome = metadata.OutcomeIncomplete
+			}
+		}
+	}
+
+	if err := f.markAsForwarded(messageId); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotMarkedAsForwarded, err)
 	}
 
 	return nil
 }
 
+// Handle an error according to its class and return it
+func (f *Forwarder) fail(messageId string, err error) error {
+	switch failure.Classify(err) {
+	case failure.Permanent:
+		f.markAsFailed(messageId)
+	case failure.Transient:
+		log.Printf("Leaving message %s in place to be retried", messageId)
+	}
+	return err
+}
+
 func (f *Forwarder) isSpamOrVirus(event *events.SimpleEmailService) bool {
 	isSpamOrVirus := false
 
@@ -118,15 +411,6 @@ func (f *Forwarder) transformRecipients(recipients []string) ([]envelope.Transfo
 		return nil, fmt.Errorf("failed to transform recipients: %w", err)
 	}
 
-	// Check transformed recipient count
-	count := 0
-	for _, v := range transformedRecipients {
-		count += len(v.Transformed)
-	}
-	if count < 1 {
-		return nil, errors.New("no recipients after transformation")
-	}
-
 	log.Print("Transforming recipients succeeded")
 	return transformedRecipients, nil
 }
@@ -136,7 +420,8 @@ func (f *Forwarder) transformSender(senders []string, transformedRecipients []en
 
 	transformedSender, err := envelope.TransformSenders(f.config, senders, transformedRecipients)
 	if err != nil {
-		return nil, fmt.Errorf("failed to transform senders: %w", err)
+		// Deterministic, a retry would fail the same way
+		return nil, failure.AsPermanent(fmt.Errorf("failed to transform senders: %w", err))
 	}
 	return transformedSender, nil
 }
@@ -146,6 +431,10 @@ func (f *Forwarder) fetchMessage(mailId string) (*message.BufferedMessage, error
 	key := f.config.S3.Incoming.NewPrefix + mailId
 	messageReader, size, err := f.storage.Get(key)
 	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			// Most likely processed by a previous invocation already
+			return nil, failure.AsHandled(fmt.Errorf("failed to get message with key %s: %w", key, err))
+		}
 		return nil, fmt.Errorf("failed to get message with key %s: %w", key, err)
 	}
 	defer messageReader.Close()
@@ -157,30 +446,23 @@ func (f *Forwarder) fetchMessage(mailId string) (*message.BufferedMessage, error
 		log.Print("Mail sending will most likely fail (max supported mail size is 40MB)")
 	}
 
-	mailMessage, err := mail.ReadMessage(messageReader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read message: %w", err)
-	}
-
-	body, err := io.ReadAll(mailMessage.Body)
+	bufferedMessage, err := message.ReadMessage(messageReader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message body into memory: %w", err)
+		return nil, err
 	}
 
 	log.Print("Fetching message succeeded")
 
-	return &message.BufferedMessage{
-		Header: mailMessage.Header,
-		Body:   body,
-	}, nil
+	return bufferedMessage, nil
 }
 
-func (f *Forwarder) processMessageHeader(header mail.Header, newSender *mail.Address) error {
+func (f *Forwarder) processMessageHeader(header mail.Header, newSender *mail.Address, transformedRecipients []envelope.TransformationResult) error {
 	log.Print("Processing message headers...")
 
-	err := message.ProcessMessageHeader(f.config, header, newSender)
+	err := message.ProcessMessageHeader(f.config, header, newSender, transformedRecipients)
 	if err != nil {
-		return fmt.Errorf("failed to process message header: %w", err)
+		// Deterministic, a retry would fail the same way
+		return failure.AsPermanent(fmt.Errorf("failed to process message header: %w", err))
 	}
 
 	log.Print("Processing message headers succeeded")
@@ -195,45 +477,36 @@ func (f *Forwarder) setDebugHeaders(header mail.Header, messageMetadata events.S
 func (f *Forwarder) buildMessage(msg *message.BufferedMessage) ([]byte, error) {
 	data, err := message.BuildMail(msg)
 	if err != nil {
-		return nil, err
+		return nil, failure.AsPermanent(fmt.Errorf("failed to build message: %w", err))
 	}
 
 	return data, nil
 }
 
-func (f *Forwarder) sendMessage(sender string, recipientAddresses []*mail.Address, originalMessageId string, data []byte) error {
+// Send the message to the given recipients, returns the ID of the sent message
+func (f *Forwarder) sendMessage(ctx context.Context, sender string, recipientAddresses []*mail.Address, data []byte) (string, error) {
 	log.Print("Sending message...")
 
 	log.Printf("Recipients: %v", recipientAddresses)
 
 	recipients := []string{}
 	for i := 0; i < len(recipientAddresses); i++ {
-		address := recipientAddresses[i].String()
-		recipients = append(recipients, address)
+		// Like the source (see envelope.SourceAddress), keeping the name
+		recipientAddress, err := envelope.ToASCIIDomainAddress(recipientAddresses[i])
+		if err != nil {
+			return "", failure.AsPermanent(fmt.Errorf("invalid recipient: %w", err))
+		}
+		recipients = append(recipients, recipientAddress.String())
 	}
 
-	forwardedMessageId, err := f.sender.SendMessage(sender, recipients, data)
+	forwardedMessageId, err := f.sender.SendMessage(ctx, sender, recipients, data)
 	if err != nil {
 		log.Printf("Failed to send message: %v", err)
-
-		// Store failed outgoing mail
-		key := f.config.S3.Outgoing.FailedPrefix + originalMessageId
-		storeErr := f.storeMessage(key, data)
-		if storeErr != nil {
-			log.Printf("Failed to store failed message at %s: %v", key, storeErr)
-		}
-
-		return err
-	}
-
-	// Store succeeded outgoing mail
-	key := f.config.S3.Outgoing.SentPrefix + originalMessageId
-	if err = f.storeMessage(key, data); err != nil {
-		return fmt.Errorf("failed to store sent message: %w", err)
+		return "", err
 	}
 
 	log.Printf("Sending message succeeded with message ID %s", *forwardedMessageId)
-	return nil
+	return *forwardedMessageId, nil
 }
 
 func (f *Forwarder) storeMessage(key string, data []byte) error {
@@ -251,6 +524,10 @@ func (f *Forwarder) storeMessage(key string, data []byte) error {
 func (f *Forwarder) moveMessage(sourceKey string, targetKey string) error {
 	err := f.storage.Move(sourceKey, targetKey)
 	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			// Most likely processed by a previous invocation already
+			return failure.AsHandled(fmt.Errorf("failed to move message from %s to %s: %w", sourceKey, targetKey, err))
+		}
 		return fmt.Errorf("failed to move message from %s to %s: %w", sourceKey, targetKey, err)
 	}
 	log.Printf("Moved message to %s", targetKey)
@@ -258,16 +535,16 @@ func (f *Forwarder) moveMessage(sourceKey string, targetKey string) error {
 }
 
 func (f *Forwarder) markAsFailed(messageId string) {
-	err := f.storage.Move(f.config.S3.Incoming.NewPrefix+messageId, f.config.S3.Incoming.FailedPrefix+messageId)
+	err := f.changeState(messageId, StateFailed, f.config.S3.Incoming.FailedPrefix)
 	if err != nil {
 		log.Printf("failed to mark message as failed: %v", err)
 	}
 }
 
 func (f *Forwarder) markAsForwarded(messageId string) error {
-	return f.moveMessage(f.config.S3.Incoming.NewPrefix+messageId, f.config.S3.Incoming.ForwardedPrefix+messageId)
+	return f.changeState(messageId, StateForwarded, f.config.S3.Incoming.ForwardedPrefix)
 }
 
 func (f *Forwarder) markAsSpamVirus(messageId string) error {
-	return f.moveMessage(f.config.S3.Incoming.NewPrefix+messageId, f.config.S3.Incoming.SpamVirusPrefix+messageId)
+	return f.changeState(messageId, StateSpamVirus, f.config.S3.Incoming.SpamVirusPrefix)
 }
@@ -1,13 +1,31 @@
 package forwarder
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/digest"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/metadata"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+	"github.com/codezombiech/aws-mail-forwarder-test/webhook"
+	"github.com/google/go-cmp/cmp"
 )
 
 func NotTestForward(t *testing.T) {
@@ -44,8 +62,11 @@ func NotTestForward(t *testing.T) {
 
 	sesEvent := event.Records[0].SES
 
-	forwarder := NewForwarder(config, aws.Config{})
-	err = forwarder.Forward(sesEvent)
+	forwarder, err := NewForwarder(config, aws.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = forwarder.Forward(context.Background(), sesEvent)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,3 +79,1395 @@ func parseConfig(t *testing.T, rawConfig config.RawConfig) *config.ParsedConfig
 	}
 	return config
 }
+
+type fakeStorage struct {
+	objects map[string][]byte
+	states  map[string][]string // State history by key
+	// Target keys moving objects to fails for
+	failingMoves map[string]bool
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{objects: make(map[string][]byte), states: make(map[string][]string), failingMoves: make(map[string]bool)}
+}
+
+func (s *fakeStorage) Get(key string) (io.ReadCloser, int64, error) {
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, 0, fmt.Errorf("failed to get object %s: %w", key, storage.ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (s *fakeStorage) Put(key string, reader io.Reader) (*string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	s.objects[key] = data
+	return aws.String("etag"), nil
+}
+
+func (s *fakeStorage) Delete(key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *fakeStorage) State(key string) (string, error) {
+	if _, ok := s.objects[key]; !ok {
+		return "", fmt.Errorf("failed to get tags of object %s: %w", key, storage.ErrNotFound)
+	}
+	if history := s.states[key]; len(history) > 0 {
+		return history[len(history)-1], nil
+	}
+	return "", nil
+}
+
+func (s *fakeStorage) SetState(key string, state string, at time.Time) error {
+	if _, ok := s.objects[key]; !ok {
+		return fmt.Errorf("failed to tag object %s: %w", key, storage.ErrNotFound)
+	}
+	s.states[key] = append(s.states[key], state)
+	return nil
+}
+
+func (s *fakeStorage) Move(sourceKey string, targetKey string) error {
+	data, ok := s.objects[sourceKey]
+	if !ok {
+		return fmt.Errorf("failed to copy object %s: %w", sourceKey, storage.ErrNotFound)
+	}
+	if s.failingMoves[targetKey] {
+		return fmt.Errorf("failed to copy object %s: access denied", sourceKey)
+	}
+	s.objects[targetKey] = data
+	delete(s.objects, sourceKey)
+	return nil
+}
+
+type sentMessage struct {
+	source       string
+	destinations []string
+	data         []byte
+}
+
+type fakeSender struct {
+	sent []sentMessage
+	// Destinations the sender fails for
+	failing map[string]bool
+	// Whether failures are transient (permanent otherwise)
+	transient bool
+}
+
+func (s *fakeSender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
+	for _, destination := range destinations {
+		if s.failing[destination] {
+			if s.transient {
+				return nil, failure.AsTransient(fmt.Errorf("throttled %s", destination))
+			}
+			return nil, failure.AsPermanent(fmt.Errorf("rejected %s", destination))
+		}
+	}
+	s.sent = append(s.sent, sentMessage{source: source, destinations: destinations, data: data})
+	return aws.String(fmt.Sprintf("sent-%d", len(s.sent))), nil
+}
+
+func testRawConfig() config.RawConfig {
+	return config.RawConfig{
+		FromEmail: "forwarder@example.com",
+		S3: config.S3Config{
+			BucketName: "s3-bucket-name",
+			Incoming: config.S3IncomingConfig{
+				NewPrefix:       "in/new/",
+				SpamVirusPrefix: "in/spam-virus/",
+				ForwardedPrefix: "in/forwarded/",
+				FailedPrefix:    "in/failed/",
+			},
+			Outgoing: config.S3OutgoingConfig{
+				SentPrefix:   "out/sent/",
+				FailedPrefix: "out/failed/",
+			},
+		},
+		ForwardMapping: map[string][]string{
+			"info@example.com": {
+				"one@example.net",
+				"two@example.net",
+				"three@example.net",
+			},
+		},
+	}
+}
+
+func testEvent(messageId string, recipients ...string) events.SimpleEmailService {
+	event := events.SimpleEmailService{}
+	event.Mail.MessageID = messageId
+	event.Mail.CommonHeaders.From = []string{"Sender <sender@example.org>"}
+	event.Receipt.Recipients = recipients
+	event.Receipt.SpamVerdict.Status = "PASS"
+	event.Receipt.VirusVerdict.Status = "PASS"
+	return event
+}
+
+const testMessage = "From: Sender <sender@example.org>\r\nTo: info@example.com\r\nSubject: Test subject\r\n\r\nMessage body\r\n"
+
+func newTestForwarder(t *testing.T, rawConfig config.RawConfig) (*Forwarder, *fakeStorage, *fakeSender) {
+	storage, sender := newFakeStorage(), &fakeSender{failing: map[string]bool{}}
+	forwarder, err := NewForwarderWith(parseConfig(t, rawConfig), storage, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwarder, storage, sender
+}
+
+func TestForwardBatched(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.Delivery = &config.DeliveryConfig{MaxRecipientsPerCall: 2}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	var destinations [][]string
+	for _, sent := range sender.sent {
+		destinations = append(destinations, sent.destinations)
+	}
+	want := [][]string{{"<one@example.net>", "<two@example.net>"}, {"<three@example.net>"}}
+	if diff := cmp.Diff(want, destinations); diff != "" {
+		t.Errorf("destinations (-want +got):\n%s", diff)
+	}
+
+	for _, key := range []string{"in/forwarded/message-1", "out/sent/message-1"} {
+		if _, ok := storage.objects[key]; !ok {
+			t.Errorf("expected object %s", key)
+		}
+	}
+}
+
+func TestForwardDotInsensitiveTargets(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.Normalization = &config.NormalizationConfig{DotInsensitiveDomains: []string{"gmail.com"}}
+	rawConfig.ForwardMapping["info@example.com"] = []string{"j.doe@gmail.com", "jdoe@gmail.com", "j.doe@example.net", "jdoe@example.net"}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	var destinations [][]string
+	for _, sent := range sender.sent {
+		destinations = append(destinations, sent.destinations)
+	}
+	want := [][]string{{"<j.doe@gmail.com>", "<j.doe@example.net>", "<jdoe@example.net>"}}
+	if diff := cmp.Diff(want, destinations); diff != "" {
+		t.Errorf("destinations (-want +got):\n%s", diff)
+	}
+}
+
+func TestForwardPartialFailure(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.Delivery = &config.DeliveryConfig{Mode: config.DeliveryModePerTarget}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	sender.failing["<two@example.net>"] = true
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 2, len(sender.sent); want != got {
+		t.Errorf("sent messages: want %v, got %v", want, got)
+	}
+
+	for _, key := range []string{
+		"in/forwarded/message-1",
+		"out/sent/message-1/one@example.net",
+		"out/failed/message-1/two@example.net",
+		"out/sent/message-1/three@example.net",
+	} {
+		if _, ok := storage.objects[key]; !ok {
+			t.Errorf("expected object %s", key)
+		}
+	}
+}
+
+func TestForwardAllFailed(t *testing.T) {
+	forwarder, storage, sender := newTestForwarder(t, testRawConfig())
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	sender.failing["<one@example.net>"] = true
+
+	err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com"))
+
+	var deliveryErr *DeliveryError
+	if !errors.As(err, &deliveryErr) {
+		t.Fatalf("expected delivery error, got %v", err)
+	}
+	if want, got := 3, len(deliveryErr.Results); want != got {
+		t.Errorf("failed results: want %v, got %v", want, got)
+	}
+	if want, got := failure.Permanent, failure.Classify(err); want != got {
+		t.Errorf("class: want %v, got %v", want, got)
+	}
+	if _, ok := storage.objects["in/failed/message-1"]; !ok {
+		t.Errorf("expected message to be marked as failed")
+	}
+}
+
+func TestForwardTransientFailureKeepsMessage(t *testing.T) {
+	forwarder, storage, sender := newTestForwarder(t, testRawConfig())
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	sender.failing["<one@example.net>"] = true
+	sender.transient = true
+
+	err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com"))
+
+	if want, got := failure.Transient, failure.Classify(err); want != got {
+		t.Errorf("class: want %v, got %v", want, got)
+	}
+	if _, ok := storage.objects["in/new/message-1"]; !ok {
+		t.Errorf("expected message to be left in place")
+	}
+}
+
+func TestForwardErrorClasses(t *testing.T) {
+	tests := map[string]struct {
+		event     events.SimpleEmailService
+		stored    bool
+		wantErr   error
+		wantClass failure.Class
+		wantKey   string
+	}{
+		"no recipients": {
+			event:     testEvent("message-1", "unknown@example.com"),
+			stored:    true,
+			wantErr:   ErrNoRecipients,
+			wantClass: failure.Permanent,
+			wantKey:   "in/failed/message-1",
+		},
+		"invalid sender": {
+			event: func() events.SimpleEmailService {
+				event := testEvent("message-1", "info@example.com")
+				event.Mail.CommonHeaders.From = []string{"sender@example@org"}
+				return event
+			}(),
+			stored:    true,
+			wantErr:   envelope.ErrInvalidAddress,
+			wantClass: failure.Permanent,
+			wantKey:   "in/failed/message-1",
+		},
+		"already processed": {
+			event:     testEvent("message-1", "info@example.com"),
+			stored:    false,
+			wantErr:   storage.ErrNotFound,
+			wantClass: failure.Handled,
+		},
+		"spam already processed": {
+			event: func() events.SimpleEmailService {
+				event := testEvent("message-1", "info@example.com")
+				event.Receipt.SpamVerdict.Status = "FAIL"
+				return event
+			}(),
+			stored:    false,
+			wantErr:   storage.ErrNotFound,
+			wantClass: failure.Handled,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			forwarder, fakeStorage, _ := newTestForwarder(t, testRawConfig())
+			if tc.stored {
+				fakeStorage.objects["in/new/message-1"] = []byte(testMessage)
+			}
+
+			err := forwarder.Forward(context.Background(), tc.event)
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("want %v, got %v", tc.wantErr, err)
+			}
+			if want, got := tc.wantClass, failure.Classify(err); want != got {
+				t.Errorf("class: want %v, got %v", want, got)
+			}
+			if _, ok := fakeStorage.objects[tc.wantKey]; tc.wantKey != "" && !ok {
+				t.Errorf("expected object %s", tc.wantKey)
+			}
+		})
+	}
+}
+
+func TestDeliverPerTargetHeaders(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.Delivery = &config.DeliveryConfig{
+		Mode: config.DeliveryModePerTarget,
+		Headers: map[string]string{
+			"to":             "$target",
+			"X-Forwarded-To": "$target (via $recipient)",
+		},
+	}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, target := range []string{"one@example.net", "two@example.net", "three@example.net"} {
+		sent, err := mail.ReadMessage(bytes.NewReader(sender.sent[i].data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := target, sent.Header.Get("To"); want != got {
+			t.Errorf("To: want %v, got %v", want, got)
+		}
+		if want, got := target+" (via info@example.com)", sent.Header.Get("X-Forwarded-To"); want != got {
+			t.Errorf("X-Forwarded-To: want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestForwardUnmapped(t *testing.T) {
+	tests := map[string]struct {
+		unmapped       config.UnmappedConfig
+		recipients     []string
+		wantKey        string
+		wantSent       [][]string
+		wantNoticeSent bool
+	}{
+		"drop": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyDrop},
+			recipients: []string{"unknown@example.com"},
+		},
+		"quarantine": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyQuarantine},
+			recipients: []string{"unknown@example.com"},
+			wantKey:    "in/unmapped/message-1",
+		},
+		"catch-all": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyCatchAll, CatchAll: []string{"catch-all@example.net"}},
+			recipients: []string{"unknown@example.com"},
+			wantKey:    "in/forwarded/message-1",
+			wantSent:   [][]string{{"<catch-all@example.net>"}},
+		},
+		"notify": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyNotify},
+			recipients: []string{"unknown@example.com"},
+			wantKey:    "in/unmapped/message-1",
+			wantSent:   [][]string{{"<sender@example.org>"}},
+		},
+		"partly mapped": {
+			unmapped:   config.UnmappedConfig{Policy: config.UnmappedPolicyNotify},
+			recipients: []string{"unknown@example.com", "info@example.com"},
+			wantKey:    "in/forwarded/message-1",
+			wantSent:   [][]string{{"<one@example.net>", "<two@example.net>", "<three@example.net>"}, {"<sender@example.org>"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rawConfig := testRawConfig()
+			rawConfig.S3.Incoming.UnmappedPrefix = "in/unmapped/"
+			rawConfig.Unmapped = &tc.unmapped
+
+			forwarder, storage, sender := newTestForwarder(t, rawConfig)
+			storage.objects["in/new/message-1"] = []byte(testMessage)
+
+			event := testEvent("message-1", tc.recipients...)
+			event.Mail.Source = "sender@example.org"
+			event.Receipt.SPFVerdict.Status = "PASS"
+
+			if err := forwarder.Forward(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+
+			var sent [][]string
+			for _, message := range sender.sent {
+				sent = append(sent, message.destinations)
+			}
+			if diff := cmp.Diff(tc.wantSent, sent); diff != "" {
+				t.Errorf("sent (-want +got):\n%s", diff)
+			}
+
+			if _, ok := storage.objects["in/new/message-1"]; ok {
+				t.Errorf("expected message to be removed from in/new/")
+			}
+			if _, ok := storage.objects[tc.wantKey]; tc.wantKey != "" && !ok {
+				t.Errorf("expected object %s", tc.wantKey)
+			}
+		})
+	}
+}
+
+func TestNoticeRecipient(t *testing.T) {
+	tests := map[string]struct {
+		source string
+		spf    string
+		dkim   string
+		dmarc  string
+		want   string // Empty if no notice is sent
+	}{
+		"authenticated": {source: "sender@example.org", spf: "PASS", want: "sender@example.org"},
+		"dkim only":     {source: "sender@example.org", spf: "FAIL", dkim: "PASS"},
+		"dmarc":         {source: "bounces@mailer.example.org", spf: "FAIL", dkim: "PASS", dmarc: "PASS", want: "sender@example.org"},
+		"null sender":   {source: "<>", spf: "PASS"},
+		"daemon":        {source: "MAILER-DAEMON@example.org", spf: "PASS"},
+		"unverified":    {source: "sender@example.org", spf: "FAIL", dkim: "FAIL"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			event := testEvent("message-1")
+			event.Mail.Source = tc.source
+			event.Mail.CommonHeaders.From = []string{"Sender <sender@example.org>"}
+			event.Receipt.SPFVerdict.Status = tc.spf
+			event.Receipt.DKIMVerdict.Status = tc.dkim
+			event.Receipt.DMARCVerdict.Status = tc.dmarc
+
+			var got string
+			if address, ok := noticeRecipient(&event); ok {
+				got = address.Address
+			}
+			if tc.want != got {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestForwardObject(t *testing.T) {
+	tests := map[string]struct {
+		bucket    string
+		key       string
+		message   string
+		wantClass failure.Class
+		wantKey   string
+	}{
+		"forwarded": {
+			bucket:  "s3-bucket-name",
+			key:     "in/new/message-1",
+			message: "X-SES-Spam-Verdict: PASS\r\nX-SES-Virus-Verdict: PASS\r\n" + testMessage,
+			wantKey: "in/forwarded/message-1",
+		},
+		"spam": {
+			bucket:  "s3-bucket-name",
+			key:     "in/new/message-1",
+			message: "X-SES-Spam-Verdict: FAIL\r\nX-SES-Virus-Verdict: PASS\r\n" + testMessage,
+			wantKey: "in/spam-virus/message-1",
+		},
+		"outside new prefix": {
+			bucket:    "s3-bucket-name",
+			key:       "in/forwarded/message-1",
+			message:   testMessage,
+			wantClass: failure.Handled,
+			wantKey:   "in/forwarded/message-1",
+		},
+		"other bucket": {
+			bucket:    "other-bucket",
+			key:       "in/new/message-1",
+			message:   testMessage,
+			wantClass: failure.Handled,
+			wantKey:   "in/new/message-1",
+		},
+		"below new prefix": {
+			bucket:    "s3-bucket-name",
+			key:       "in/new/nested/message-1",
+			message:   testMessage,
+			wantClass: failure.Handled,
+			wantKey:   "in/new/nested/message-1",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			forwarder, storage, _ := newTestForwarder(t, testRawConfig())
+			storage.objects[tc.key] = []byte(tc.message)
+
+			err := forwarder.ForwardObject(context.Background(), tc.bucket, tc.key)
+
+			if tc.wantClass == failure.Handled {
+				if want, got := tc.wantClass, failure.Classify(err); err == nil || want != got {
+					t.Errorf("class: want %v, got %v (%v)", want, got, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := storage.objects[tc.wantKey]; !ok {
+				t.Errorf("expected object %s", tc.wantKey)
+			}
+		})
+	}
+}
+
+func TestForwardObjectRecipients(t *testing.T) {
+	tests := map[string]struct {
+		header   string
+		wantSent [][]string
+	}{
+		"foreign recipient": {
+			header:   "To: info@example.com, sales@attacker.example\r\n",
+			wantSent: [][]string{{"<one@example.net>"}},
+		},
+		"received recipient": {
+			header:   "Received: from mail.example.org by inbound-smtp.eu-west-1.amazonaws.com with SMTP id abc for sales@example.com; Tue, 22 Nov 2022 19:16:00 +0000\r\nTo: info@example.com\r\n",
+			wantSent: [][]string{{"<two@example.net>"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rawConfig := testRawConfig()
+			rawConfig.ForwardMapping = map[string][]string{"info@example.com": {"one@example.net"}, "sales": {"two@example.net"}}
+
+			forwarder, storage, sender := newTestForwarder(t, rawConfig)
+			storage.objects["in/new/message-1"] = []byte(tc.header + "From: Sender <sender@example.org>\r\nSubject: Test subject\r\n\r\nMessage body\r\n")
+
+			if err := forwarder.ForwardObject(context.Background(), "s3-bucket-name", "in/new/message-1"); err != nil {
+				t.Fatal(err)
+			}
+
+			var sent [][]string
+			for _, message := range sender.sent {
+				sent = append(sent, message.destinations)
+			}
+			if diff := cmp.Diff(tc.wantSent, sent); diff != "" {
+				t.Errorf("sent (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestForwardMetadata(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.S3.MetadataPrefix = "meta/"
+	rawConfig.Delivery = &config.DeliveryConfig{Mode: config.DeliveryModePerTarget}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	sender.failing["<one@example.net>"] = true
+
+	event := testEvent("message-1", "info@example.com")
+	event.Mail.CommonHeaders.Subject = "Test subject"
+	if err := forwarder.Forward(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	record := metadata.Record{}
+	if err := json.Unmarshal(storage.objects["meta/message-1.json"], &record); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := metadata.OutcomePartiallyForwarded, record.Outcome; want != got {
+		t.Errorf("outcome: want %v, got %v", want, got)
+	}
+	if want, got := "in/forwarded/message-1", record.MessageKey; want != got {
+		t.Errorf("message key: want %v, got %v", want, got)
+	}
+	if want, got := "Test subject", record.Subject; want != got {
+		t.Errorf("subject: want %v, got %v", want, got)
+	}
+	wantMappings := []metadata.Mapping{{
+		Recipient: "info@example.com",
+		Rule:      "info@example.com",
+		Targets:   []string{"one@example.net", "two@example.net", "three@example.net"},
+	}}
+	if diff := cmp.Diff(wantMappings, record.Mappings); diff != "" {
+		t.Errorf("mappings (-want +got):\n%s", diff)
+	}
+	if want, got := 3, len(record.Deliveries); want != got {
+		t.Fatalf("deliveries: want %v, got %v", want, got)
+	}
+	if record.Deliveries[0].Error == "" || record.Deliveries[1].MessageId == "" {
+		t.Errorf("unexpected deliveries %+v", record.Deliveries)
+	}
+
+	// A retried event must not overwrite the record
+	if err := forwarder.Forward(context.Background(), event); failure.Classify(err) != failure.Handled {
+		t.Fatalf("expected handled error, got %v", err)
+	}
+	if err := json.Unmarshal(storage.objects["meta/message-1.json"], &record); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := metadata.OutcomePartiallyForwarded, record.Outcome; want != got {
+		t.Errorf("outcome after retry: want %v, got %v", want, got)
+	}
+}
+
+func TestForwardNotMarkedAsForwarded(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.S3.MetadataPrefix = "meta/"
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	storage.failingMoves["in/forwarded/message-1"] = true
+
+	err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com"))
+	if !errors.Is(err, ErrNotMarkedAsForwarded) {
+		t.Fatalf("want %v, got %v", ErrNotMarkedAsForwarded, err)
+	}
+	if want, got := failure.Handled, failure.Classify(err); want != got {
+		t.Errorf("class: want %v, got %v", want, got)
+	}
+	if want, got := 1, len(sender.sent); want != got {
+		t.Errorf("sent messages: want %v, got %v", want, got)
+	}
+
+	record := metadata.Record{}
+	if err := json.Unmarshal(storage.objects["meta/message-1.json"], &record); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := metadata.OutcomeForwarded, record.Outcome; want != got {
+		t.Errorf("outcome: want %v, got %v", want, got)
+	}
+	if record.Error == "" {
+		t.Errorf("expected error in record")
+	}
+}
+
+func TestForwardStateTrackingTags(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.S3.Incoming.StateTracking = config.StateTrackingTags
+
+	tests := map[string]struct {
+		event     events.SimpleEmailService
+		wantState string
+	}{
+		"forwarded": {
+			event:     testEvent("message-1", "info@example.com"),
+			wantState: StateForwarded,
+		},
+		"failed": {
+			event:     testEvent("message-1", "unknown@example.com"),
+			wantState: StateFailed,
+		},
+		"spam": {
+			event: func() events.SimpleEmailService {
+				event := testEvent("message-1", "info@example.com")
+				event.Receipt.SpamVerdict.Status = "FAIL"
+				return event
+			}(),
+			wantState: StateSpamVirus,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			forwarder, storage, sender := newTestForwarder(t, rawConfig)
+			storage.objects["in/new/message-1"] = []byte(testMessage)
+
+			forwarder.Forward(context.Background(), tc.event)
+
+			if _, ok := storage.objects["in/new/message-1"]; !ok {
+				t.Errorf("expected message to be kept at in/new/")
+			}
+			if want, got := []string{tc.wantState}, storage.states["in/new/message-1"]; !cmp.Equal(want, got) {
+				t.Errorf("states: want %v, got %v", want, got)
+			}
+
+			// A retried event is not processed again
+			sent := len(sender.sent)
+			err := forwarder.Forward(context.Background(), tc.event)
+			if want, got := failure.Handled, failure.Classify(err); err == nil || want != got {
+				t.Errorf("class: want %v, got %v (%v)", want, got, err)
+			}
+			if want, got := sent, len(sender.sent); want != got {
+				t.Errorf("sent messages: want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestForwardNonEmailTargets(t *testing.T) {
+	var payloads []webhook.Payload
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "webhook-secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rawConfig := testRawConfig()
+	rawConfig.SubjectPrefix = "FWD: "
+	rawConfig.Webhook = &config.WebhookConfig{SecretFile: secretFile}
+	rawConfig.S3.MetadataPrefix = "metadata/"
+	rawConfig.ForwardMapping = map[string][]string{
+		"alerts@example.com":  {server.URL + "/hook?token=secret", "s3://s3-bucket-name/mailboxes/alerts/", "oncall@example.net"},
+		"archive@example.com": {"s3://other-bucket/archive/"},
+	}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	// Trust the certificate of the test server
+	forwarder.webhooks = webhook.NewClient([]byte("secret"), server.Client())
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "alerts@example.com", "archive@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The webhook gets the original message
+	if want, got := 1, len(payloads); want != got {
+		t.Fatalf("payloads: want %d, got %d", want, got)
+	}
+	if want, got := "Test subject", payloads[0].Subject; want != got {
+		t.Errorf("subject: want %v, got %v", want, got)
+	}
+	if want, got := "s3://s3-bucket-name/in/forwarded/message-1", payloads[0].RawMessage; want != got {
+		t.Errorf("raw message: want %v, got %v", want, got)
+	}
+
+	if _, ok := storage.objects["mailboxes/alerts/message-1"]; !ok {
+		t.Errorf("expected object mailboxes/alerts/message-1")
+	}
+	if want, got := 1, len(sender.sent); want != got {
+		t.Errorf("sent messages: want %d, got %d", want, got)
+	}
+
+	// Mailboxes in other buckets are not supported by the fake storage
+	var record metadata.Record
+	if err := json.Unmarshal(storage.objects["metadata/message-1.json"], &record); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := metadata.OutcomePartiallyForwarded, record.Outcome; want != got {
+		t.Errorf("outcome: want %v, got %v", want, got)
+	}
+	targets := make([]string, 0)
+	for _, delivery := range record.Deliveries {
+		targets = append(targets, delivery.Target)
+	}
+	want := []string{"oncall@example.net", server.URL + "/hook", "s3://s3-bucket-name/mailboxes/alerts/", "s3://other-bucket/archive/"}
+	if diff := cmp.Diff(want, targets); diff != "" {
+		t.Errorf("delivery targets (-want +got):\n%s", diff)
+	}
+}
+
+func TestForwardIncomplete(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "webhook-secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rawConfig := testRawConfig()
+	rawConfig.Webhook = &config.WebhookConfig{SecretFile: secretFile}
+	rawConfig.S3.MetadataPrefix = "metadata/"
+	rawConfig.ForwardMapping = map[string][]string{
+		"alerts@example.com": {server.URL + "/hook", "oncall@example.net"},
+	}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	forwarder.webhooks = webhook.NewClient([]byte("secret"), server.Client())
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	// The message is not retried, as it has been delivered by email
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "alerts@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(sender.sent); want != got {
+		t.Errorf("sent messages: want %d, got %d", want, got)
+	}
+	if _, ok := storage.objects["in/forwarded/message-1"]; !ok {
+		t.Errorf("expected object in/forwarded/message-1")
+	}
+
+	var record metadata.Record
+	if err := json.Unmarshal(storage.objects["metadata/message-1.json"], &record); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := metadata.OutcomeIncomplete, record.Outcome; want != got {
+		t.Errorf("outcome: want %v, got %v", want, got)
+	}
+	transient := make(map[string]bool)
+	for _, delivery := range record.Deliveries {
+		transient[delivery.Target] = delivery.Transient
+	}
+	want := map[string]bool{"oncall@example.net": false, server.URL + "/hook": true}
+	if diff := cmp.Diff(want, transient); diff != "" {
+		t.Errorf("transient deliveries (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewForwarderWebhookSecret(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.Webhook = &config.WebhookConfig{SecretFile: filepath.Join(t.TempDir(), "missing")}
+	rawConfig.ForwardMapping = map[string][]string{
+		"alerts@example.com": {"https://hooks.example.com/mail"},
+	}
+
+	// The secret is read when the forwarder is created
+	if _, err := NewForwarderWith(parseConfig(t, rawConfig), newFakeStorage(), &fakeSender{}); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
+
+func TestForwardDigest(t *testing.T) {
+	rawConfig := testRawConfig()
+	rawConfig.ForwardMapping["news@example.com"] = []string{"One@example.net"}
+	rawConfig.Digest = &config.DigestConfig{Keys: []string{"news@example.com"}, Prefix: "digest/"}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com", "news@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.sent) != 1 || len(sender.sent[0].destinations) != 3 {
+		t.Fatalf("Expected a single message to the info@example.com targets, got %+v", sender.sent)
+	}
+
+	data, ok := storage.objects["digest/pending/one@example.net/message-1.json"]
+	if !ok {
+		t.Fatal("Expected queued digest entry")
+	}
+	var entry digest.Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := digest.Entry{
+		MessageId:  "message-1",
+		MessageKey: "in/forwarded/message-1",
+		Recipient:  "news@example.com",
+		Target:     "One@example.net",
+		Rule:       "news@example.com",
+		From:       []string{"Sender <sender@example.org>"},
+	}
+	if diff := cmp.Diff(want, entry); diff != "" {
+		t.Errorf("entry (-want +got):\n%s", diff)
+	}
+
+	if _, ok := storage.objects["in/forwarded/message-1"]; !ok {
+		t.Errorf("expected object in/forwarded/message-1")
+	}
+}
+
+func TestForwardAutoReply(t *testing.T) {
+	today := time.Now().UTC()
+	tests := map[string]struct {
+		rule      config.AutoReplyRule
+		header    string
+		source    string
+		spf       string // Defaults to PASS
+		dmarc     string
+		lastReply *time.Time
+		wantReply bool
+	}{
+		"reply": {
+			rule:      config.AutoReplyRule{Body: "Away until $recipient is back"},
+			wantReply: true,
+		},
+		"active": {
+			rule:      config.AutoReplyRule{Body: "Away", Start: today.Format(config.AutoReplyDateFormat), End: today.Format(config.AutoReplyDateFormat)},
+			wantReply: true,
+		},
+		"not yet active": {
+			rule: config.AutoReplyRule{Body: "Away", Start: today.AddDate(0, 0, 1).Format(config.AutoReplyDateFormat)},
+		},
+		"no longer active": {
+			rule: config.AutoReplyRule{Body: "Away", End: today.AddDate(0, 0, -1).Format(config.AutoReplyDateFormat)},
+		},
+		"replied recently": {
+			rule:      config.AutoReplyRule{Body: "Away", IntervalDays: 3},
+			lastReply: aws.Time(today.AddDate(0, 0, -2)),
+		},
+		"interval elapsed": {
+			rule:      config.AutoReplyRule{Body: "Away", IntervalDays: 3},
+			lastReply: aws.Time(today.AddDate(0, 0, -4)),
+			wantReply: true,
+		},
+		"auto-submitted": {
+			rule:   config.AutoReplyRule{Body: "Away"},
+			header: "Auto-Submitted: auto-replied\r\n",
+		},
+		"precedence bulk": {
+			rule:   config.AutoReplyRule{Body: "Away"},
+			header: "Precedence: bulk\r\n",
+		},
+		"list": {
+			rule:   config.AutoReplyRule{Body: "Away"},
+			header: "List-Id: <news.example.org>\r\n",
+		},
+		"null sender": {
+			rule:   config.AutoReplyRule{Body: "Away"},
+			source: "<>",
+		},
+		"unauthenticated": {
+			rule: config.AutoReplyRule{Body: "Away"},
+			spf:  "FAIL",
+		},
+		"From authenticated by DMARC": {
+			rule:      config.AutoReplyRule{Body: "Away"},
+			source:    "bounces@mailer.example.org",
+			spf:       "FAIL",
+			dmarc:     "PASS",
+			wantReply: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rawConfig := testRawConfig()
+			rawConfig.AutoReply = &config.AutoReplyConfig{
+				Prefix: "auto-reply/",
+				Rules:  map[string]config.AutoReplyRule{"info@example.com": tc.rule},
+			}
+
+			forwarder, storage, sender := newTestForwarder(t, rawConfig)
+			storage.objects["in/new/message-1"] = []byte(tc.header + testMessage)
+			stateKey := "auto-reply/info@example.com/sender@example.org"
+			if tc.lastReply != nil {
+				storage.objects[stateKey] = []byte(tc.lastReply.Format(time.RFC3339))
+			}
+
+			event := testEvent("message-1", "info@example.com")
+			event.Mail.Source = "sender@example.org"
+			if tc.source != "" {
+				event.Mail.Source = tc.source
+			}
+			event.Receipt.SPFVerdict.Status = "PASS"
+			if tc.spf != "" {
+				event.Receipt.SPFVerdict.Status = tc.spf
+			}
+			// Passes for any domain, so it does not authenticate the sender
+			event.Receipt.DKIMVerdict.Status = "PASS"
+			event.Receipt.DMARCVerdict.Status = tc.dmarc
+
+			if err := forwarder.Forward(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+
+			var replies []sentMessage
+			for _, message := range sender.sent {
+				if message.destinations[0] == "<sender@example.org>" {
+					replies = append(replies, message)
+				}
+			}
+			if !tc.wantReply {
+				if len(replies) > 0 {
+					t.Fatalf("Expected no auto-reply, got %s", replies[0].data)
+				}
+				return
+			}
+
+			if len(replies) != 1 {
+				t.Fatalf("Expected a single auto-reply, got %d", len(replies))
+			}
+			if replies[0].source != "info@example.com" {
+				t.Errorf("Expected auto-reply from info@example.com, got %s", replies[0].source)
+			}
+			reply, err := mail.ReadMessage(bytes.NewReader(replies[0].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reply.Header.Get("Auto-Submitted"); got != "auto-replied" {
+				t.Errorf("Expected Auto-Submitted auto-replied, got %q", got)
+			}
+			if _, ok := storage.objects[stateKey]; !ok {
+				t.Errorf("expected auto-reply state at %s", stateKey)
+			}
+		})
+	}
+}
+
+func TestForwardRelay(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "relay-secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := testRawConfig()
+	rawConfig.Relay = &config.RelayConfig{Domain: "example.com", SecretFile: secretFile, Prefix: "relay/"}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected a single forwarded message, got %d", len(sender.sent))
+	}
+	forwarded, err := mail.ReadMessage(bytes.NewReader(sender.sent[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverseAddress := forwarded.Header.Get("Reply-To")
+	if !strings.HasPrefix(reverseAddress, "reply+") || !strings.HasSuffix(reverseAddress, "@example.com") {
+		t.Fatalf("Expected reverse address as Reply-To, got %q", reverseAddress)
+	}
+
+	const reply = "From: One <one@example.net>\r\nTo: " + "REVERSE" + "\r\nReply-To: one@example.net\r\nSubject: Re: Test subject\r\n\r\nReply body\r\n"
+
+	tests := map[string]struct {
+		recipient string
+		source    string // Defaults to the From address
+		from      string
+		spf       string
+		dmarc     string
+		wantErr   error
+	}{
+		"reply": {
+			recipient: reverseAddress,
+			from:      "One <one@example.net>",
+			spf:       "PASS",
+		},
+		"reply with DMARC": {
+			recipient: reverseAddress,
+			source:    "bounces@mailer.example.org",
+			from:      "One <one@example.net>",
+			spf:       "PASS",
+			dmarc:     "PASS",
+		},
+		"From without DMARC": {
+			recipient: reverseAddress,
+			source:    "bounces@mailer.example.org",
+			from:      "One <one@example.net>",
+			spf:       "PASS",
+			wantErr:   ErrReplyNotAllowed,
+		},
+		"not a target": {
+			recipient: reverseAddress,
+			from:      "other@example.net",
+			spf:       "PASS",
+			wantErr:   ErrReplyNotAllowed,
+		},
+		"unauthenticated": {
+			recipient: reverseAddress,
+			from:      "One <one@example.net>",
+			spf:       "FAIL",
+			wantErr:   ErrReplyNotAllowed,
+		},
+		"unknown token": {
+			recipient: "reply+aaaaaaaaaaaaaaaaaaaaaaaa@example.com",
+			from:      "One <one@example.net>",
+			spf:       "PASS",
+			wantErr:   ErrUnknownReverseAddress,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sender.sent = nil
+			storage.objects["in/new/message-2"] = []byte(strings.Replace(reply, "REVERSE", tc.recipient, 1))
+
+			from, err := mail.ParseAddress(tc.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event := testEvent("message-2", tc.recipient)
+			event.Mail.Source = from.Address
+			if tc.source != "" {
+				event.Mail.Source = tc.source
+			}
+			event.Mail.CommonHeaders.From = []string{tc.from}
+			event.Receipt.SPFVerdict.Status = tc.spf
+			event.Receipt.DMARCVerdict.Status = tc.dmarc
+
+			err = forwarder.Forward(context.Background(), event)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("Expected %v, got %v", tc.wantErr, err)
+				}
+				if _, ok := storage.objects["in/failed/message-2"]; !ok {
+					t.Errorf("expected object in/failed/message-2")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(sender.sent) != 1 {
+				t.Fatalf("Expected a single relayed reply, got %d", len(sender.sent))
+			}
+			sent := sender.sent[0]
+			if sent.source != "info@example.com" {
+				t.Errorf("Expected reply from info@example.com, got %s", sent.source)
+			}
+			if diff := cmp.Diff([]string{"<sender@example.org>"}, sent.destinations); diff != "" {
+				t.Errorf("destinations (-want +got):\n%s", diff)
+			}
+
+			relayed, err := mail.ReadMessage(bytes.NewReader(sent.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"Reply-To", "Return-Path", "Sender"} {
+				if value := relayed.Header.Get(key); value != "" {
+					t.Errorf("Expected no %s header, got %q", key, value)
+				}
+			}
+			if got := relayed.Header.Get("From"); got != "<info@example.com>" {
+				t.Errorf("Expected From <info@example.com>, got %q", got)
+			}
+			if strings.Contains(string(sent.data), "one@example.net") {
+				t.Errorf("Expected address of the replier to be removed, got:\n%s", sent.data)
+			}
+		})
+	}
+}
+
+func TestForwardRelayAfterDelivery(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "relay-secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := testRawConfig()
+	rawConfig.Relay = &config.RelayConfig{Domain: "example.com", SecretFile: secretFile, Prefix: "relay/"}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	forwarded, err := mail.ReadMessage(bytes.NewReader(sender.sent[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverseAddress := forwarded.Header.Get("Reply-To")
+
+	// Replying to the reverse address and the alias, the delivery to the
+	// alias fails transiently
+	sender.sent = nil
+	sender.failing["<one@example.net>"] = true
+	sender.transient = true
+	storage.objects["in/new/message-2"] = []byte(testMessage)
+	event := testEvent("message-2", reverseAddress, "info@example.com")
+	event.Mail.Source = "one@example.net"
+	event.Receipt.SPFVerdict.Status = "PASS"
+
+	if err := forwarder.Forward(context.Background(), event); failure.Classify(err) != failure.Transient {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	// The reply is relayed once the event is retried
+	if want, got := 0, len(sender.sent); want != got {
+		t.Errorf("sent messages: want %d, got %d", want, got)
+	}
+
+	sender.failing = map[string]bool{}
+	if err := forwarder.Forward(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(sender.sent); want != got {
+		t.Fatalf("sent messages: want %d, got %d", want, got)
+	}
+	if diff := cmp.Diff([]string{"<sender@example.org>"}, sender.sent[1].destinations); diff != "" {
+		t.Errorf("relayed reply destinations (-want +got):\n%s", diff)
+	}
+}
+
+func TestForwardSenderRules(t *testing.T) {
+	tests := map[string]struct {
+		rules       config.SenderRulesConfig
+		recipients  []string
+		dmarc       string
+		wantKey     string
+		wantOutcome string
+		wantRule    string
+		wantSent    [][]string
+	}{
+		"no match": {
+			rules:       config.SenderRulesConfig{Rules: []config.SenderRule{{Action: config.SenderActionDeny, Domain: "example.net"}}},
+			recipients:  []string{"info@example.com"},
+			wantKey:     "in/forwarded/message-1",
+			wantOutcome: metadata.OutcomeForwarded,
+			wantSent:    [][]string{{"<one@example.net>", "<two@example.net>", "<three@example.net>"}},
+		},
+		"denied": {
+			rules:       config.SenderRulesConfig{Rules: []config.SenderRule{{Action: config.SenderActionDeny, Address: "Sender@example.org"}}},
+			recipients:  []string{"info@example.com"},
+			wantKey:     "in/blocked/message-1",
+			wantOutcome: metadata.OutcomeBlocked,
+			wantRule:    "deny address Sender@example.org",
+		},
+		"allowed by priority": {
+			rules: config.SenderRulesConfig{
+				Rules: []config.SenderRule{{Action: config.SenderActionDeny, Domain: "example.org"}},
+				Mappings: map[string][]config.SenderRule{
+					"info@example.com": {{Action: config.SenderActionAllow, Address: "sender@example.org", Priority: 1}},
+				},
+			},
+			recipients:  []string{"info@example.com"},
+			dmarc:       "PASS",
+			wantKey:     "in/forwarded/message-1",
+			wantOutcome: metadata.OutcomeForwarded,
+			wantSent:    [][]string{{"<one@example.net>", "<two@example.net>", "<three@example.net>"}},
+		},
+		"allow unauthenticated": {
+			rules: config.SenderRulesConfig{
+				Rules: []config.SenderRule{{Action: config.SenderActionDeny, Domain: "example.org"}},
+				Mappings: map[string][]config.SenderRule{
+					"info@example.com": {{Action: config.SenderActionAllow, Address: "sender@example.org", Priority: 1}},
+				},
+			},
+			recipients:  []string{"info@example.com"},
+			wantKey:     "in/blocked/message-1",
+			wantOutcome: metadata.OutcomeBlocked,
+			wantRule:    "deny domain example.org",
+		},
+		"only known senders": {
+			rules: config.SenderRulesConfig{Mappings: map[string][]config.SenderRule{
+				"info@example.com": {
+					{Action: config.SenderActionAllow, Domain: "example.com"},
+					{Name: "unknown", Action: config.SenderActionDeny, Regex: ".*", Priority: -1},
+				},
+			}},
+			recipients:  []string{"info@example.com", "sales@example.com"},
+			wantKey:     "in/forwarded/message-1",
+			wantOutcome: metadata.OutcomeForwarded,
+			wantRule:    "unknown",
+			wantSent:    [][]string{{"<sales@example.net>"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rawConfig := testRawConfig()
+			rawConfig.ForwardMapping["sales@example.com"] = []string{"sales@example.net"}
+			rawConfig.S3.Incoming.BlockedPrefix = "in/blocked/"
+			rawConfig.S3.MetadataPrefix = "meta/"
+			rawConfig.SenderRules = &tc.rules
+
+			forwarder, storage, sender := newTestForwarder(t, rawConfig)
+			storage.objects["in/new/message-1"] = []byte(testMessage)
+
+			event := testEvent("message-1", tc.recipients...)
+			event.Mail.Source = "bounces@example.org"
+			event.Receipt.DMARCVerdict.Status = tc.dmarc
+			if err := forwarder.Forward(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+
+			var sent [][]string
+			for _, message := range sender.sent {
+				sent = append(sent, message.destinations)
+			}
+			if diff := cmp.Diff(tc.wantSent, sent); diff != "" {
+				t.Errorf("sent (-want +got):\n%s", diff)
+			}
+			if _, ok := storage.objects[tc.wantKey]; !ok {
+				t.Errorf("expected object %s", tc.wantKey)
+			}
+
+			record := metadata.Record{}
+			if err := json.Unmarshal(storage.objects["meta/message-1.json"], &record); err != nil {
+				t.Fatal(err)
+			}
+			if want, got := tc.wantOutcome, record.Outcome; want != got {
+				t.Errorf("outcome: want %v, got %v", want, got)
+			}
+			if want, got := tc.wantRule, record.SenderRule; want != got {
+				t.Errorf("sender rule: want %q, got %q", want, got)
+			}
+			if want, got := tc.wantKey, record.MessageKey; want != got {
+				t.Errorf("message key: want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestForwardSenderRulesRelay(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "relay-secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rawConfig := testRawConfig()
+	rawConfig.Relay = &config.RelayConfig{Domain: "example.com", SecretFile: secretFile, Prefix: "relay/"}
+	rawConfig.S3.Incoming.BlockedPrefix = "in/blocked/"
+	rawConfig.SenderRules = &config.SenderRulesConfig{Rules: []config.SenderRule{{Action: config.SenderActionDeny, Address: "one@example.net"}}}
+
+	forwarder, storage, sender := newTestForwarder(t, rawConfig)
+	storage.objects["in/new/message-1"] = []byte(testMessage)
+	if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	forwarded, err := mail.ReadMessage(bytes.NewReader(sender.sent[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A denied sender cannot reply through the relay either
+	sender.sent = nil
+	storage.objects["in/new/message-2"] = []byte(testMessage)
+	event := testEvent("message-2", forwarded.Header.Get("Reply-To"))
+	event.Mail.Source = "one@example.net"
+	event.Receipt.SPFVerdict.Status = "PASS"
+	if err := forwarder.Forward(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 0, len(sender.sent); want != got {
+		t.Errorf("sent messages: want %d, got %d", want, got)
+	}
+	if _, ok := storage.objects["in/blocked/message-2"]; !ok {
+		t.Errorf("expected object in/blocked/message-2")
+	}
+}
+
+func TestForwardRelayAliases(t *testing.T) {
+	for _, mode := range []string{config.DeliveryModeBatch, config.DeliveryModePerTarget} {
+		t.Run(mode, func(t *testing.T) {
+			secretFile := filepath.Join(t.TempDir(), "relay-secret")
+			if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rawConfig := testRawConfig()
+			rawConfig.ForwardMapping["sales@example.com"] = []string{"sales@example.net"}
+			rawConfig.Relay = &config.RelayConfig{Domain: "example.com", SecretFile: secretFile, Prefix: "relay/"}
+			rawConfig.Delivery = &config.DeliveryConfig{Mode: mode}
+
+			forwarder, storage, sender := newTestForwarder(t, rawConfig)
+			storage.objects["in/new/message-1"] = []byte(testMessage)
+			if err := forwarder.Forward(context.Background(), testEvent("message-1", "info@example.com", "sales@example.com")); err != nil {
+				t.Fatal(err)
+			}
+
+			// Each target gets the reverse address of its own alias
+			replyTos := make(map[string]string)
+			for _, sent := range sender.sent {
+				forwarded, err := mail.ReadMessage(bytes.NewReader(sent.data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, destination := range sent.destinations {
+					replyTos[destination] = forwarded.Header.Get("Reply-To")
+				}
+			}
+			if replyTos["<one@example.net>"] == replyTos["<sales@example.net>"] {
+				t.Fatalf("Expected reverse addresses per alias, got %v", replyTos)
+			}
+			if replyTos["<one@example.net>"] != replyTos["<two@example.net>"] {
+				t.Errorf("Expected the targets of an alias to share its reverse address, got %v", replyTos)
+			}
+
+			// A target of the second alias replies through its reverse address
+			sender.sent = nil
+			storage.objects["in/new/message-2"] = []byte(testMessage)
+			event := testEvent("message-2", replyTos["<sales@example.net>"])
+			event.Mail.Source = "sales@example.net"
+			event.Receipt.SPFVerdict.Status = "PASS"
+			if err := forwarder.Forward(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+			if len(sender.sent) != 1 {
+				t.Fatalf("Expected a single relayed reply, got %d", len(sender.sent))
+			}
+			if want, got := "sales@example.com", sender.sent[0].source; want != got {
+				t.Errorf("reply source: want %v, got %v", want, got)
+			}
+		})
+	}
+}
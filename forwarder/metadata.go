@@ -0,0 +1,141 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/metadata"
+)
+
+func newMetadataRecord(event *events.SimpleEmailService) *metadata.Record {
+	return &metadata.Record{
+		MessageId:  event.Mail.MessageID,
+		From:       event.Mail.CommonHeaders.From,
+		To:         event.Mail.CommonHeaders.To,
+		Subject:    event.Mail.CommonHeaders.Subject,
+		Recipients: event.Receipt.Recipients,
+		Verdicts: map[string]string{
+			"spam":  event.Receipt.SpamVerdict.Status,
+			"virus": event.Receipt.VirusVerdict.Status,
+			"spf":   event.Receipt.SPFVerdict.Status,
+			"dkim":  event.Receipt.DKIMVerdict.Status,
+			"dmarc": event.Receipt.DMARCVerdict.Status,
+		},
+		ReceivedAt: event.Mail.Timestamp,
+		StartedAt:  time.Now(),
+	}
+}
+
+func metadataMappings(transformedRecipients []envelope.TransformationResult) []metadata.Mapping {
+	mappings := make([]metadata.Mapping, 0, len(transformedRecipients))
+	for _, transformation := range transformedRecipients {
+		targets := make([]string, 0, len(transformation.Transformed)+len(transformation.Targets))
+		for _, target := range transformation.Transformed {
+			targets = append(targets, target.Address)
+		}
+		for _, target := range transformation.Targets {
+			targets = append(targets, target.String())
+		}
+		mappings = append(mappings, metadata.Mapping{
+			Recipient: transformation.Source.Address,
+			Rule:      transformation.Rule,
+			Targets:   targets,
+		})
+	}
+	return mappings
+}
+
+func metadataDeliveries(results []DeliveryResult) []metadata.Delivery {
+	deliveries := make([]metadata.Delivery, 0, len(results))
+	for _, result := range results {
+		delivery := metadata.Delivery{Target: result.Recipient, MessageId: result.MessageId}
+		if result.Err != nil {
+			delivery.Error = result.Err.Error()
+			delivery.Transient = failure.Classify(result.Err) == failure.Transient
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+func unmappedOutcome(policy string) string {
+	if policy == config.UnmappedPolicyDrop {
+		return metadata.OutcomeDropped
+	}
+	return metadata.OutcomeUnmapped
+}
+
+// Store the metadata record of a processed message (if configured).
+// Failures are only logged, as the message has been processed already.
+func (f *Forwarder) storeMetadata(record *metadata.Record, err error) {
+	prefix := f.config.S3.MetadataPrefix
+	if prefix == "" {
+		return
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+		switch failure.Classify(err) {
+		case failure.Handled:
+			if !errors.Is(err, ErrNotMarkedAsForwarded) {
+				// Most likely processed by a previous invocation, keep its record
+				return
+			}
+			// Delivered, keep the outcome
+		case failure.Permanent:
+			record.Outcome = metadata.OutcomeFailed
+		default:
+			record.Outcome = metadata.OutcomeRetry
+		}
+	}
+	record.MessageKey = f.messageKey(record.Outcome, record.MessageId)
+
+	record.FinishedAt = time.Now()
+	record.DurationMs = record.FinishedAt.Sub(record.StartedAt).Milliseconds()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to serialize metadata: %v", err)
+		return
+	}
+
+	key := prefix + record.MessageId + ".json"
+	if _, err := f.storage.Put(key, bytes.NewReader(data)); err != nil {
+		log.Printf("Failed to store metadata at %s: %v", key, err)
+		return
+	}
+	log.Printf("Stored metadata at %s", key)
+}
+
+// Returns the key the message is stored at after processing with the given outcome
+func (f *Forwarder) messageKey(outcome string, messageId string) string {
+	incoming := f.config.S3.Incoming
+	if f.tracksStateWithTags() && outcome != metadata.OutcomeDropped {
+		// Messages are kept at the new prefix
+		return incoming.NewPrefix + messageId
+	}
+
+	switch outcome {
+	case metadata.OutcomeForwarded, metadata.OutcomePartiallyForwarded, metadata.OutcomeIncomplete:
+		return incoming.ForwardedPrefix + messageId
+	case metadata.OutcomeSpamVirus:
+		return incoming.SpamVirusPrefix + messageId
+	case metadata.OutcomeBlocked:
+		return incoming.BlockedPrefix + messageId
+	case metadata.OutcomeUnmapped:
+		return incoming.UnmappedPrefix + messageId
+	case metadata.OutcomeFailed:
+		return incoming.FailedPrefix + messageId
+	case metadata.OutcomeRetry:
+		return incoming.NewPrefix + messageId
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,213 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+	"github.com/codezombiech/aws-mail-forwarder-test/relay"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// Returned if a reply is sent to a reverse address that has not been issued
+var ErrUnknownReverseAddress = failure.AsPermanent(errors.New("unknown reverse address"))
+
+// Returned if a reply to a reverse address is not sent by a target of its alias
+var ErrReplyNotAllowed = failure.AsPermanent(errors.New("reply not sent by a target of the alias"))
+
+// A reply to a reverse address of the relay
+type relayReply struct {
+	Recipient string // The reverse address
+	Token     string
+}
+
+// Split the recipients into the reverse addresses of the relay and the others
+func (f *Forwarder) splitRelayRecipients(recipients []string) ([]string, []relayReply) {
+	if f.relaySecret == nil {
+		return recipients, nil
+	}
+
+	others := make([]string, 0, len(recipients))
+	replies := make([]relayReply, 0)
+	for _, recipient := range recipients {
+		address := recipient
+		if parsed, err := mail.ParseAddress(recipient); err == nil {
+			address = parsed.Address
+		}
+
+		if token, ok := relay.ParseAddress(f.config.Relay.LocalPart, f.config.Relay.Domain, address); ok {
+			replies = append(replies, relayReply{Recipient: address, Token: token})
+		} else {
+			others = append(others, recipient)
+		}
+	}
+	return others, replies
+}
+
+func (f *Forwarder) relayEntryKey(token string) string {
+	return f.config.Relay.Prefix + token + ".json"
+}
+
+// Returns the reverse addresses replacing the Reply-To of the forwarded
+// message, keyed by the alias (original recipient) their targets got the
+// message through. Each is issued for the original sender (Reply-To or From of
+// the original header) and its alias, so only the targets of the alias may
+// reply through it. Nil if the relay is not configured.
+func (f *Forwarder) relayReplyTos(original mail.Header, transformedRecipients []envelope.TransformationResult) (map[string]string, error) {
+	if f.relaySecret == nil || len(transformedRecipients) == 0 {
+		return nil, nil
+	}
+
+	senders, err := original.AddressList(message.ReplyToKey)
+	if err != nil || len(senders) == 0 {
+		senders, err = original.AddressList(message.FromKey)
+	}
+	if err != nil || len(senders) == 0 {
+		log.Printf("Not relaying replies, no valid sender: %v", err)
+		return nil, nil
+	}
+	sender := senders[0].Address
+
+	replyTos := make(map[string]string, len(transformedRecipients))
+	for _, transformation := range transformedRecipients {
+		if transformation.Source == nil || len(transformation.Transformed) == 0 {
+			continue
+		}
+		alias := transformation.Source.Address
+		if _, ok := replyTos[alias]; ok {
+			continue
+		}
+
+		token := relay.Token(f.relaySecret, sender, alias)
+		data, err := json.Marshal(relay.Entry{Sender: sender, Alias: alias})
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize relay entry: %w", err)
+		}
+		key := f.relayEntryKey(token)
+		if _, err := f.storage.Put(key, bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to store relay entry at %s: %w", key, err)
+		}
+
+		replyTos[alias] = relay.Address(f.config.Relay.LocalPart, f.config.Relay.Domain, token)
+	}
+	return replyTos, nil
+}
+
+// Deliver the replies to the original senders of the reverse addresses, sent
+// from the alias. Only targets of the alias may reply through it.
+func (f *Forwarder) relayReplies(ctx context.Context, event *events.SimpleEmailService, replies []relayReply, msg *message.BufferedMessage) []DeliveryResult {
+	log.Printf("Relaying reply to %d reverse addresses...", len(replies))
+
+	results := make([]DeliveryResult, 0, len(replies))
+	for _, reply := range replies {
+		result := DeliveryResult{Recipient: reply.Recipient}
+		result.MessageId, result.Err = f.relayReply(ctx, event, reply, msg)
+		if result.Err != nil {
+			log.Printf("Relaying reply to %s failed: %v", reply.Recipient, result.Err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (f *Forwarder) relayReply(ctx context.Context, event *events.SimpleEmailService, reply relayReply, msg *message.BufferedMessage) (string, error) {
+	entry, err := f.relayEntry(reply.Token)
+	if err != nil {
+		return "", err
+	}
+
+	alias, err := mail.ParseAddress(entry.Alias)
+	if err != nil {
+		return "", failure.AsPermanent(fmt.Errorf("invalid alias of relay entry: %w", err))
+	}
+	sender, err := mail.ParseAddress(entry.Sender)
+	if err != nil {
+		return "", failure.AsPermanent(fmt.Errorf("invalid sender of relay entry: %w", err))
+	}
+
+	if err := f.checkReplyAllowed(event, alias); err != nil {
+		return "", err
+	}
+
+	header := message.CloneHeader(msg.Header)
+	// No debug headers, they would reveal the original From
+	message.ProcessRelayHeader(header, alias, sender)
+
+	data, err := f.buildMessage(&message.BufferedMessage{Header: header, Body: msg.Body})
+	if err != nil {
+		return "", err
+	}
+
+	source, err := envelope.SourceAddress(alias)
+	if err != nil {
+		return "", failure.AsPermanent(fmt.Errorf("invalid alias: %w", err))
+	}
+
+	messageId, err := f.sendMessage(ctx, source.Address, []*mail.Address{sender}, data)
+	f.storeOutgoingMessage(event.Mail.MessageID+"/"+sender.Address, []DeliveryResult{{Recipient: sender.Address, MessageId: messageId, Err: err}}, data)
+	return messageId, err
+}
+
+// Returns the verified entry of the token
+func (f *Forwarder) relayEntry(token string) (*relay.Entry, error) {
+	key := f.relayEntryKey(token)
+	reader, _, err := f.storage.Get(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("%w: no entry at %s", ErrUnknownReverseAddress, key)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get relay entry at %s: %w", key, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relay entry at %s: %w", key, err)
+	}
+
+	var entry relay.Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, failure.AsPermanent(fmt.Errorf("invalid relay entry at %s: %w", key, err))
+	}
+	if !entry.Verify(f.relaySecret, token) {
+		return nil, fmt.Errorf("%w: entry at %s does not match its token", ErrUnknownReverseAddress, key)
+	}
+
+	return &entry, nil
+}
+
+// Ensure the reply is sent by a target of the alias. Only authenticated
+// senders are considered: the envelope sender if SPF passed and the From
+// addresses if DMARC passed (aligned with SPF or DKIM).
+func (f *Forwarder) checkReplyAllowed(event *events.SimpleEmailService, alias *mail.Address) error {
+	repliers := authenticatedSenders(event)
+	if len(repliers) == 0 {
+		return fmt.Errorf("%w (neither SPF nor DMARC passed)", ErrReplyNotAllowed)
+	}
+
+	transformations, err := envelope.TransformRecipients(f.config, []string{alias.Address})
+	if err != nil {
+		return failure.AsPermanent(fmt.Errorf("failed to transform alias %s: %w", alias.Address, err))
+	}
+
+	for _, transformation := range transformations {
+		for _, target := range transformation.Transformed {
+			for _, replier := range repliers {
+				if strings.EqualFold(target.Address, replier) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("%w (alias %s, sender %v)", ErrReplyNotAllowed, alias.Address, repliers)
+}
@@ -0,0 +1,93 @@
+package forwarder
+
+import (
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+)
+
+// Returns the addresses the sender rules are matched against: the envelope
+// sender and the From addresses, see authenticatedSenders for the
+// authenticated ones
+func senderAddresses(event *events.SimpleEmailService) config.Senders {
+	senders := config.Senders{Addresses: make([]string, 0), Authenticated: authenticatedSenders(event)}
+	if source := strings.Trim(event.Mail.Source, "<>"); source != "" {
+		senders.Addresses = append(senders.Addresses, source)
+	}
+	for _, from := range event.Mail.CommonHeaders.From {
+		if address, err := mail.ParseAddress(from); err == nil {
+			senders.Addresses = append(senders.Addresses, address.Address)
+		}
+	}
+	return senders
+}
+
+// Returns the authenticated addresses of the sender: the envelope sender if
+// SPF passed and the From addresses if DMARC passed (aligned with SPF or
+// DKIM). A passing DKIM signature alone authenticates neither, it might be
+// of any domain.
+func authenticatedSenders(event *events.SimpleEmailService) []string {
+	senders := make([]string, 0)
+	if source := strings.Trim(event.Mail.Source, "<>"); source != "" && event.Receipt.SPFVerdict.Status == "PASS" {
+		senders = append(senders, source)
+	}
+	if event.Receipt.DMARCVerdict.Status == "PASS" {
+		for _, from := range event.Mail.CommonHeaders.From {
+			if address, err := mail.ParseAddress(from); err == nil {
+				senders = append(senders, address.Address)
+			}
+		}
+	}
+	return senders
+}
+
+// Apply the sender rules to the transformed recipients and the replies to
+// reverse addresses (global rules only). Returns the recipients and replies
+// the sender is allowed to send to and the rule that denied the first
+// blocked one (nil if none has been blocked).
+func (f *Forwarder) applySenderRules(event *events.SimpleEmailService, transformedRecipients []envelope.TransformationResult, replies []relayReply) ([]envelope.TransformationResult, []relayReply, *config.SenderRule) {
+	if f.config.Senders == nil {
+		return transformedRecipients, replies, nil
+	}
+
+	senders := senderAddresses(event)
+	var denied *config.SenderRule
+	isAllowed := func(key string, recipient string) bool {
+		rule := f.config.Senders.Match(key, senders)
+		if rule == nil || rule.Action == config.SenderActionAllow {
+			if rule != nil {
+				log.Printf("Sender %v allowed for %s (rule %q)", senders.Addresses, recipient, rule.Name)
+			}
+			return true
+		}
+
+		log.Printf("Sender %v blocked for %s (rule %q)", senders.Addresses, recipient, rule.Name)
+		if denied == nil {
+			denied = rule
+		}
+		return false
+	}
+
+	allowed := make([]envelope.TransformationResult, 0, len(transformedRecipients))
+	for _, transformation := range transformedRecipients {
+		if isAllowed(transformation.Rule, transformation.Source.Address) {
+			allowed = append(allowed, transformation)
+		}
+	}
+	allowedReplies := make([]relayReply, 0, len(replies))
+	for _, reply := range replies {
+		if isAllowed("", reply.Recipient) {
+			allowedReplies = append(allowedReplies, reply)
+		}
+	}
+
+	return allowed, allowedReplies, denied
+}
+
+func (f *Forwarder) markAsBlocked(messageId string) error {
+	return f.changeState(messageId, StateBlocked, f.config.S3.Incoming.BlockedPrefix)
+}
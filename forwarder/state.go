@@ -0,0 +1,68 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// States of processed messages, recorded with object tags if configured
+// (see config.StateTrackingTags)
+const (
+	StateForwarded = "forwarded"
+	StateFailed    = "failed"
+	StateSpamVirus = "spam-virus"
+	StateUnmapped  = "unmapped"
+	StateBlocked   = "blocked"
+)
+
+func (f *Forwarder) tracksStateWithTags() bool {
+	return f.config.S3.Incoming.StateTracking == config.StateTrackingTags
+}
+
+// Change the state of a message by tagging it or by moving it to the given
+// prefix, according to the configured state tracking
+func (f *Forwarder) changeState(messageId string, state string, prefix string) error {
+	key := f.config.S3.Incoming.NewPrefix + messageId
+	if !f.tracksStateWithTags() {
+		return f.moveMessage(key, prefix+messageId)
+	}
+
+	err := f.storage.SetState(key, state, time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return failure.AsHandled(fmt.Errorf("failed to set state of message %s to %s: %w", messageId, state, err))
+		}
+		return fmt.Errorf("failed to set state of message %s to %s: %w", messageId, state, err)
+	}
+	log.Printf("Set state of message %s to %s", messageId, state)
+	return nil
+}
+
+// Returns a handled error if the message has been processed already. Only
+// needed when tracking the state with tags, as moved messages are no longer
+// found at the new prefix.
+func (f *Forwarder) checkState(messageId string) error {
+	if !f.tracksStateWithTags() {
+		return nil
+	}
+
+	key := f.config.S3.Incoming.NewPrefix + messageId
+	state, err := f.storage.State(key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return failure.AsHandled(fmt.Errorf("failed to get state of message %s: %w", messageId, err))
+		}
+		return fmt.Errorf("failed to get state of message %s: %w", messageId, err)
+	}
+	if state != "" {
+		return failure.AsHandled(fmt.Errorf("message %s already processed (state %s)", messageId, state))
+	}
+
+	return nil
+}
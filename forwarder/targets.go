@@ -0,0 +1,127 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+	"github.com/codezombiech/aws-mail-forwarder-test/metadata"
+	"github.com/codezombiech/aws-mail-forwarder-test/webhook"
+)
+
+// Storage of mailbox targets, implemented by storage.Storage
+type mailboxStorage interface {
+	Put(key string, reader io.Reader) (*string, error)
+}
+
+// Returned if a message is mapped to a webhook but no webhook secret is configured
+var ErrNoWebhookClient = failure.AsPermanent(errors.New("no webhook secret configured"))
+
+// A non-email target a message is delivered to
+type nonEmailTarget struct {
+	Target    config.Target
+	Recipient *mail.Address // The original recipient the target was mapped from
+}
+
+// Collect the non-email targets of all transformed recipients, ignoring duplicates
+func collectNonEmailTargets(transformedRecipients []envelope.TransformationResult) []nonEmailTarget {
+	targets := make([]nonEmailTarget, 0)
+	seen := make(map[config.Target]bool)
+
+	for _, transformation := range transformedRecipients {
+		for _, target := range transformation.Targets {
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+
+			targets = append(targets, nonEmailTarget{Target: target, Recipient: transformation.Source})
+		}
+	}
+
+	return targets
+}
+
+// Returns a copy of the message whose header can be changed independently
+func cloneMessage(msg *message.BufferedMessage) *message.BufferedMessage {
+	return &message.BufferedMessage{Header: message.CloneHeader(msg.Header), Body: msg.Body}
+}
+
+// Deliver the original (not rewritten) message to the non-email targets
+func (f *Forwarder) deliverToTargets(ctx context.Context, event *events.SimpleEmailService, targets []nonEmailTarget, original *message.BufferedMessage) []DeliveryResult {
+	results := make([]DeliveryResult, 0, len(targets))
+	if len(targets) == 0 {
+		return results
+	}
+
+	log.Printf("Delivering message to %d non-email targets...", len(targets))
+
+	var data []byte
+	for _, target := range targets {
+		result := DeliveryResult{Recipient: target.Target.String()}
+
+		switch target.Target.Kind {
+		case config.TargetKindWebhook:
+			result.Err = f.deliverToWebhook(ctx, event, target, original)
+		case config.TargetKindMailbox:
+			if data == nil {
+				var err error
+				if data, err = f.buildMessage(original); err != nil {
+					result.Err = err
+					break
+				}
+			}
+			result.MessageId, result.Err = f.deliverToMailbox(event.Mail.MessageID, target.Target, data)
+		}
+
+		if result.Err != nil {
+			log.Printf("Delivery to %s failed: %v", result.Recipient, result.Err)
+		} else {
+			log.Printf("Delivery to %s succeeded", result.Recipient)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Post the payload of the message to the webhook
+func (f *Forwarder) deliverToWebhook(ctx context.Context, event *events.SimpleEmailService, target nonEmailTarget, original *message.BufferedMessage) error {
+	if f.webhooks == nil {
+		return ErrNoWebhookClient
+	}
+
+	messageId := event.Mail.MessageID
+	rawMessage := "s3://" + f.config.S3.BucketName + "/" + f.messageKey(metadata.OutcomeForwarded, messageId)
+
+	payload, err := webhook.NewPayload(messageId, target.Recipient.Address, event.Mail.Timestamp, rawMessage, original)
+	if err != nil {
+		return failure.AsPermanent(err)
+	}
+
+	return f.webhooks.Deliver(ctx, target.Target.URL, payload)
+}
+
+// Store the raw message in the mailbox, returns its location
+func (f *Forwarder) deliverToMailbox(messageId string, target config.Target, data []byte) (string, error) {
+	mailbox := f.mailboxes(target.Bucket)
+	if mailbox == nil {
+		return "", failure.AsPermanent(fmt.Errorf("mailbox bucket %s is not supported by the storage", target.Bucket))
+	}
+
+	key := target.Prefix + messageId
+	if _, err := mailbox.Put(key, bytes.NewReader(data)); err != nil {
+		return "", fmt.Errorf("failed to store message in mailbox %s: %w", target, err)
+	}
+
+	return "s3://" + target.Bucket + "/" + key, nil
+}
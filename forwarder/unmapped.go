@@ -0,0 +1,180 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+)
+
+// Split the transformed recipients into the mapped ones and the unmapped recipients
+func splitUnmapped(transformedRecipients []envelope.TransformationResult) ([]envelope.TransformationResult, []*mail.Address) {
+	mapped := make([]envelope.TransformationResult, 0, len(transformedRecipients))
+	unmapped := make([]*mail.Address, 0)
+
+	for _, transformation := range transformedRecipients {
+		if len(transformation.Transformed) > 0 || len(transformation.Targets) > 0 {
+			mapped = append(mapped, transformation)
+		} else {
+			unmapped = append(unmapped, transformation.Source)
+		}
+	}
+
+	return mapped, unmapped
+}
+
+// Apply the unmapped recipient policy to the transformed recipients.
+//
+// Returns the recipients to forward the message to and the unmapped ones. If
+// there are none to forward to, the message has been handled according to the
+// policy (done is true) or an error is returned. Messages with relayed
+// replies are always forwarded, the replies count as mapped recipients.
+func (f *Forwarder) applyUnmappedPolicy(ctx context.Context, event *events.SimpleEmailService, transformedRecipients []envelope.TransformationResult, replies bool) ([]envelope.TransformationResult, []*mail.Address, bool, error) {
+	mapped, unmapped := splitUnmapped(transformedRecipients)
+	if len(unmapped) == 0 {
+		return mapped, unmapped, false, nil
+	}
+
+	policy := f.config.Unmapped.Policy
+	messageId := event.Mail.MessageID
+	log.Printf("Unmapped recipients %v (policy %s)", unmapped, policy)
+
+	switch policy {
+	case config.UnmappedPolicyCatchAll:
+		for _, recipient := range unmapped {
+			mapped = append(mapped, envelope.TransformationResult{
+				Source:      recipient,
+				Transformed: f.config.UnmappedCatchAll,
+			})
+		}
+	}
+
+	if len(mapped) > 0 || replies {
+		// Forward to the mapped part
+		return mapped, unmapped, false, nil
+	}
+
+	switch policy {
+	case config.UnmappedPolicyDrop:
+		if err := f.deleteMessage(f.config.S3.Incoming.NewPrefix + messageId); err != nil {
+			return nil, unmapped, false, err
+		}
+		return nil, unmapped, true, nil
+	case config.UnmappedPolicyQuarantine, config.UnmappedPolicyNotify:
+		if err := f.markAsUnmapped(messageId); err != nil {
+			return nil, unmapped, false, err
+		}
+		f.notifyUnmapped(ctx, event, unmapped)
+		return nil, unmapped, true, nil
+	default:
+		return nil, unmapped, false, ErrNoRecipients
+	}
+}
+
+// Send the original sender a notice about the unmapped recipients if the
+// notify policy is configured. Must only be called once the message reached
+// its final state, so a retried event does not send the notice twice.
+// Failures are only logged, as the notice is best effort.
+func (f *Forwarder) notifyUnmapped(ctx context.Context, event *events.SimpleEmailService, unmapped []*mail.Address) {
+	if f.config.Unmapped.Policy != config.UnmappedPolicyNotify || len(unmapped) == 0 {
+		return
+	}
+
+	to, ok := noticeRecipient(event)
+	if !ok {
+		return
+	}
+
+	from := unmapped[0]
+	if f.config.Unmapped.NoticeFromEmail != "" {
+		parsedFrom, err := mail.ParseAddress(f.config.Unmapped.NoticeFromEmail)
+		if err != nil {
+			log.Printf("Invalid notice sender %s: %v", f.config.Unmapped.NoticeFromEmail, err)
+			return
+		}
+		from = parsedFrom
+	}
+
+	source, err := envelope.SourceAddress(from)
+	if err != nil {
+		log.Printf("Invalid notice sender %s: %v", from.Address, err)
+		return
+	}
+
+	recipients := make([]string, 0, len(unmapped))
+	for _, recipient := range unmapped {
+		recipients = append(recipients, recipient.Address)
+	}
+	replacer := strings.NewReplacer(
+		"$recipients", strings.Join(recipients, "\n"),
+		"$subject", event.Mail.CommonHeaders.Subject,
+	)
+
+	data, err := message.BuildNotice(&message.Notice{
+		From:      source,
+		To:        to,
+		Subject:   replacer.Replace(f.config.Unmapped.NoticeSubject),
+		Body:      replacer.Replace(f.config.Unmapped.NoticeBody),
+		InReplyTo: event.Mail.CommonHeaders.MessageID,
+	}, time.Now())
+	if err != nil {
+		log.Printf("Failed to build non-delivery notice: %v", err)
+		return
+	}
+
+	if _, err := f.sendMessage(ctx, source.Address, []*mail.Address{to}, data); err != nil {
+		log.Printf("Failed to send non-delivery notice to %s: %v", to.Address, err)
+		return
+	}
+
+	log.Printf("Sent non-delivery notice to %s", to.Address)
+}
+
+// Returns the recipient of a notice, which is the envelope sender of the
+// original message if SPF passed, or else its From address if DMARC passed
+// (see authenticatedSenders). To prevent backscatter, no notice is sent for
+// null senders, daemons and unauthenticated senders.
+func noticeRecipient(event *events.SimpleEmailService) (*mail.Address, bool) {
+	source := strings.Trim(event.Mail.Source, "<>")
+	if source == "" {
+		log.Printf("Not sending notice to null sender %q", event.Mail.Source)
+		return nil, false
+	}
+
+	senders := authenticatedSenders(event)
+	if len(senders) == 0 {
+		log.Printf("Not sending notice to unauthenticated sender %s", source)
+		return nil, false
+	}
+
+	address, err := mail.ParseAddress(senders[0])
+	if err != nil {
+		log.Printf("Not sending notice to invalid sender %s: %v", senders[0], err)
+		return nil, false
+	}
+	if strings.HasPrefix(strings.ToLower(address.Address), "mailer-daemon@") {
+		log.Printf("Not sending notice to daemon %s", address.Address)
+		return nil, false
+	}
+
+	return address, true
+}
+
+func (f *Forwarder) deleteMessage(key string) error {
+	if err := f.storage.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete message %s: %w", key, err)
+	}
+	log.Printf("Deleted message %s", key)
+	return nil
+}
+
+func (f *Forwarder) markAsUnmapped(messageId string) error {
+	return f.changeState(messageId, StateUnmapped, f.config.S3.Incoming.UnmappedPrefix)
+}
@@ -10,6 +10,8 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sesv2 v1.15.1
 	github.com/aws/smithy-go v1.13.5
 	github.com/google/go-cmp v0.5.9
+	golang.org/x/net v0.5.0
+	golang.org/x/text v0.6.0
 )
 
 require (
@@ -0,0 +1,148 @@
+package ingress
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Authentication service ID of SES in Authentication-Results headers
+const sesAuthServId = "amazonses.com"
+
+// Recover the SES notification of a message from the headers SES adds when
+// storing it, used for events without a SES receipt (e.g. S3 events).
+//
+// SES prepends its headers, so only the first (top-most) occurrence of each
+// header is trusted, others might have been added by the sender.
+//
+// The envelope recipients are not part of the message. SES only names the
+// recipient in its Received header if there is a single one (see
+// ReceivedRecipient), otherwise the To and Cc recipients are used instead.
+// These are controlled by the sender: Bcc and list recipients are lost, and
+// the sender might add addresses the message has not been sent to, so they
+// must be restricted to the receiving domains.
+func EventFromHeader(messageId string, header mail.Header) events.SimpleEmailService {
+	event := events.SimpleEmailService{}
+
+	event.Mail.MessageID = messageId
+	event.Mail.Source = strings.Trim(header.Get("Return-Path"), "<> ")
+	event.Mail.CommonHeaders.From = header["From"]
+	event.Mail.CommonHeaders.To = header["To"]
+	event.Mail.CommonHeaders.Subject = header.Get("Subject")
+	event.Mail.CommonHeaders.MessageID = header.Get("Message-Id")
+	event.Mail.CommonHeaders.Date = header.Get("Date")
+	if date, err := header.Date(); err == nil {
+		event.Mail.Timestamp = date
+	}
+
+	recipients := make([]string, 0)
+	if recipient, ok := ReceivedRecipient(header); ok {
+		recipients = append(recipients, recipient)
+	} else {
+		for _, key := range []string{"To", "Cc"} {
+			addresses, err := header.AddressList(key)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				recipients = append(recipients, address.Address)
+			}
+		}
+	}
+	event.Receipt.Recipients = recipients
+
+	event.Receipt.SpamVerdict.Status = verdict(header.Get("X-Ses-Spam-Verdict"))
+	event.Receipt.VirusVerdict.Status = verdict(header.Get("X-Ses-Virus-Verdict"))
+
+	results := authenticationResults(header)
+	event.Receipt.SPFVerdict.Status = results["spf"]
+	if event.Receipt.SPFVerdict.Status == "" {
+		// Received-SPF: pass (spfCheck: ...) client-ip=...
+		event.Receipt.SPFVerdict.Status = verdict(strings.SplitN(header.Get("Received-Spf"), " ", 2)[0])
+	}
+	event.Receipt.DKIMVerdict.Status = results["dkim"]
+	event.Receipt.DMARCVerdict.Status = results["dmarc"]
+
+	return event
+}
+
+// Returns the envelope recipient of the top-most Received header if it has
+// been added by SES, e.g. "from ... by inbound-smtp.eu-west-1.amazonaws.com
+// with SMTP id ... for info@example.com; <date>". SES only names the
+// recipient if the message has been sent to a single one.
+func ReceivedRecipient(header mail.Header) (string, bool) {
+	values := header["Received"]
+	if len(values) == 0 {
+		return "", false
+	}
+
+	clauses, _, _ := strings.Cut(values[0], ";")
+	fields := strings.Fields(clauses)
+	bySES, recipient := false, ""
+	for i := 0; i+1 < len(fields); i++ {
+		switch strings.ToLower(fields[i]) {
+		case "by":
+			host := strings.ToLower(fields[i+1])
+			bySES = strings.HasPrefix(host, "inbound-smtp.") && strings.HasSuffix(host, ".amazonaws.com")
+		case "for":
+			recipient = strings.Trim(fields[i+1], "<>")
+		}
+	}
+	if !bySES || recipient == "" {
+		return "", false
+	}
+
+	address, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return "", false
+	}
+	return address.Address, true
+}
+
+// Returns the verdicts of the first Authentication-Results header added by
+// SES, e.g. "amazonses.com; spf=pass ...; dkim=pass ...; dmarc=pass ..."
+// keyed by method. A method passes if any of its results passed.
+func authenticationResults(header mail.Header) map[string]string {
+	results := map[string]string{}
+
+	values := header["Authentication-Results"]
+	if len(values) == 0 {
+		return results
+	}
+
+	parts := strings.Split(values[0], ";")
+	if strings.TrimSpace(parts[0]) != sesAuthServId {
+		return results
+	}
+
+	for _, part := range parts[1:] {
+		method, result, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		result = strings.SplitN(result, " ", 2)[0]
+		if results[method] != "PASS" {
+			results[method] = verdict(result)
+		}
+	}
+
+	return results
+}
+
+// Map a result like "pass" or "softfail" to a SES verdict status, see
+// https://docs.aws.amazon.com/ses/latest/dg/receiving-email-notifications-contents.html#receiving-email-notifications-contents-spamverdict-object
+func verdict(result string) string {
+	switch strings.ToLower(strings.TrimSpace(result)) {
+	case "":
+		return ""
+	case "pass":
+		return "PASS"
+	case "fail", "softfail", "hardfail":
+		return "FAIL"
+	case "temperror":
+		return "PROCESSING_FAILED"
+	default:
+		return "GRAY"
+	}
+}
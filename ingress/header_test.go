@@ -0,0 +1,132 @@
+package ingress
+
+import (
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEventFromHeader(t *testing.T) {
+	reader, err := os.Open("../testdata/test-mail-with-attachment.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	msg, err := mail.ReadMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := EventFromHeader("message-1", msg.Header)
+
+	if want, got := "message-1", event.Mail.MessageID; want != got {
+		t.Errorf("MessageID: want %v, got %v", want, got)
+	}
+	if want, got := "Test mail with attachment", event.Mail.CommonHeaders.Subject; want != got {
+		t.Errorf("Subject: want %v, got %v", want, got)
+	}
+	if want, got := "PASS", event.Receipt.SPFVerdict.Status; want != got {
+		t.Errorf("SPF: want %v, got %v", want, got)
+	}
+	if want, got := "PASS", event.Receipt.DKIMVerdict.Status; want != got {
+		t.Errorf("DKIM: want %v, got %v", want, got)
+	}
+	if want, got := "PASS", event.Receipt.DMARCVerdict.Status; want != got {
+		t.Errorf("DMARC: want %v, got %v", want, got)
+	}
+	if len(event.Receipt.Recipients) == 0 {
+		t.Errorf("expected recipients from To and Cc")
+	}
+}
+
+func TestEventFromHeaderVerdicts(t *testing.T) {
+	message := strings.Join([]string{
+		"X-SES-Spam-Verdict: FAIL",
+		"X-SES-Virus-Verdict: PASS",
+		"Received-SPF: softfail (spfCheck: ...) client-ip=192.0.2.1",
+		"Authentication-Results: amazonses.com; dkim=fail header.i=@example.org; dkim=pass header.i=@example.net; dmarc=fail",
+		// Headers below the ones added by SES are not trusted
+		"X-SES-Spam-Verdict: PASS",
+		"Authentication-Results: amazonses.com; spf=pass",
+		"From: sender@example.org",
+		"To: info@example.com, Other <other@example.com>",
+		"Cc: cc@example.com",
+		"",
+		"Body",
+	}, "\r\n")
+
+	msg, err := mail.ReadMessage(strings.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := EventFromHeader("message-1", msg.Header)
+
+	verdicts := map[string]string{
+		"spam":  event.Receipt.SpamVerdict.Status,
+		"virus": event.Receipt.VirusVerdict.Status,
+		"spf":   event.Receipt.SPFVerdict.Status,
+		"dkim":  event.Receipt.DKIMVerdict.Status,
+		"dmarc": event.Receipt.DMARCVerdict.Status,
+	}
+	want := map[string]string{"spam": "FAIL", "virus": "PASS", "spf": "FAIL", "dkim": "PASS", "dmarc": "FAIL"}
+	if diff := cmp.Diff(want, verdicts); diff != "" {
+		t.Errorf("verdicts (-want +got):\n%s", diff)
+	}
+
+	wantRecipients := []string{"info@example.com", "other@example.com", "cc@example.com"}
+	if diff := cmp.Diff(wantRecipients, event.Receipt.Recipients); diff != "" {
+		t.Errorf("recipients (-want +got):\n%s", diff)
+	}
+}
+
+func TestEventFromHeaderReceivedRecipient(t *testing.T) {
+	tests := map[string]struct {
+		received []string
+		want     []string
+	}{
+		"single recipient": {
+			received: []string{"from mail.example.org by inbound-smtp.eu-west-1.amazonaws.com with SMTP id abc for <bcc@example.com>; Tue, 22 Nov 2022 19:16:00 +0000"},
+			want:     []string{"bcc@example.com"},
+		},
+		"multiple recipients": {
+			received: []string{"from mail.example.org by inbound-smtp.eu-west-1.amazonaws.com with SMTP id abc; Tue, 22 Nov 2022 19:16:00 +0000"},
+			want:     []string{"info@example.com"},
+		},
+		"not added by SES": {
+			received: []string{"from mail.example.org by mx.example.org with SMTP id abc for bcc@example.com; Tue, 22 Nov 2022 19:16:00 +0000"},
+			want:     []string{"info@example.com"},
+		},
+		"below the header of SES": {
+			received: []string{
+				"from mail.example.org by inbound-smtp.eu-west-1.amazonaws.com with SMTP id abc; Tue, 22 Nov 2022 19:16:00 +0000",
+				"from client by inbound-smtp.eu-west-1.amazonaws.com with SMTP id def for bcc@example.com; Tue, 22 Nov 2022 19:15:00 +0000",
+			},
+			want: []string{"info@example.com"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lines := make([]string, 0)
+			for _, received := range tc.received {
+				lines = append(lines, "Received: "+received)
+			}
+			lines = append(lines, "From: sender@example.org", "To: info@example.com", "", "Body")
+
+			msg, err := mail.ReadMessage(strings.NewReader(strings.Join(lines, "\r\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			event := EventFromHeader("message-1", msg.Header)
+			if diff := cmp.Diff(tc.want, event.Receipt.Recipients); diff != "" {
+				t.Errorf("recipients (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package ingress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Returned if the shape of an event is not supported
+var ErrUnsupportedEvent = errors.New("unsupported event")
+
+// A single message to forward, normalized from one of the supported event types
+type Record struct {
+	// The SES notification of the message (nil for S3 events)
+	SES *events.SimpleEmailService `json:"ses,omitempty"`
+
+	// The object the message was stored at (S3 events only)
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+
+	// The ID of the SQS message the record was delivered with (SQS events only)
+	SQSMessageId string `json:"sqsMessageId,omitempty"`
+}
+
+// Returns the ID of the message, which is the SES message ID or (for S3
+// events) derived from the object key, see MessageIdFromKey
+func (r *Record) MessageId() string {
+	if r.SES != nil {
+		return r.SES.Mail.MessageID
+	}
+	return MessageIdFromKey(r.Key)
+}
+
+// Returns the ID of the message stored at the given key, which is the last
+// segment of the key, as SES stores messages at <prefix><message ID>
+func MessageIdFromKey(key string) string {
+	return path.Base(key)
+}
+
+// Fields used to detect the shape of an event
+type probe struct {
+	Records []struct {
+		// aws:ses, aws:s3, aws:sqs or aws:sns (the latter as "EventSource",
+		// which matches as field names are case-insensitive)
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+
+	Type             string `json:"Type"`             // "Notification" for SNS messages delivered to SQS
+	NotificationType string `json:"notificationType"` // "Received" for SES notifications published to SNS
+	Event            string `json:"Event"`            // "s3:TestEvent" sent when configuring S3 notifications
+}
+
+// Parse an event into records. Supported are SES events (invoked by a
+// receipt rule), S3 ObjectCreated events, and SES and S3 notifications
+// delivered through SNS, SQS or SNS to SQS. SNS and SQS messages that cannot
+// be parsed are logged and skipped, the others of the event are returned.
+func Parse(payload []byte) ([]Record, error) {
+	var p probe
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("failed to deserialize event: %w", err)
+	}
+
+	switch {
+	case p.NotificationType == "Received":
+		return parseSESNotification(payload)
+	case p.Type == "Notification":
+		return parseSNSMessage(payload)
+	case p.Event == "s3:TestEvent":
+		return []Record{}, nil
+	case len(p.Records) == 0:
+		return nil, fmt.Errorf("%w: no records", ErrUnsupportedEvent)
+	}
+
+	switch source := p.Records[0].EventSource; source {
+	case "aws:ses":
+		return parseSESEvent(payload)
+	case "aws:s3":
+		return parseS3Event(payload)
+	case "aws:sns":
+		return parseSNSEvent(payload)
+	case "aws:sqs":
+		return parseSQSEvent(payload)
+	default:
+		return nil, fmt.Errorf("%w: event source %q", ErrUnsupportedEvent, source)
+	}
+}
+
+func parseSESEvent(payload []byte) ([]Record, error) {
+	var event events.SimpleEmailEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to deserialize SES event: %w", err)
+	}
+
+	records := make([]Record, 0, len(event.Records))
+	for i := range event.Records {
+		records = append(records, Record{SES: &event.Records[i].SES})
+	}
+	return records, nil
+}
+
+// Parse a SES notification as published to SNS, see
+// https://docs.aws.amazon.com/ses/latest/dg/receiving-email-notifications-contents.html
+func parseSESNotification(payload []byte) ([]Record, error) {
+	var notification events.SimpleEmailService
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		return nil, fmt.Errorf("failed to deserialize SES notification: %w", err)
+	}
+	return []Record{{SES: &notification}}, nil
+}
+
+func parseS3Event(payload []byte) ([]Record, error) {
+	var event events.S3Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to deserialize S3 event: %w", err)
+	}
+
+	records := make([]Record, 0, len(event.Records))
+	for _, record := range event.Records {
+		// Keys are URL encoded in S3 events
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid object key %s: %w", record.S3.Object.Key, err)
+		}
+		records = append(records, Record{Bucket: record.S3.Bucket.Name, Key: key})
+	}
+	return records, nil
+}
+
+func parseSNSEvent(payload []byte) ([]Record, error) {
+	var event events.SNSEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to deserialize SNS event: %w", err)
+	}
+
+	records := make([]Record, 0, len(event.Records))
+	for _, record := range event.Records {
+		parsed, err := Parse([]byte(record.SNS.Message))
+		if err != nil {
+			// Retrying won't help, but must not drop the other messages
+			log.Printf("Skipping SNS message %s: %v (%s)", record.SNS.MessageID, err, record.SNS.Message)
+			continue
+		}
+		records = append(records, parsed...)
+	}
+	return records, nil
+}
+
+// Parse a SNS message delivered to SQS (without raw message delivery)
+func parseSNSMessage(payload []byte) ([]Record, error) {
+	var entity events.SNSEntity
+	if err := json.Unmarshal(payload, &entity); err != nil {
+		return nil, fmt.Errorf("failed to deserialize SNS message: %w", err)
+	}
+	return Parse([]byte(entity.Message))
+}
+
+func parseSQSEvent(payload []byte) ([]Record, error) {
+	var event events.SQSEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to deserialize SQS event: %w", err)
+	}
+
+	records := make([]Record, 0, len(event.Records))
+	for _, record := range event.Records {
+		parsed, err := Parse([]byte(record.Body))
+		if err != nil {
+			// Retrying won't help, but must not drop the other messages of
+			// the batch (SQS deletes the messages not reported as failed)
+			log.Printf("Skipping SQS message %s: %v (%s)", record.MessageId, err, record.Body)
+			continue
+		}
+		for i := range parsed {
+			parsed[i].SQSMessageId = record.MessageId
+		}
+		records = append(records, parsed...)
+	}
+	return records, nil
+}
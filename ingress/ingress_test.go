@@ -0,0 +1,132 @@
+package ingress
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const sesNotification = `{"notificationType": "Received", "mail": {"messageId": "ses-message"}, "receipt": {"recipients": ["info@example.com"]}}`
+
+func quote(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+func TestParse(t *testing.T) {
+	snsMessage := `{"Type": "Notification", "MessageId": "sns-1", "Message": ` + quote(sesNotification) + `}`
+	s3Event := `{"Records": [{"eventSource": "aws:s3", "s3": {"bucket": {"name": "bucket"}, "object": {"key": "in/new/s3+message%40"}}}]}`
+
+	tests := map[string]struct {
+		payload string
+		want    []string
+	}{
+		"ses": {
+			payload: `{"Records": [{"eventSource": "aws:ses", "ses": {"mail": {"messageId": "message-1"}}}, {"eventSource": "aws:ses", "ses": {"mail": {"messageId": "message-2"}}}]}`,
+			want:    []string{"message-1", "message-2"},
+		},
+		"s3": {
+			payload: s3Event,
+			want:    []string{"s3 message@"},
+		},
+		"s3 test event": {
+			payload: `{"Service": "Amazon S3", "Event": "s3:TestEvent"}`,
+			want:    []string{},
+		},
+		"sns": {
+			payload: `{"Records": [{"EventSource": "aws:sns", "Sns": {"MessageId": "sns-1", "Message": ` + quote(sesNotification) + `}}]}`,
+			want:    []string{"ses-message"},
+		},
+		"sqs": {
+			payload: `{"Records": [{"eventSource": "aws:sqs", "messageId": "sqs-1", "body": ` + quote(sesNotification) + `}]}`,
+			want:    []string{"ses-message"},
+		},
+		"sns to sqs": {
+			payload: `{"Records": [{"eventSource": "aws:sqs", "messageId": "sqs-1", "body": ` + quote(snsMessage) + `}]}`,
+			want:    []string{"ses-message"},
+		},
+		"s3 to sqs": {
+			payload: `{"Records": [{"eventSource": "aws:sqs", "messageId": "sqs-1", "body": ` + quote(s3Event) + `}]}`,
+			want:    []string{"s3 message@"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			records, err := Parse([]byte(tc.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0)
+			for _, record := range records {
+				got = append(got, record.MessageId())
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("message IDs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseS3Key(t *testing.T) {
+	records, err := Parse([]byte(`{"Records": [{"eventSource": "aws:s3", "s3": {"bucket": {"name": "bucket"}, "object": {"key": "in/new/message-1"}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Record{{Bucket: "bucket", Key: "in/new/message-1"}}
+	if diff := cmp.Diff(want, records); diff != "" {
+		t.Errorf("records (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseSQSMessageId(t *testing.T) {
+	s3Event := `{"Records": [{"eventSource": "aws:s3", "s3": {"bucket": {"name": "bucket"}, "object": {"key": "in/new/message-1"}}}]}`
+	records, err := Parse([]byte(`{"Records": [{"eventSource": "aws:sqs", "messageId": "sqs-1", "body": ` + quote(s3Event) + `}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Record{{Bucket: "bucket", Key: "in/new/message-1", SQSMessageId: "sqs-1"}}
+	if diff := cmp.Diff(want, records); diff != "" {
+		t.Errorf("records (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseSQSInvalidMessage(t *testing.T) {
+	s3Event := `{"Records": [{"eventSource": "aws:s3", "s3": {"bucket": {"name": "bucket"}, "object": {"key": "in/new/message-1"}}}]}`
+	payload := `{"Records": [` +
+		`{"eventSource": "aws:sqs", "messageId": "sqs-1", "body": "not json"},` +
+		`{"eventSource": "aws:sqs", "messageId": "sqs-2", "body": ` + quote(s3Event) + `},` +
+		`{"eventSource": "aws:sqs", "messageId": "sqs-3", "body": "{}"},` +
+		`{"eventSource": "aws:sqs", "messageId": "sqs-4", "body": ` + quote(sesNotification) + `}]}`
+	records, err := Parse([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, 0)
+	for _, record := range records {
+		ids = append(ids, record.SQSMessageId+" "+record.MessageId())
+	}
+	want := []string{"sqs-2 message-1", "sqs-4 ses-message"}
+	if diff := cmp.Diff(want, ids); diff != "" {
+		t.Errorf("records (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	for name, payload := range map[string]string{
+		"no records":   `{}`,
+		"event source": `{"Records": [{"eventSource": "aws:kinesis"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse([]byte(payload)); !errors.Is(err, ErrUnsupportedEvent) {
+				t.Errorf("want %v, got %v", ErrUnsupportedEvent, err)
+			}
+		})
+	}
+}
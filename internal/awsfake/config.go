@@ -0,0 +1,40 @@
+// Package awsfake provides in-process S3 and SESv2 endpoints for tests that
+// exercise the real SDK clients, including request serialization and error
+// deserialization.
+package awsfake
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// Returns an AWS config with static credentials, resolving the S3 and SESv2
+// endpoints to the given fakes (nil to leave the service unresolved)
+func Config(s3Fake *S3, sesFake *SES) aws.Config {
+	endpoints := map[string]string{}
+	if s3Fake != nil {
+		endpoints[s3.ServiceID] = s3Fake.Server.URL
+	}
+	if sesFake != nil {
+		endpoints[sesv2.ServiceID] = sesFake.Server.URL
+	}
+
+	return aws.Config{
+		Region: "eu-west-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDFAKE", SecretAccessKey: "fake", Source: "awsfake"}, nil
+		}),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			url, ok := endpoints[service]
+			if !ok {
+				return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+			}
+			// Immutable hostnames make the S3 client use path-style addressing
+			return aws.Endpoint{URL: url, HostnameImmutable: true, SigningRegion: region}, nil
+		}),
+		Retryer: func() aws.Retryer { return aws.NopRetryer{} },
+	}
+}
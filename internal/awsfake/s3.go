@@ -0,0 +1,323 @@
+package awsfake
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stored object
+type Object struct {
+	Data         []byte
+	Metadata     map[string]string // User metadata (without the x-amz-meta- prefix)
+	Tags         map[string]string
+	ETag         string
+	LastModified time.Time
+}
+
+// In-process S3 endpoint implementing the operations used by storage.Storage
+// (Get, Head, Put, Copy, Delete, ListObjectsV2 and object tagging) with
+// path-style addressing
+type S3 struct {
+	Server *httptest.Server
+
+	// Maximum number of keys per list page (1000 like S3 if zero)
+	PageSize int
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*Object
+	now     func() time.Time
+}
+
+// Start a S3 endpoint with the given (empty) buckets, closed when the test ends
+func NewS3(t testing.TB, buckets ...string) *S3 {
+	s := &S3{buckets: map[string]map[string]*Object{}, now: time.Now}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Server.Close)
+	return s
+}
+
+// Store an object directly, e.g. a message stored by SES
+func (s *S3) PutObject(bucket string, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(bucket, key, &Object{Data: data})
+}
+
+// Returns a copy of the object (nil if it does not exist)
+func (s *S3) Object(bucket string, key string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil
+	}
+	copied := *object
+	return &copied
+}
+
+// Returns the sorted keys of the bucket
+func (s *S3) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *S3) put(bucket string, key string, object *Object) {
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]*Object{}
+	}
+	sum := md5.Sum(object.Data)
+	object.ETag = `"` + hex.EncodeToString(sum[:]) + `"`
+	object.LastModified = s.now().UTC().Truncate(time.Second)
+	s.buckets[bucket][key] = object
+}
+
+func (s *S3) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Path-style addressing: /<bucket>/<key>
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+	_, tagging := query["tagging"]
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.listObjects(w, objects, query)
+	case tagging && r.Method == http.MethodGet:
+		s.getTagging(w, objects, key)
+	case tagging && r.Method == http.MethodPut:
+		s.putTagging(w, r, objects, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, objects, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" is not implemented")
+	}
+}
+
+func (s *S3) getObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	object, ok := objects[key]
+	if !ok {
+		if r.Method == http.MethodHead {
+			// HEAD responses have no body, the SDK maps the status to types.NotFound
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	w.Header().Set("ETag", object.ETag)
+	w.Header().Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	for k, v := range object.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+
+	if r.Header.Get("If-None-Match") == object.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(object.Data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(object.Data)
+	}
+}
+
+func (s *S3) putObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	object := &Object{Data: data, Metadata: userMetadata(r.Header)}
+	s.put(bucket, key, object)
+
+	w.Header().Set("ETag", object.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3) copyObject(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source encoding")
+		return
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+
+	sourceObject, ok := s.buckets[sourceBucket][sourceKey]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	// The metadata is copied by default (x-amz-metadata-directive: COPY)
+	object := &Object{Data: sourceObject.Data, Metadata: sourceObject.Metadata, Tags: sourceObject.Tags}
+	s.put(bucket, key, object)
+
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: object.ETag, LastModified: object.LastModified.Format(time.RFC3339)})
+}
+
+type tag struct {
+	Key   string
+	Value string
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []tag    `xml:"TagSet>Tag"`
+}
+
+func (s *S3) getTagging(w http.ResponseWriter, objects map[string]*Object, key string) {
+	object, ok := objects[key]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	result := tagging{}
+	for k, v := range object.Tags {
+		result.TagSet = append(result.TagSet, tag{Key: k, Value: v})
+	}
+	writeXML(w, result)
+}
+
+func (s *S3) putTagging(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	object, ok := objects[key]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	var input tagging
+	if err := xml.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	object.Tags = map[string]string{}
+	for _, tag := range input.TagSet {
+		object.Tags[tag.Key] = tag.Value
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3) listObjects(w http.ResponseWriter, objects map[string]*Object, query url.Values) {
+	prefix := query.Get("prefix")
+	pageSize := s.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+
+	keys := make([]string, 0)
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string    `xml:",omitempty"`
+		Contents              []content `xml:"Contents"`
+	}{Prefix: prefix, MaxKeys: pageSize}
+
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		// The last key of the page, as keys are listed in lexicographical order
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		object := objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: object.LastModified.Format(time.RFC3339),
+			ETag:         object.ETag,
+			Size:         len(object.Data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, result)
+}
+
+func userMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(name, "x-amz-meta-")] = v[0]
+		}
+	}
+	return metadata
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, message)
+}
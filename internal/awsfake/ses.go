@@ -0,0 +1,117 @@
+package awsfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// A message sent through the SESv2 endpoint
+type SentEmail struct {
+	MessageId string
+	From      string
+	To        []string
+	Data      []byte
+}
+
+// An error returned by the SESv2 endpoint, e.g. "TooManyRequestsException"
+type SESError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+// In-process SESv2 endpoint implementing SendEmail with raw content
+type SES struct {
+	Server *httptest.Server
+
+	mu     sync.Mutex
+	sent   []SentEmail
+	errors []SESError
+}
+
+// Start a SESv2 endpoint, closed when the test ends
+func NewSES(t testing.TB) *SES {
+	s := &SES{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Server.Close)
+	return s
+}
+
+// Fail the next SendEmail calls with the given errors (one per call)
+func (s *SES) FailNext(errors ...SESError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, errors...)
+}
+
+// Returns the messages sent so far
+func (s *SES) Sent() []SentEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SentEmail(nil), s.sent...)
+}
+
+type sendEmailInput struct {
+	FromEmailAddress string
+	Destination      struct {
+		ToAddresses []string
+	}
+	Content struct {
+		Raw struct {
+			Data []byte // Base64 in JSON
+		}
+	}
+}
+
+func (s *SES) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method != http.MethodPost || r.URL.Path != "/v2/email/outbound-emails" {
+		writeSESError(w, SESError{Code: "NotFoundException", Message: r.Method + " " + r.URL.Path + " is not implemented", Status: http.StatusNotFound})
+		return
+	}
+
+	if len(s.errors) > 0 {
+		sesErr := s.errors[0]
+		s.errors = s.errors[1:]
+		writeSESError(w, sesErr)
+		return
+	}
+
+	var input sendEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeSESError(w, SESError{Code: "BadRequestException", Message: err.Error()})
+		return
+	}
+	if len(input.Content.Raw.Data) == 0 {
+		writeSESError(w, SESError{Code: "BadRequestException", Message: "Only raw content is supported"})
+		return
+	}
+
+	messageId := fmt.Sprintf("fake-%04d", len(s.sent)+1)
+	s.sent = append(s.sent, SentEmail{
+		MessageId: messageId,
+		From:      input.FromEmailAddress,
+		To:        input.Destination.ToAddresses,
+		Data:      input.Content.Raw.Data,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"MessageId": messageId})
+}
+
+func writeSESError(w http.ResponseWriter, sesErr SESError) {
+	status := sesErr.Status
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-ErrorType", sesErr.Code)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": sesErr.Message})
+}
@@ -0,0 +1,72 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"time"
+)
+
+// A digest of several messages generated by the forwarder
+type Digest struct {
+	From     *mail.Address
+	To       *mail.Address
+	Subject  string
+	Summary  string   // Plain text summary of the messages
+	Messages [][]byte // Raw messages attached as message/rfc822 parts (none for a summary only digest)
+}
+
+// Build a digest according to RFC 2046 (multipart/digest) with the summary as
+// first part, or a plain text message with the summary only if there are no
+// messages
+func BuildDigest(digest *Digest, date time.Time) ([]byte, error) {
+	header := mail.Header{}
+	header[FromKey] = []string{encodeAddressHeader(digest.From.String())}
+	header[ToKey] = []string{encodeAddressHeader(digest.To.String())}
+	header[SubjectKey] = []string{mime.QEncoding.Encode("utf-8", digest.Subject)}
+	header[DateKey] = []string{date.Format(time.RFC1123Z)}
+	header[AutoSubmittedKey] = []string{"auto-generated"}
+	header["Mime-Version"] = []string{"1.0"}
+
+	summary, err := encodeQuotedPrintable(digest.Summary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode digest summary: %w", err)
+	}
+
+	if len(digest.Messages) == 0 {
+		header["Content-Type"] = []string{"text/plain; charset=UTF-8"}
+		header["Content-Transfer-Encoding"] = []string{"quoted-printable"}
+		return BuildMail(&BufferedMessage{Header: header, Body: summary})
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header["Content-Type"] = []string{mime.FormatMediaType("multipart/digest", map[string]string{"boundary": writer.Boundary()})}
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write digest summary: %w", err)
+	}
+	part.Write(summary)
+
+	for _, msg := range digest.Messages {
+		// The default content type of digest parts is message/rfc822
+		part, err := writer.CreatePart(textproto.MIMEHeader{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to write digest part: %w", err)
+		}
+		part.Write(msg)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write digest: %w", err)
+	}
+
+	return BuildMail(&BufferedMessage{Header: header, Body: body.Bytes()})
+}
@@ -0,0 +1,74 @@
+package message
+
+import (
+	"log"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+)
+
+// Whether a header value contains raw UTF-8 (RFC 6532) to be encoded for the forwarded message
+func isRawUTF8(value string) bool {
+	return !isASCII(value)
+}
+
+// Encode an address list header value (From, To, Reply-To) for the forwarded message.
+//
+// Headers of internationalized messages may contain raw UTF-8 (RFC 6532).
+// Display names are encoded according to RFC 2047 and domains are converted
+// to their ASCII form. Local parts can't be encoded and are left as is.
+// Values that are already ASCII or can't be parsed are returned unchanged.
+func encodeAddressHeader(value string) string {
+	if !isRawUTF8(value) {
+		return value
+	}
+
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		log.Printf("Failed to parse address header %v, leaving it unchanged: %v", value, err)
+		return value
+	}
+
+	encoded := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		asciiAddress, err := envelope.ToASCIIDomainAddress(address)
+		if err != nil {
+			log.Printf("Failed to convert address %v, leaving it unchanged: %v", address.Address, err)
+			asciiAddress = address
+		}
+		// String() encodes the name according to RFC 2047
+		encoded = append(encoded, asciiAddress.String())
+	}
+
+	return strings.Join(encoded, ", ")
+}
+
+// Encode a text to be prepended to an unstructured header value (e.g. a subject prefix)
+func encodePrefix(prefix string, value string) string {
+	if isASCII(prefix) || !isASCII(value) {
+		// Nothing to encode or the value itself is raw UTF-8 (RFC 6532)
+		return prefix + value
+	}
+
+	if strings.HasPrefix(value, "=?") {
+		// Whitespace between adjacent encoded words is ignored (RFC 2047 section 6.2),
+		// so keep the trailing whitespace of the prefix within the encoded word
+		return mime.QEncoding.Encode("utf-8", prefix) + " " + value
+	}
+
+	trimmedPrefix := strings.TrimRight(prefix, " \t")
+	return mime.QEncoding.Encode("utf-8", trimmedPrefix) + prefix[len(trimmedPrefix):] + value
+}
+
+// Whether the string only consists of ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package message
+
+import (
+	"net/mail"
+	"os"
+	"testing"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
+)
+
+func TestEncodeAddressHeader(t *testing.T) {
+	tests := map[string]struct {
+		value string
+		want  string
+	}{
+		"ascii":         {value: "=?UTF-8?Q?Sender?= <sender@example.com>", want: "=?UTF-8?Q?Sender?= <sender@example.com>"},
+		"utf-8 name":    {value: "Jürgen <juergen@example.com>", want: "=?utf-8?q?J=C3=BCrgen?= <juergen@example.com>"},
+		"utf-8 domain":  {value: "info@bücher.example", want: "<info@xn--bcher-kva.example>"},
+		"utf-8 address": {value: "jürgen@bücher.example", want: "<jürgen@xn--bcher-kva.example>"},
+		"list":          {value: "Jürgen <j@example.com>, info@bücher.example", want: "=?utf-8?q?J=C3=BCrgen?= <j@example.com>, <info@xn--bcher-kva.example>"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if want, got := tc.want, encodeAddressHeader(tc.value); want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestEncodePrefix(t *testing.T) {
+	tests := map[string]struct {
+		prefix string
+		value  string
+		want   string
+	}{
+		"ascii prefix":    {prefix: "FORWARDER: ", value: "Test", want: "FORWARDER: Test"},
+		"utf-8 prefix":    {prefix: "[Bücher] ", value: "Test", want: "=?utf-8?q?[B=C3=BCcher]?= Test"},
+		"encoded value":   {prefix: "[Bücher] ", value: "=?UTF-8?Q?Test?=", want: "=?utf-8?q?[B=C3=BCcher]_?= =?UTF-8?Q?Test?="},
+		"raw utf-8 value": {prefix: "[Bücher] ", value: "Grüße", want: "[Bücher] Grüße"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if want, got := tc.want, encodePrefix(tc.prefix, tc.value); want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestProcessMessageHeaderEAI(t *testing.T) {
+	config, err := config.ParseConfig(&config.RawConfig{
+		ForwardMapping: map[string][]string{
+			"info@bücher.example": {"info@example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := os.Open("../testdata/test-mail-eai.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	mailMessage, err := mail.ReadMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transformations, err := envelope.TransformRecipients(config, []string{"info@bücher.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSender, err := envelope.TransformSenders(config, []string{mailMessage.Header.Get(FromKey)}, transformations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ProcessMessageHeader(config, mailMessage.Header, newSender, transformations); err != nil {
+		t.Fatal(err)
+	}
+
+	// Should be rewritten to the original recipient with an ASCII domain and an encoded name
+	assertHeader(t, mailMessage.Header, FromKey, []string{"=?utf-8?b?SsO8cmdlbiBNw7xsbGVyIGF0IGrDvHJnZW5AYsO8Y2hlci5leGFtcGxl?= <info@xn--bcher-kva.example>"})
+	// Should be set to original sender with an ASCII domain and an encoded name
+	assertHeader(t, mailMessage.Header, ReplyToKey, []string{"=?utf-8?q?J=C3=BCrgen_M=C3=BCller?= <jürgen@xn--bcher-kva.example>"})
+	// Should be left unchanged
+	assertHeader(t, mailMessage.Header, SubjectKey, []string{"Grüße aus München"})
+
+	decoded, err := mail.ParseAddress(mailMessage.Header.Get(FromKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Jürgen Müller at jürgen@bücher.example", decoded.Name; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
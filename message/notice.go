@@ -0,0 +1,64 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	AutoSubmittedKey = "Auto-Submitted"
+	InReplyToKey     = "In-Reply-To"
+	ReferencesKey    = "References"
+	DateKey          = "Date"
+)
+
+// A plain text message generated by the forwarder itself (e.g. a non-delivery notice)
+type Notice struct {
+	From      *mail.Address
+	To        *mail.Address
+	Subject   string
+	Body      string
+	InReplyTo string // The Message-ID of the message the notice refers to (if any)
+}
+
+// Build a notice as an automatically replied message according to RFC 3834
+func BuildNotice(notice *Notice, date time.Time) ([]byte, error) {
+	header := mail.Header{}
+	header[FromKey] = []string{encodeAddressHeader(notice.From.String())}
+	header[ToKey] = []string{encodeAddressHeader(notice.To.String())}
+	header[SubjectKey] = []string{mime.QEncoding.Encode("utf-8", notice.Subject)}
+	header[DateKey] = []string{date.Format(time.RFC1123Z)}
+	header[AutoSubmittedKey] = []string{"auto-replied"}
+	header["Mime-Version"] = []string{"1.0"}
+	header["Content-Type"] = []string{"text/plain; charset=UTF-8"}
+	header["Content-Transfer-Encoding"] = []string{"quoted-printable"}
+	if notice.InReplyTo != "" {
+		header[InReplyToKey] = []string{notice.InReplyTo}
+		header[ReferencesKey] = []string{notice.InReplyTo}
+	}
+
+	body, err := encodeQuotedPrintable(notice.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode notice body: %w", err)
+	}
+
+	return BuildMail(&BufferedMessage{Header: header, Body: body})
+}
+
+// Encode the text with CRLF line delimiters as quoted-printable
+func encodeQuotedPrintable(text string) ([]byte, error) {
+	var body bytes.Buffer
+	writer := quotedprintable.NewWriter(&body)
+	if _, err := writer.Write([]byte(toRFC5322LineDelimiter(strings.ReplaceAll(text, "\r\n", "\n")))); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
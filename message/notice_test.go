@@ -0,0 +1,52 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildNotice(t *testing.T) {
+	data, err := BuildNotice(&Notice{
+		From:      &mail.Address{Address: "info@example.com"},
+		To:        &mail.Address{Address: "sender@example.org"},
+		Subject:   "Undeliverable: Grüsse",
+		Body:      "No such address:\n\nunknown@example.com\n",
+		InReplyTo: "<original@example.org>",
+	}, time.Date(2022, 11, 22, 19, 16, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{
+		"From":           "<info@example.com>",
+		"To":             "<sender@example.org>",
+		"Subject":        "=?utf-8?q?Undeliverable:_Gr=C3=BCsse?=",
+		"Date":           "Tue, 22 Nov 2022 19:16:00 +0000",
+		"Auto-Submitted": "auto-replied",
+		"In-Reply-To":    "<original@example.org>",
+		"References":     "<original@example.org>",
+	}
+	for key, want := range headers {
+		if got := msg.Header.Get(key); want != got {
+			t.Errorf("%s: want %v, got %v", key, want, got)
+		}
+	}
+
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "No such address:\r\n\r\nunknown@example.com", strings.TrimSpace(string(body)); want != got {
+		t.Errorf("body: want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,129 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// Maximum nesting of multipart bodies
+const maxPartDepth = 10
+
+// An attachment (or inline part) that is neither the text nor the HTML body
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType"`
+	ContentId   string `json:"contentId,omitempty"`
+	Size        int    `json:"size"` // Decoded size in bytes
+}
+
+// The bodies and attachments of a message
+type Parts struct {
+	Text        string       // The first text/plain part that is not an attachment
+	HTML        string       // The first text/html part that is not an attachment
+	Attachments []Attachment // All other parts
+}
+
+// Split the message into its bodies and attachments. The transfer encodings
+// are decoded, charsets other than UTF-8 (and its subset US-ASCII) are not
+// converted.
+func ParseParts(msg *BufferedMessage) (*Parts, error) {
+	parts := &Parts{Attachments: make([]Attachment, 0)}
+	header := textproto.MIMEHeader(msg.Header)
+	if err := parts.add(header, msg.Body, 0); err != nil {
+		return nil, fmt.Errorf("failed to parse message parts: %w", err)
+	}
+	return parts, nil
+}
+
+func (p *Parts) add(header textproto.MIMEHeader, body []byte, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// Defaults according to RFC 2045
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxPartDepth {
+			return errors.New("too deeply nested")
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			partBody, err := io.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			if err := p.add(part.Header, partBody, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	decoded, err := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	isAttachment := disposition == "attachment"
+
+	switch {
+	case mediaType == "text/plain" && !isAttachment && p.Text == "":
+		p.Text = string(decoded)
+	case mediaType == "text/html" && !isAttachment && p.HTML == "":
+		p.HTML = string(decoded)
+	default:
+		filename := dispositionParams["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+		p.Attachments = append(p.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			ContentId:   strings.Trim(header.Get("Content-Id"), "<>"),
+			Size:        len(decoded),
+		})
+	}
+
+	return nil
+}
+
+func decodeTransferEncoding(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// Encoded lines are wrapped
+		compact := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+		n, err := base64.StdEncoding.Decode(decoded, compact)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 part: %w", err)
+		}
+		return decoded[:n], nil
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted-printable part: %w", err)
+		}
+		return decoded, nil
+	default:
+		return body, nil
+	}
+}
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseParts(t *testing.T) {
+	raw := strings.ReplaceAll(`From: jane@example.org
+To: alerts@example.com
+Subject: Disk full
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=UTF-8
+Content-Transfer-Encoding: quoted-printable
+
+Disk /dev/sda1 is 99% full, gr=C3=BCezi
+--inner
+Content-Type: text/html; charset=UTF-8
+
+<p>Disk /dev/sda1 is 99% full</p>
+--inner--
+--outer
+Content-Type: text/plain; name="df.txt"
+Content-Disposition: attachment; filename="df.txt"
+Content-Transfer-Encoding: base64
+
+RmlsZXN5c3RlbSAgU2l6ZQ==
+--outer
+Content-Type: image/png
+Content-Id: <logo@example.org>
+Content-Transfer-Encoding: base64
+
+iVBORw0K
+--outer--
+`, "\n", "\r\n")
+
+	msg, err := ReadMessage(bytes.NewReader([]byte(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts, err := ParseParts(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Parts{
+		Text: "Disk /dev/sda1 is 99% full, grüezi",
+		HTML: "<p>Disk /dev/sda1 is 99% full</p>",
+		Attachments: []Attachment{
+			{Filename: "df.txt", ContentType: "text/plain", Size: 16},
+			{ContentType: "image/png", ContentId: "logo@example.org", Size: 6},
+		},
+	}
+	if diff := cmp.Diff(want, parts); diff != "" {
+		t.Errorf("parts (-want +got):\n%s", diff)
+	}
+}
+
+func TestParsePartsSinglePart(t *testing.T) {
+	parts, err := ParseParts(&BufferedMessage{Header: map[string][]string{}, Body: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Hello", parts.Text; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,32 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+)
+
+// Returned if a message can't be parsed. Parsing won't succeed when
+// retried, so the error is permanent.
+var ErrMalformedMessage = failure.AsPermanent(errors.New("malformed message"))
+
+// Read a message and buffer its body
+func ReadMessage(reader io.Reader) (*BufferedMessage, error) {
+	mailMessage, err := mail.ReadMessage(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v: %w", err, ErrMalformedMessage)
+	}
+
+	body, err := io.ReadAll(mailMessage.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message body into memory: %w", err)
+	}
+
+	return &BufferedMessage{
+		Header: mailMessage.Header,
+		Body:   body,
+	}, nil
+}
@@ -8,16 +8,26 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
 )
 
-func ProcessMessageHeader(config *config.ParsedConfig, header mail.Header, newSender *mail.Address) error {
+// Rewrite the message header for forwarding.
+// Per-domain settings are resolved from the first original recipient in transformations.
+func ProcessMessageHeader(config *config.ParsedConfig, header mail.Header, newSender *mail.Address, transformations []envelope.TransformationResult) error {
 	log.Print("Processing message headers...\n")
+	profile := envelope.ResolveProfile(config, transformations)
+	var tag string
+	if len(transformations) > 0 {
+		tag = transformations[0].Tag
+	}
 	fromHeader := header.Get(FromKey)
 
 	// REPLY-TO header
 	// Add "Reply-To:" with the "From" address if it doesn't already exists
 	if _, exists := header[ReplyToKey]; !exists {
-		setHeader(header, ReplyToKey, []string{fromHeader})
+		setHeader(header, ReplyToKey, []string{encodeAddressHeader(fromHeader)})
+	} else if replyTo := header.Get(ReplyToKey); isRawUTF8(replyTo) {
+		setHeader(header, ReplyToKey, []string{encodeAddressHeader(replyTo)})
 	}
 
 	// FROM header
@@ -25,9 +35,9 @@ func ProcessMessageHeader(config *config.ParsedConfig, header mail.Header, newSe
 
 	// SUBJECT header
 	// Add a prefix to the Subject
-	if len(config.SubjectPrefix) > 0 {
+	if len(profile.SubjectPrefix) > 0 {
 		subjectHeader := header.Get(SubjectKey)
-		subjectHeader = config.SubjectPrefix + subjectHeader
+		subjectHeader = encodePrefix(envelope.ExpandTag(profile.SubjectPrefix, tag), subjectHeader)
 		setHeader(header, SubjectKey, []string{subjectHeader})
 	}
 
@@ -47,8 +57,8 @@ func ProcessMessageHeader(config *config.ParsedConfig, header mail.Header, newSe
 	// Actual recipient:	                       private@example.com
 
 	// Replace original 'To' header with a manually defined one
-	if len(config.ToEmail) > 0 {
-		setHeader(header, ToKey, []string{config.ToEmail})
+	if len(profile.ToEmail) > 0 {
+		setHeader(header, ToKey, []string{encodeAddressHeader(envelope.ExpandTag(profile.ToEmail, tag))})
 	}
 
 	// Remove the Return-Path header
@@ -60,25 +70,51 @@ func ProcessMessageHeader(config *config.ParsedConfig, header mail.Header, newSe
 	// Remove Message-ID header
 	removeHeader(header, MessageIdKey)
 
-	// Remove all DKIM-Signature headers to prevent triggering an
-	// "InvalidParameterValue: Duplicate header 'DKIM-Signature'" error.
-	// These signatures will likely be invalid anyways, since the From
-	// header was modified.
+	removeDKIMSignatures(header)
+
+	log.Print("Processing message headers succeeded\n")
+
+	return nil
+}
+
+// Remove all DKIM-Signature headers to prevent triggering an
+// "InvalidParameterValue: Duplicate header 'DKIM-Signature'" error.
+// These signatures will likely be invalid anyways, since the From
+// header was modified.
+func removeDKIMSignatures(header mail.Header) {
 	for k := range header {
 		if strings.HasSuffix(k, "Dkim-Signature") {
 			removeHeader(header, k)
 		}
 	}
+}
 
-	log.Print("Processing message headers succeeded\n")
+// Replace the Reply-To header with the reverse address of the reply relay
+func SetRelayReplyTo(header mail.Header, reverseAddress string) {
+	setHeader(header, ReplyToKey, []string{reverseAddress})
+}
 
-	return nil
+// Process the header of a reply relayed through the alias: From is rewritten
+// to the alias, To to the original sender, and the headers revealing the
+// address of the replying recipient are removed.
+func ProcessRelayHeader(header mail.Header, alias *mail.Address, sender *mail.Address) {
+	setHeader(header, FromKey, []string{encodeAddressHeader(alias.String())})
+	setHeader(header, ToKey, []string{encodeAddressHeader(sender.String())})
+	removeHeader(header, ReplyToKey)
+	removeHeader(header, ReturnPathKey)
+	removeHeader(header, SenderKey)
+	removeHeader(header, MessageIdKey)
+	removeDKIMSignatures(header)
 }
 
 func SetDebugHeaders(header mail.Header, messageMetadata events.SimpleEmailMessage) {
 	// Add debugging headers
 	setHeader(header, "X-Forwarder-Message-Id", []string{messageMetadata.MessageID}) // The unique ID assigned to the email by Amazon SES
-	setHeader(header, "X-Forwarder-Original-From", messageMetadata.CommonHeaders.From)
+	originalFrom := make([]string, 0, len(messageMetadata.CommonHeaders.From))
+	for _, from := range messageMetadata.CommonHeaders.From {
+		originalFrom = append(originalFrom, encodeAddressHeader(from))
+	}
+	setHeader(header, "X-Forwarder-Original-From", originalFrom)
 	setHeader(header, "X-Forwarder-Function-Name", []string{os.Getenv("AWS_LAMBDA_FUNCTION_NAME")})
 }
 
@@ -91,3 +127,37 @@ func removeHeader(header mail.Header, key string) {
 	delete(header, key)
 	log.Printf("Removing header %v", key)
 }
+
+// Set the per-target headers of a message delivered to a single target.
+// The placeholders $target, $recipient and $tag are replaced in the header templates.
+func SetTargetHeaders(header mail.Header, templates map[string]string, target *mail.Address, recipient *mail.Address, tag string) {
+	replacer := strings.NewReplacer(
+		"$target", asciiDomainAddress(target),
+		"$recipient", asciiDomainAddress(recipient),
+		envelope.TagPlaceholder, tag,
+	)
+
+	for key, template := range templates {
+		setHeader(header, key, []string{replacer.Replace(template)})
+	}
+}
+
+// Copy a header, so it can be modified without affecting the original
+func CloneHeader(header mail.Header) mail.Header {
+	clone := make(mail.Header, len(header))
+	for k, v := range header {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+func asciiDomainAddress(address *mail.Address) string {
+	if address == nil {
+		return ""
+	}
+	asciiAddress, err := envelope.ToASCIIDomain(address.Address)
+	if err != nil {
+		return address.Address
+	}
+	return asciiAddress
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/envelope"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -56,7 +57,7 @@ Message body
 			}
 
 			// Act
-			if err := ProcessMessageHeader(config, mailMessage.Header, originalRecipient); err != nil {
+			if err := ProcessMessageHeader(config, mailMessage.Header, originalRecipient, nil); err != nil {
 				t.Fatal(err)
 			}
 
@@ -116,7 +117,7 @@ Message body
 			}
 
 			// Act
-			if err := ProcessMessageHeader(tc.config, mailMessage.Header, originalRecipient); err != nil {
+			if err := ProcessMessageHeader(tc.config, mailMessage.Header, originalRecipient, nil); err != nil {
 				t.Fatal(err)
 			}
 
@@ -125,6 +126,100 @@ Message body
 	}
 }
 
+func TestProcessMessageHeaderProfile(t *testing.T) {
+	subjectPrefix, toEmail := "[example.org] ", "list@example.org"
+	config := &config.ParsedConfig{
+		RawConfig: config.RawConfig{
+			SubjectPrefix: "FORWARDER: ",
+			Profiles: map[string]config.DomainProfileConfig{
+				"example.org": {
+					SubjectPrefix: &subjectPrefix,
+					ToEmail:       &toEmail,
+				},
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		recipient   string
+		wantSubject []string
+		wantTo      []string
+	}{
+		"global": {
+			recipient:   "info@example.com",
+			wantSubject: []string{"FORWARDER: Test subject"},
+			wantTo:      []string{"info@example.com"},
+		},
+		"domain profile": {
+			recipient:   "info@example.org",
+			wantSubject: []string{"[example.org] Test subject"},
+			wantTo:      []string{"list@example.org"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			message := toRFC5322LineDelimiter(`From: sender@example.net
+To: ` + tc.recipient + `
+Subject: Test subject
+Content-Type: text/plain
+
+Message body
+`)
+
+			mailMessage, err := mail.ReadMessage(strings.NewReader(message))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recipient, err := mail.ParseAddress(tc.recipient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transformations := []envelope.TransformationResult{{Source: recipient}}
+
+			// Act
+			if err := ProcessMessageHeader(config, mailMessage.Header, recipient, transformations); err != nil {
+				t.Fatal(err)
+			}
+
+			assertHeader(t, mailMessage.Header, SubjectKey, tc.wantSubject)
+			assertHeader(t, mailMessage.Header, ToKey, tc.wantTo)
+		})
+	}
+}
+
+func TestProcessMessageHeaderTag(t *testing.T) {
+	config := &config.ParsedConfig{
+		RawConfig: config.RawConfig{
+			SubjectPrefix: "[$tag] ",
+		},
+	}
+
+	mailMessage, err := mail.ReadMessage(strings.NewReader(toRFC5322LineDelimiter(`From: sender@example.net
+Subject: Test subject
+Content-Type: text/plain
+
+Message body
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient, err := mail.ParseAddress("user+billing@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformations := []envelope.TransformationResult{{Source: recipient, Tag: "billing"}}
+
+	// Act
+	if err := ProcessMessageHeader(config, mailMessage.Header, recipient, transformations); err != nil {
+		t.Fatal(err)
+	}
+
+	assertHeader(t, mailMessage.Header, SubjectKey, []string{"[billing] Test subject"})
+}
+
 func TestProcessMessageHeaderNoDkimSignature(t *testing.T) {
 	originalRecipientRaw := "public@example.com"
 	originalRecipient, err := mail.ParseAddress(originalRecipientRaw)
@@ -175,7 +270,7 @@ Message body
 	}
 
 	// Act
-	if err := ProcessMessageHeader(&config.ParsedConfig{}, mailMessage.Header, originalRecipient); err != nil {
+	if err := ProcessMessageHeader(&config.ParsedConfig{}, mailMessage.Header, originalRecipient, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -207,7 +302,7 @@ func TestProcessMessageHeaderTestMail(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := ProcessMessageHeader(&config, mailMessage.Header, originalRecipient); err != nil {
+	if err := ProcessMessageHeader(&config, mailMessage.Header, originalRecipient, nil); err != nil {
 		t.Fatal(err)
 	}
 
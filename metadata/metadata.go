@@ -0,0 +1,106 @@
+package metadata
+
+import (
+	"strings"
+	"time"
+)
+
+// Outcomes of processing a message
+const (
+	OutcomeForwarded          = "forwarded"           // Delivered to all targets
+	OutcomePartiallyForwarded = "partially-forwarded" // Delivered to some targets, the others failed permanently
+	OutcomeIncomplete         = "incomplete"          // Delivered to some targets, others failed transiently and need to be redelivered manually
+	OutcomeSpamVirus          = "spam-virus"          // Flagged as spam or virus
+	OutcomeUnmapped           = "unmapped"            // No mapped recipient, quarantined
+	OutcomeDropped            = "dropped"             // No mapped recipient, deleted
+	OutcomeBlocked            = "blocked"             // Denied by the sender rules for all recipients
+	OutcomeFailed             = "failed"              // Failed permanently
+	OutcomeRetry              = "retry"               // Failed transiently, to be retried
+)
+
+// Metadata of a processed message, stored as JSON next to the message
+type Record struct {
+	MessageId  string `json:"messageId"`            // The ID assigned by SES
+	MessageKey string `json:"messageKey,omitempty"` // The key the raw message is stored at (if kept)
+
+	From       []string          `json:"from"`
+	To         []string          `json:"to"`
+	Subject    string            `json:"subject"`
+	Recipients []string          `json:"recipients"` // The envelope recipients
+	Verdicts   map[string]string `json:"verdicts"`   // SES verdicts keyed by spam, virus, spf, dkim and dmarc
+
+	Mappings   []Mapping  `json:"mappings,omitempty"`
+	SenderRule string     `json:"senderRule,omitempty"` // The sender rule that denied the message for a recipient (if any)
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	ReceivedAt time.Time `json:"receivedAt"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// Mapping of an original recipient
+type Mapping struct {
+	Recipient string   `json:"recipient"`
+	Rule      string   `json:"rule,omitempty"` // The forwardMapping key that matched
+	Targets   []string `json:"targets"`
+}
+
+// Delivery of the message to a single target
+type Delivery struct {
+	Target    string `json:"target"`
+	MessageId string `json:"messageId,omitempty"` // The ID of the outgoing message assigned by SES
+	Error     string `json:"error,omitempty"`
+	Transient bool   `json:"transient,omitempty"` // Whether the delivery failed transiently (e.g. a webhook timed out)
+}
+
+// Criteria records are searched by, zero values match any record
+type Filter struct {
+	Since    time.Time         // Received at or after
+	Until    time.Time         // Received before
+	Address  string            // Part of any address (case-insensitive)
+	Outcome  string            // One of the Outcome* constants
+	Verdicts map[string]string // Verdicts keyed like Record.Verdicts, e.g. {"spam": "FAIL"}
+}
+
+// Whether the record matches all criteria of the filter
+func (f *Filter) Matches(record *Record) bool {
+	if !f.Since.IsZero() && record.ReceivedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.ReceivedAt.Before(f.Until) {
+		return false
+	}
+	if f.Outcome != "" && f.Outcome != record.Outcome {
+		return false
+	}
+	for name, verdict := range f.Verdicts {
+		if !strings.EqualFold(verdict, record.Verdicts[name]) {
+			return false
+		}
+	}
+	if f.Address != "" && !containsAddress(record, strings.ToLower(f.Address)) {
+		return false
+	}
+	return true
+}
+
+func containsAddress(record *Record, address string) bool {
+	addresses := make([]string, 0)
+	addresses = append(addresses, record.From...)
+	addresses = append(addresses, record.To...)
+	addresses = append(addresses, record.Recipients...)
+	for _, mapping := range record.Mappings {
+		addresses = append(addresses, mapping.Targets...)
+	}
+
+	for _, candidate := range addresses {
+		if strings.Contains(strings.ToLower(candidate), address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testRecord(id string, receivedAt time.Time) *Record {
+	return &Record{
+		MessageId:  id,
+		From:       []string{"Sender <sender@example.org>"},
+		Recipients: []string{"info@example.com"},
+		Verdicts:   map[string]string{"spam": "PASS", "virus": "PASS"},
+		Mappings: []Mapping{
+			{Recipient: "info@example.com", Rule: "info@example.com", Targets: []string{"one@example.net"}},
+		},
+		Outcome:    OutcomeForwarded,
+		ReceivedAt: receivedAt,
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	receivedAt := time.Date(2022, 11, 22, 19, 16, 0, 0, time.UTC)
+	record := testRecord("message-1", receivedAt)
+
+	tests := map[string]struct {
+		filter Filter
+		want   bool
+	}{
+		"empty":           {filter: Filter{}, want: true},
+		"since":           {filter: Filter{Since: receivedAt}, want: true},
+		"since later":     {filter: Filter{Since: receivedAt.Add(time.Second)}, want: false},
+		"until":           {filter: Filter{Until: receivedAt}, want: false},
+		"until later":     {filter: Filter{Until: receivedAt.Add(time.Second)}, want: true},
+		"sender":          {filter: Filter{Address: "SENDER@example"}, want: true},
+		"target":          {filter: Filter{Address: "one@example.net"}, want: true},
+		"other address":   {filter: Filter{Address: "other@example.com"}, want: false},
+		"outcome":         {filter: Filter{Outcome: OutcomeForwarded}, want: true},
+		"other outcome":   {filter: Filter{Outcome: OutcomeFailed}, want: false},
+		"verdict":         {filter: Filter{Verdicts: map[string]string{"spam": "pass"}}, want: true},
+		"other verdict":   {filter: Filter{Verdicts: map[string]string{"spam": "FAIL"}}, want: false},
+		"missing verdict": {filter: Filter{Verdicts: map[string]string{"dmarc": "PASS"}}, want: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.filter.Matches(record); tc.want != got {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+type fakeStorage struct {
+	objects map[string][]byte
+}
+
+func (s *fakeStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	objects := make([]storage.ObjectInfo, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.ObjectInfo{Key: key, LastModified: time.Now()})
+		}
+	}
+	return objects, nil
+}
+
+func (s *fakeStorage) Get(key string) (io.ReadCloser, int64, error) {
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, 0, fmt.Errorf("failed to get object %s: %w", key, storage.ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func TestSearch(t *testing.T) {
+	day := time.Date(2022, 11, 22, 0, 0, 0, 0, time.UTC)
+
+	reader := &fakeStorage{objects: map[string][]byte{
+		"meta/invalid.json": []byte("{"),
+		"meta/other.txt":    []byte("{}"),
+	}}
+	for i, id := range []string{"message-3", "message-1", "message-2"} {
+		record := testRecord(id, day.Add(time.Duration(3-i)*time.Hour))
+		if id == "message-2" {
+			record.Outcome = OutcomeFailed
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.objects["meta/"+id+".json"] = data
+	}
+
+	records, err := Search(reader, "meta/", &Filter{Outcome: OutcomeForwarded})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	for _, record := range records {
+		got = append(got, record.MessageId)
+	}
+	if diff := cmp.Diff([]string{"message-1", "message-3"}, got); diff != "" {
+		t.Errorf("message IDs (-want +got):\n%s", diff)
+	}
+}
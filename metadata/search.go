@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// Listing and reading of objects, implemented by storage.Storage
+type objectReader interface {
+	List(prefix string) ([]storage.ObjectInfo, error)
+	Get(key string) (io.ReadCloser, int64, error)
+}
+
+// Search the records stored at the given prefix, returns the matching records
+// ordered by the time they were received
+func Search(reader objectReader, prefix string, filter *Filter) ([]*Record, error) {
+	objects, err := reader.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata: %w", err)
+	}
+
+	records := make([]*Record, 0)
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		// Records are written after the message was received, so older
+		// records can be skipped without reading them
+		if !filter.Since.IsZero() && object.LastModified.Before(filter.Since) {
+			continue
+		}
+
+		record, err := readRecord(reader, object.Key)
+		if err != nil {
+			log.Printf("Skipping %s: %v", object.Key, err)
+			continue
+		}
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ReceivedAt.Before(records[j].ReceivedAt)
+	})
+
+	return records, nil
+}
+
+func readRecord(reader objectReader, key string) (*Record, error) {
+	body, _, err := reader.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	record := &Record{}
+	if err := json.NewDecoder(body).Decode(record); err != nil {
+		return nil, fmt.Errorf("failed to deserialize metadata: %w", err)
+	}
+	return record, nil
+}
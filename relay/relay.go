@@ -0,0 +1,65 @@
+// Package relay implements the reverse addresses of the reply relay.
+//
+// Forwarded messages get a Reply-To like reply+<token>@example.com instead of
+// the address of the original sender. The token is a truncated HMAC of the
+// original sender and the alias the message was sent to, which are stored in
+// an Entry, so replies can be delivered to the original sender from the alias
+// without revealing the private addresses of either side.
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// Size of the truncated HMAC of a token in bytes (24 characters encoded)
+const tokenSize = 15
+
+// Lowercase, as local parts might not keep their case
+var tokenEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// The original sender and alias of a reverse address
+type Entry struct {
+	Sender string `json:"sender"` // The address replies are delivered to
+	Alias  string `json:"alias"`  // The address replies are sent from
+}
+
+// Returns the token of the reverse address of the sender and alias
+func Token(secret []byte, sender string, alias string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToLower(sender) + "\n" + strings.ToLower(alias)))
+	return tokenEncoding.EncodeToString(mac.Sum(nil)[:tokenSize])
+}
+
+// Whether the token has been issued for the entry
+func (e Entry) Verify(secret []byte, token string) bool {
+	return hmac.Equal([]byte(Token(secret, e.Sender, e.Alias)), []byte(strings.ToLower(token)))
+}
+
+// Returns the reverse address of the token, e.g. "reply+<token>@example.com"
+func Address(localPart string, domain string, token string) string {
+	return localPart + "+" + token + "@" + domain
+}
+
+// Returns the token of a reverse address, ok is false if the address is not a
+// reverse address of the given local part and domain
+func ParseAddress(localPart string, domain string, address string) (token string, ok bool) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 || !strings.EqualFold(address[at+1:], domain) {
+		return "", false
+	}
+
+	local := strings.ToLower(address[:at])
+	prefix := strings.ToLower(localPart) + "+"
+	if !strings.HasPrefix(local, prefix) {
+		return "", false
+	}
+
+	token = local[len(prefix):]
+	if decoded, err := tokenEncoding.DecodeString(token); err != nil || len(decoded) != tokenSize {
+		return "", false
+	}
+	return token, true
+}
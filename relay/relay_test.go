@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	secret := []byte("secret")
+	entry := Entry{Sender: "Sender@example.org", Alias: "info@example.com"}
+
+	token := Token(secret, entry.Sender, entry.Alias)
+	if len(token) != 24 {
+		t.Errorf("Expected token of 24 characters, got %q", token)
+	}
+	if token != Token(secret, "sender@example.org", "INFO@example.com") {
+		t.Errorf("Expected token to ignore the case of the addresses")
+	}
+
+	if !entry.Verify(secret, token) {
+		t.Errorf("Expected token to verify")
+	}
+	if !entry.Verify(secret, strings.ToUpper(token)) {
+		t.Errorf("Expected token to verify regardless of its case")
+	}
+	if entry.Verify([]byte("other"), token) {
+		t.Errorf("Expected token not to verify with another secret")
+	}
+	if (Entry{Sender: "other@example.org", Alias: entry.Alias}).Verify(secret, token) {
+		t.Errorf("Expected token not to verify for another sender")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	token := Token([]byte("secret"), "sender@example.org", "info@example.com")
+
+	tests := map[string]struct {
+		address   string
+		wantToken string
+		wantOk    bool
+	}{
+		"reverse address": {
+			address:   Address("reply", "example.com", token),
+			wantToken: token,
+			wantOk:    true,
+		},
+		"case": {
+			address:   "Reply+" + strings.ToUpper(token) + "@Example.COM",
+			wantToken: token,
+			wantOk:    true,
+		},
+		"other domain": {
+			address: Address("reply", "example.net", token),
+		},
+		"other local part": {
+			address: Address("info", "example.com", token),
+		},
+		"invalid token": {
+			address: Address("reply", "example.com", "invalid"),
+		},
+		"no token": {
+			address: "reply@example.com",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			token, ok := ParseAddress("reply", "example.com", tc.address)
+			if ok != tc.wantOk || token != tc.wantToken {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tc.wantToken, tc.wantOk, token, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package retention
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+)
+
+// Listing and deletion of objects, implemented by storage.Storage
+type objectStorage interface {
+	List(prefix string) ([]storage.ObjectInfo, error)
+	Delete(key string) error
+}
+
+// Outcome of a purge
+type Result struct {
+	Expired int // Objects older than the retention of their prefix
+	Deleted int // Expired objects deleted (none in dry-run mode)
+	Held    int // Expired objects kept due to a legal hold
+}
+
+// Deletes objects older than the retention configured for their prefix
+type Purger struct {
+	s3      config.S3Config
+	storage objectStorage
+	dryRun  bool
+}
+
+func NewPurger(s3 config.S3Config, storage objectStorage, dryRun bool) *Purger {
+	return &Purger{s3: s3, storage: storage, dryRun: dryRun}
+}
+
+// Purge the objects expired at the given time
+func (p *Purger) Purge(now time.Time) (*Result, error) {
+	held, err := p.legalHolds()
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]string, 0, len(p.s3.RetentionDays))
+	for prefix := range p.s3.RetentionDays {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	result := &Result{}
+	for _, prefix := range prefixes {
+		days := p.s3.RetentionDays[prefix]
+		cutoff := now.AddDate(0, 0, -days)
+		log.Printf("Purging objects at %s older than %d days (%s)...", prefix, days, cutoff.Format(time.RFC3339))
+
+		objects, err := p.storage.List(prefix)
+		if err != nil {
+			return result, fmt.Errorf("failed to list objects at %s: %w", prefix, err)
+		}
+
+		for _, object := range objects {
+			if !object.LastModified.Before(cutoff) {
+				continue
+			}
+			result.Expired++
+
+			if messageId := messageId(prefix, object.Key); held[messageId] {
+				log.Printf("Keeping %s (legal hold on %s)", object.Key, messageId)
+				result.Held++
+				continue
+			}
+
+			if p.dryRun {
+				log.Printf("Would delete %s (last modified %s)", object.Key, object.LastModified.Format(time.RFC3339))
+				continue
+			}
+
+			if err := p.storage.Delete(object.Key); err != nil {
+				return result, fmt.Errorf("failed to delete %s: %w", object.Key, err)
+			}
+			log.Printf("Deleted %s (last modified %s)", object.Key, object.LastModified.Format(time.RFC3339))
+			result.Deleted++
+		}
+	}
+
+	log.Printf("Purge finished: %d expired, %d deleted, %d held", result.Expired, result.Deleted, result.Held)
+	return result, nil
+}
+
+// Returns the IDs of the messages on legal hold
+func (p *Purger) legalHolds() (map[string]bool, error) {
+	held := map[string]bool{}
+	if p.s3.LegalHoldPrefix == "" {
+		return held, nil
+	}
+
+	markers, err := p.storage.List(p.s3.LegalHoldPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list legal holds: %w", err)
+	}
+	for _, marker := range markers {
+		held[messageId(p.s3.LegalHoldPrefix, marker.Key)] = true
+	}
+
+	return held, nil
+}
+
+// Returns the message ID of an object, which is the first segment of the key
+// after the prefix, e.g. "<id>" for "out/sent/<id>/<target>" (or the dead
+// letter "<prefix><id>.json")
+func messageId(prefix string, key string) string {
+	id := strings.TrimPrefix(key, prefix)
+	if i := strings.Index(id, "/"); i >= 0 {
+		id = id[:i]
+	}
+	return strings.TrimSuffix(id, ".json")
+}
@@ -0,0 +1,106 @@
+package retention
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/config"
+	"github.com/codezombiech/aws-mail-forwarder-test/storage"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeStorage struct {
+	objects map[string]time.Time
+}
+
+func (s *fakeStorage) List(prefix string) ([]storage.ObjectInfo, error) {
+	objects := make([]storage.ObjectInfo, 0)
+	for key, lastModified := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.ObjectInfo{Key: key, LastModified: lastModified})
+		}
+	}
+	return objects, nil
+}
+
+func (s *fakeStorage) Delete(key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *fakeStorage) keys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPurge(t *testing.T) {
+	now := time.Date(2022, 11, 22, 19, 16, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.AddDate(0, 0, -days) }
+
+	s3 := config.S3Config{
+		RetentionDays: map[string]int{
+			"in/spam-virus/": 14,
+			"out/sent/":      90,
+		},
+		LegalHoldPrefix: "legal-hold/",
+	}
+
+	tests := map[string]struct {
+		dryRun     bool
+		wantResult Result
+		wantKeys   []string
+	}{
+		"purge": {
+			wantResult: Result{Expired: 3, Deleted: 2, Held: 1},
+			wantKeys: []string{
+				"in/failed/message-1",
+				"in/spam-virus/message-3",
+				"legal-hold/message-4",
+				"out/sent/message-4/one@example.net",
+			},
+		},
+		"dry run": {
+			dryRun:     true,
+			wantResult: Result{Expired: 3, Held: 1},
+			wantKeys: []string{
+				"in/failed/message-1",
+				"in/spam-virus/message-2",
+				"in/spam-virus/message-3",
+				"legal-hold/message-4",
+				"out/sent/message-1",
+				"out/sent/message-4/one@example.net",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			storage := &fakeStorage{objects: map[string]time.Time{
+				"in/failed/message-1":                daysAgo(365), // Kept forever
+				"out/sent/message-1":                 daysAgo(91),
+				"in/spam-virus/message-2":            daysAgo(15),
+				"in/spam-virus/message-3":            daysAgo(13),
+				"out/sent/message-4/one@example.net": daysAgo(100),
+				"legal-hold/message-4":               daysAgo(100),
+			}}
+
+			result, err := NewPurger(s3, storage, tc.dryRun).Purge(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.wantResult, *result); diff != "" {
+				t.Errorf("result (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantKeys, storage.keys()); diff != "" {
+				t.Errorf("keys (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
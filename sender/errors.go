@@ -0,0 +1,99 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/smithy-go"
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+)
+
+// Error codes of SES errors that won't succeed when retried
+var permanentErrorCodes = map[string]bool{
+	"MessageRejected":                    true,
+	"MailFromDomainNotVerifiedException": true,
+	"AccountSuspendedException":          true,
+	"SendingPausedException":             true,
+	"BadRequestException":                true,
+	"NotFoundException":                  true,
+	"LimitExceededException":             true,
+}
+
+// Error codes of SES errors that are expected to succeed when retried
+var transientErrorCodes = map[string]bool{
+	"TooManyRequestsException": true,
+	"ThrottlingException":      true,
+	"Throttling":               true,
+	"RequestTimeout":           true,
+	"InternalFailure":          true,
+	"ServiceUnavailable":       true,
+}
+
+// Error returned if sending a message failed
+type SendError struct {
+	Code      string // The SES error code, e.g. "MessageRejected" (empty if not an API error)
+	Message   string // The SES error message
+	Fault     string // The party at fault ("client", "server" or "unknown")
+	Retryable bool   // Whether the error is transient and sending might succeed when retried
+	Attempts  int    // The number of attempts made
+	Err       error  // The underlying error
+}
+
+func (e *SendError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("failed to send message after %d attempts: %v", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf(
+		"failed to send message after %d attempts (code: %s, message: %s, fault: %s)",
+		e.Attempts, e.Code, e.Message, e.Fault,
+	)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SendError) FailureClass() failure.Class {
+	if e.Retryable {
+		return failure.Transient
+	}
+	return failure.Permanent
+}
+
+// Whether the error is a transient send error
+func IsRetryable(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && sendErr.Retryable
+}
+
+// Classify an error returned by the SES client
+func classifyError(err error) *SendError {
+	sendErr := &SendError{
+		Fault: smithy.FaultUnknown.String(),
+		Err:   err,
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		sendErr.Code = apiErr.ErrorCode()
+		sendErr.Message = apiErr.ErrorMessage()
+		sendErr.Fault = apiErr.ErrorFault().String()
+
+		switch {
+		case permanentErrorCodes[sendErr.Code]:
+			sendErr.Retryable = false
+		case transientErrorCodes[sendErr.Code]:
+			sendErr.Retryable = true
+		default:
+			// Unknown errors are only retried if they are not caused by the request
+			sendErr.Retryable = apiErr.ErrorFault() == smithy.FaultServer
+		}
+		return sendErr
+	}
+
+	// Errors without a response (e.g. connection errors) are retried,
+	// unless the invocation ran out of time
+	sendErr.Retryable = !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	return sendErr
+}
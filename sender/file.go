@@ -0,0 +1,58 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// Sender writing messages to files instead of sending them, e.g. for running
+// the forwarder locally. Each message is written to <dir>/<message ID>.eml,
+// the envelope is not kept.
+type FileSender struct {
+	dir   string
+	mu    sync.Mutex
+	count int
+}
+
+func NewFileSender(dir string) *FileSender {
+	return &FileSender{dir: dir}
+}
+
+func (s *FileSender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
+	s.mu.Lock()
+	s.count++
+	messageId := fmt.Sprintf("%s-%04d", time.Now().UTC().Format("20060102T150405"), s.count)
+	s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, localSendError(err)
+	}
+	if err := os.WriteFile(s.Path(messageId), data, 0o644); err != nil {
+		return nil, localSendError(err)
+	}
+
+	return &messageId, nil
+}
+
+// Returns the path of the file a sent message was written to
+func (s *FileSender) Path(messageId string) string {
+	return filepath.Join(s.dir, messageId+".eml")
+}
+
+// Error of a local delivery. Not retried, as local deliveries mostly fail due
+// to the setup (e.g. permissions), the message is marked as failed instead.
+func localSendError(err error) *SendError {
+	return &SendError{Fault: smithy.FaultClient.String(), Attempts: 1, Err: err}
+}
+
+// Messages are stored with CRLF line endings by SES, local mailboxes use LF
+func toUnixLineEndings(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
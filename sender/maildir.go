@@ -0,0 +1,130 @@
+package sender
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sender delivering messages into local Maildirs, one per target address
+// below the root directory (e.g. <root>/jane@example.com/new/), see
+// https://cr.yp.to/proto/maildir.html
+//
+// Messages are written to tmp/ first and then renamed to new/, so readers
+// like an IMAP server never see partial messages.
+//
+// The unique name of a message is derived from its content, so delivering the
+// same message again (e.g. when an event is retried after a partial failure)
+// skips the Maildirs that already have it instead of duplicating it there.
+type MaildirSender struct {
+	root string
+}
+
+func NewMaildirSender(root string) *MaildirSender {
+	return &MaildirSender{root: root}
+}
+
+// Deliver the message to the Maildir of each destination, skipping the ones
+// already having it. Returns the unique name of the message, which is the same
+// in all Maildirs.
+func (s *MaildirSender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
+	dirs := make([]string, 0, len(destinations))
+	for _, destination := range destinations {
+		dir, err := s.maildir(destination)
+		if err != nil {
+			return nil, localSendError(err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	data = toUnixLineEndings(data)
+	name := uniqueName(data)
+
+	for _, dir := range dirs {
+		delivered, err := isDelivered(dir, name)
+		if err != nil {
+			return nil, localSendError(err)
+		}
+		if delivered {
+			continue
+		}
+		if err := deliverToMaildir(dir, name, data); err != nil {
+			return nil, localSendError(err)
+		}
+	}
+
+	return &name, nil
+}
+
+// Returns the Maildir of the destination address
+func (s *MaildirSender) maildir(destination string) (string, error) {
+	address, err := mail.ParseAddress(destination)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination %s: %w", destination, err)
+	}
+	name := strings.ToLower(address.Address)
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid destination %s: not usable as directory name", destination)
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+// Returns the unique name of the message, the hex encoded SHA-256 hash of its content
+func uniqueName(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether the Maildir already has the message, either still in new/ or in cur/,
+// where readers append the info (e.g. ":2,S") to the name
+func isDelivered(dir string, name string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(dir, "new", name)); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "cur", name+"*"))
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0, nil
+}
+
+func deliverToMaildir(dir string, name string, data []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+
+	// A file left in tmp/ by an interrupted delivery has the same content, so
+	// it is overwritten
+	tmpPath := filepath.Join(dir, "tmp", name)
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	// The message must be on disk before it appears in new/
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(dir, "new", name))
+}
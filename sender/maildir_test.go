@@ -0,0 +1,95 @@
+package sender
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaildirSender(t *testing.T) {
+	root := t.TempDir()
+	s := NewMaildirSender(root)
+
+	name, err := s.SendMessage(context.Background(), "from@example.net", []string{"<Jane@example.com>", "John <john@example.com>"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"jane@example.com", "john@example.com"} {
+		data, err := os.ReadFile(filepath.Join(root, address, "new", *name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "Subject: Test\n\nBody\n", string(data); want != got {
+			t.Errorf("%s: want %q, got %q", address, want, got)
+		}
+
+		tmp, err := os.ReadDir(filepath.Join(root, address, "tmp"))
+		if err != nil || len(tmp) != 0 {
+			t.Errorf("%s: expected empty tmp/, got %v (%v)", address, tmp, err)
+		}
+	}
+
+	// Names differ for different messages
+	other, err := s.SendMessage(context.Background(), "from@example.net", []string{"jane@example.com"}, []byte("Subject: Other\r\n\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *other == *name {
+		t.Errorf("expected unique name, got %v twice", *name)
+	}
+}
+
+func TestMaildirSenderRetry(t *testing.T) {
+	root := t.TempDir()
+	s := NewMaildirSender(root)
+	data := []byte("Subject: Test\r\n\r\nBody\r\n")
+
+	// First attempt reached jane only, who has read the message since
+	name, err := s.SendMessage(context.Background(), "from@example.net", []string{"jane@example.com"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	janeDir := filepath.Join(root, "jane@example.com")
+	if err := os.Rename(filepath.Join(janeDir, "new", *name), filepath.Join(janeDir, "cur", *name+":2,S")); err != nil {
+		t.Fatal(err)
+	}
+
+	retried, err := s.SendMessage(context.Background(), "from@example.net", []string{"jane@example.com", "john@example.com"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *retried != *name {
+		t.Errorf("want name %v, got %v", *name, *retried)
+	}
+
+	for address, want := range map[string]int{"jane@example.com": 0, "john@example.com": 1} {
+		entries, err := os.ReadDir(filepath.Join(root, address, "new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != want {
+			t.Errorf("%s: want %d messages in new/, got %d", address, want, len(entries))
+		}
+	}
+}
+
+func TestMaildirSenderInvalidDestination(t *testing.T) {
+	s := NewMaildirSender(t.TempDir())
+
+	for name, destination := range map[string]string{
+		"not an address": "jane",
+		"path":           "../jane@example.com",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.SendMessage(context.Background(), "from@example.net", []string{destination}, []byte("Subject: Test\r\n\r\n"))
+			if err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+			if IsRetryable(err) {
+				t.Errorf("expected permanent error, got %v", err)
+			}
+		})
+	}
+}
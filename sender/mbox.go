@@ -0,0 +1,80 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Sender appending messages to a local mbox file (mboxrd format, see
+// https://www.loc.gov/preservation/digital/formats/fdd/fdd000385.shtml).
+// All destinations share the same mailbox.
+//
+// Appending is serialized within the process only, the file must not be
+// written by other processes at the same time.
+type MboxSender struct {
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+func NewMboxSender(path string) *MboxSender {
+	return &MboxSender{path: path, now: time.Now}
+}
+
+// Append the message to the mbox file. Returns the From_ line of the message.
+func (s *MboxSender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
+	fromLine := fmt.Sprintf("From %s %s", envelopeSender(source), s.now().UTC().Format(time.ANSIC))
+	entry := mboxEntry(fromLine, data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, localSendError(err)
+	}
+	// Written at once, so a failed write does not leave a partial entry in most cases
+	if _, err := file.Write(entry); err != nil {
+		file.Close()
+		return nil, localSendError(err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, localSendError(err)
+	}
+
+	return &fromLine, nil
+}
+
+// Returns the address of the sender for the From_ line
+func envelopeSender(source string) string {
+	address, err := mail.ParseAddress(source)
+	if err != nil || address.Address == "" {
+		return "MAILER-DAEMON"
+	}
+	return address.Address
+}
+
+// Lines that would be mistaken for a From_ line or result from escaping one
+var fromLinePattern = regexp.MustCompile(`(?m)^(>*From )`)
+
+// Returns the mbox entry of the message: the From_ line, the message with
+// "From " lines escaped as ">From " (and ">From " as ">>From " to be
+// reversible) and a blank line separating it from the next entry
+func mboxEntry(fromLine string, data []byte) []byte {
+	data = toUnixLineEndings(data)
+	data = fromLinePattern.ReplaceAll(data, []byte(">$1"))
+
+	entry := bytes.NewBufferString(fromLine + "\n")
+	entry.Write(data)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		entry.WriteString("\n")
+	}
+	entry.WriteString("\n")
+	return entry.Bytes()
+}
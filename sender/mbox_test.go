@@ -0,0 +1,60 @@
+package sender
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMboxEntry(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		want string
+	}{
+		"plain": {
+			data: "Subject: Test\r\n\r\nBody\r\n",
+			want: "From jane@example.com Tue Nov 22 19:16:00 2022\nSubject: Test\n\nBody\n\n",
+		},
+		"from lines": {
+			data: "Subject: Test\r\n\r\nFrom here\r\n>From there\r\nSent From home\r\nFromage\r\n",
+			want: "From jane@example.com Tue Nov 22 19:16:00 2022\nSubject: Test\n\n>From here\n>>From there\nSent From home\nFromage\n\n",
+		},
+		"no trailing newline": {
+			data: "Subject: Test\r\n\r\nBody",
+			want: "From jane@example.com Tue Nov 22 19:16:00 2022\nSubject: Test\n\nBody\n\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := string(mboxEntry("From jane@example.com Tue Nov 22 19:16:00 2022", []byte(tc.data)))
+			if tc.want != got {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMboxSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	s := NewMboxSender(path)
+	s.now = func() time.Time { return time.Unix(1669144560, 0) }
+
+	for _, source := range []string{"\"Jane at jane@example.org\" <forwarder@example.com>", ""} {
+		if _, err := s.SendMessage(context.Background(), source, []string{"john@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From forwarder@example.com Tue Nov 22 19:16:00 2022\nSubject: Test\n\nBody\n\n" +
+		"From MAILER-DAEMON Tue Nov 22 19:16:00 2022\nSubject: Test\n\nBody\n\n"
+	if want != string(data) {
+		t.Errorf("want %q, got %q", want, string(data))
+	}
+}
@@ -0,0 +1,96 @@
+package sender
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Policy for retrying transient send errors with jittered exponential backoff
+type RetryPolicy struct {
+	MaxAttempts int           // Maximum number of attempts (including the first one)
+	BaseDelay   time.Duration // Delay before the first retry (before jitter)
+	MaxDelay    time.Duration // Upper limit of the delay between attempts
+
+	// Time to leave before the deadline of the context, so the caller
+	// can still handle the error (e.g. mark the message as failed)
+	Reserve time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	Reserve:     2 * time.Second,
+}
+
+// Returns the delay before the given retry (1 for the first retry),
+// using "full jitter", see
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func (p RetryPolicy) delay(retry int, random func(int64) int64) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(random(int64(delay)) + 1)
+}
+
+// Whether there is enough time left to wait for the given delay and try again
+func (p RetryPolicy) hasTimeFor(ctx context.Context, delay time.Duration, now time.Time) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	return now.Add(delay + p.Reserve).Before(deadline)
+}
+
+// Call fn until it succeeds, fails permanently, the maximum number of
+// attempts is reached or there is no time left
+func (s *Sender) retry(ctx context.Context, fn func() error) error {
+	policy := s.retryPolicy
+	attempt := 0
+	for {
+		attempt++
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		sendErr := classifyError(err)
+		sendErr.Attempts = attempt
+
+		if !sendErr.Retryable || attempt >= policy.MaxAttempts {
+			return sendErr
+		}
+
+		delay := policy.delay(attempt, rand.Int63n)
+		if !policy.hasTimeFor(ctx, delay, time.Now()) {
+			log.Printf("No time left to retry after %d attempts", attempt)
+			return sendErr
+		}
+
+		log.Printf("Sending failed with transient error (attempt %d/%d), retrying in %s: %v", attempt, policy.MaxAttempts, delay, err)
+		if err := s.sleep(ctx, delay); err != nil {
+			return sendErr
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
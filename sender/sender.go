@@ -2,27 +2,39 @@ package sender
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
-	"github.com/aws/smithy-go"
 )
 
+// The subset of the SES client used by the sender
+type sesAPI interface {
+	SendEmail(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error)
+}
+
 type Sender struct {
-	sesClient *sesv2.Client
+	sesClient   sesAPI
+	retryPolicy RetryPolicy
+	sleep       func(ctx context.Context, delay time.Duration) error
 }
 
 func NewSender(awsConfig aws.Config) *Sender {
 	return &Sender{
-		sesClient: sesv2.NewFromConfig(awsConfig),
+		sesClient: sesv2.NewFromConfig(awsConfig, func(o *sesv2.Options) {
+			// Retries are handled by the sender according to its retry policy
+			o.Retryer = aws.NopRetryer{}
+		}),
+		retryPolicy: DefaultRetryPolicy,
+		sleep:       sleepContext,
 	}
 }
 
-func (s *Sender) SendMessage(source string, destinations []string, data []byte) (*string, error) {
+// Send a raw message. Transient errors are retried according to the retry
+// policy within the deadline of the context. Errors are of type *SendError.
+func (s *Sender) SendMessage(ctx context.Context, source string, destinations []string, data []byte) (*string, error) {
 	input := sesv2.SendEmailInput{
 		FromEmailAddress: aws.String(source),
 		Destination: &types.Destination{
@@ -35,17 +47,15 @@ func (s *Sender) SendMessage(source string, destinations []string, data []byte)
 		},
 	}
 
-	output, err := s.sesClient.SendEmail(context.TODO(), &input)
+	var output *sesv2.SendEmailOutput
+	err := s.retry(ctx, func() error {
+		var err error
+		output, err = s.sesClient.SendEmail(ctx, &input)
+		return err
+	})
 	if err != nil {
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) {
-			log.Printf("code: %s, message: %s, fault: %s\n", apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String())
-			return nil, fmt.Errorf(
-				"failed to send message (code: %s, message: %s, fault: %s)",
-				apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
-			)
-		}
-		return nil, fmt.Errorf("failed to send message: %w", err)
+		log.Print(err)
+		return nil, err
 	}
 
 	return output.MessageId, nil
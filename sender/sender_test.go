@@ -0,0 +1,191 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/smithy-go"
+	"github.com/codezombiech/aws-mail-forwarder-test/internal/awsfake"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeSES struct {
+	errs  []error // Errors returned by the subsequent calls, succeeds afterwards
+	calls int
+}
+
+func (f *fakeSES) SendEmail(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return nil, f.errs[f.calls-1]
+	}
+	return &sesv2.SendEmailOutput{MessageId: aws.String("message-id")}, nil
+}
+
+func newTestSender(ses *fakeSES) (*Sender, *[]time.Duration) {
+	delays := []time.Duration{}
+	return &Sender{
+		sesClient:   ses,
+		retryPolicy: DefaultRetryPolicy,
+		sleep: func(ctx context.Context, delay time.Duration) error {
+			delays = append(delays, delay)
+			return nil
+		},
+	}, &delays
+}
+
+var (
+	throttlingErr = &smithy.GenericAPIError{Code: "TooManyRequestsException", Message: "Too many requests", Fault: smithy.FaultClient}
+	rejectedErr   = &smithy.GenericAPIError{Code: "MessageRejected", Message: "Email address is not verified", Fault: smithy.FaultClient}
+)
+
+func TestSendMessageRetriesTransientErrors(t *testing.T) {
+	ses := &fakeSES{errs: []error{throttlingErr, throttlingErr}}
+	sender, delays := newTestSender(ses)
+
+	messageId, err := sender.SendMessage(context.Background(), "from@example.com", []string{"to@example.com"}, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "message-id", *messageId; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := 3, ses.calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+	if want, got := 2, len(*delays); want != got {
+		t.Errorf("delays: want %v, got %v", want, got)
+	}
+}
+
+func TestSendMessageDoesNotRetryPermanentErrors(t *testing.T) {
+	ses := &fakeSES{errs: []error{rejectedErr}}
+	sender, _ := newTestSender(ses)
+
+	_, err := sender.SendMessage(context.Background(), "from@example.com", []string{"to@example.com"}, []byte{})
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		t.Fatalf("expected send error, got %v", err)
+	}
+	if sendErr.Code != "MessageRejected" || sendErr.Fault != "client" || sendErr.Retryable || sendErr.Attempts != 1 {
+		t.Errorf("unexpected send error %+v", sendErr)
+	}
+	if IsRetryable(err) {
+		t.Errorf("expected permanent error")
+	}
+	if want, got := 1, ses.calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+}
+
+func TestSendMessageGivesUpAfterMaxAttempts(t *testing.T) {
+	ses := &fakeSES{errs: []error{throttlingErr, throttlingErr, throttlingErr, throttlingErr, throttlingErr, throttlingErr}}
+	sender, _ := newTestSender(ses)
+
+	_, err := sender.SendMessage(context.Background(), "from@example.com", []string{"to@example.com"}, []byte{})
+	if !IsRetryable(err) {
+		t.Errorf("expected retryable error, got %v", err)
+	}
+	if want, got := DefaultRetryPolicy.MaxAttempts, ses.calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+}
+
+func TestSendMessageRespectsDeadline(t *testing.T) {
+	ses := &fakeSES{errs: []error{throttlingErr, throttlingErr}}
+	sender, _ := newTestSender(ses)
+
+	// Less time left than the reserve of the retry policy
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := sender.SendMessage(ctx, "from@example.com", []string{"to@example.com"}, []byte{})
+	if err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+	if want, got := 1, ses.calls; want != got {
+		t.Errorf("calls: want %v, got %v", want, got)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		retryable bool
+	}{
+		"throttling":        {err: throttlingErr, retryable: true},
+		"rejected":          {err: rejectedErr, retryable: false},
+		"not verified":      {err: &smithy.GenericAPIError{Code: "MailFromDomainNotVerifiedException", Fault: smithy.FaultClient}, retryable: false},
+		"account suspended": {err: &smithy.GenericAPIError{Code: "AccountSuspendedException", Fault: smithy.FaultClient}, retryable: false},
+		"unknown server":    {err: &smithy.GenericAPIError{Code: "Unknown", Fault: smithy.FaultServer}, retryable: true},
+		"unknown client":    {err: &smithy.GenericAPIError{Code: "Unknown", Fault: smithy.FaultClient}, retryable: false},
+		"connection":        {err: errors.New("connection reset"), retryable: true},
+		"deadline exceeded": {err: context.DeadlineExceeded, retryable: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if want, got := tc.retryable, classifyError(tc.err).Retryable; want != got {
+				t.Errorf("retryable: want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	max := func(n int64) int64 { return n - 1 }
+
+	for retry, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		if got := policy.delay(retry, max); want != got {
+			t.Errorf("retry %d: want %v, got %v", retry, want, got)
+		}
+	}
+}
+
+func TestSendMessageSDK(t *testing.T) {
+	ses := awsfake.NewSES(t)
+	s := NewSender(awsfake.Config(nil, ses))
+	s.sleep = func(ctx context.Context, delay time.Duration) error { return nil }
+
+	ses.FailNext(awsfake.SESError{Code: "TooManyRequestsException", Message: "Maximum sending rate exceeded.", Status: 429})
+	messageId, err := s.SendMessage(context.Background(), "from@example.net", []string{"to@example.net"}, []byte("Subject: Test\r\n\r\nBody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []awsfake.SentEmail{{
+		MessageId: aws.ToString(messageId),
+		From:      "from@example.net",
+		To:        []string{"to@example.net"},
+		Data:      []byte("Subject: Test\r\n\r\nBody"),
+	}}
+	if diff := cmp.Diff(want, ses.Sent()); diff != "" {
+		t.Errorf("sent (-want +got):\n%s", diff)
+	}
+
+	ses.FailNext(awsfake.SESError{Code: "MessageRejected", Message: "Email address is not verified."})
+	_, err = s.SendMessage(context.Background(), "from@example.net", []string{"to@example.net"}, []byte("Subject: Test"))
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		t.Fatalf("want *SendError, got %v", err)
+	}
+	wantErr := SendError{Code: "MessageRejected", Message: "Email address is not verified.", Fault: "client", Attempts: 1}
+	gotErr := SendError{Code: sendErr.Code, Message: sendErr.Message, Fault: sendErr.Fault, Retryable: sendErr.Retryable, Attempts: sendErr.Attempts}
+	if diff := cmp.Diff(wantErr, gotErr); diff != "" {
+		t.Errorf("error (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Returned if an encrypted object is read without a key provider
+var ErrEncrypted = errors.New("object is encrypted")
+
+// Metadata of encrypted objects
+const (
+	encryptionAlgorithm = "AES-256-GCM"
+
+	metadataAlgorithm  = "forwarder-encryption"  // Content encryption algorithm
+	metadataKeyId      = "forwarder-key-id"      // ID of the key the data key is wrapped with
+	metadataWrappedKey = "forwarder-wrapped-key" // Base64 encoded wrapped data key
+)
+
+// Size of data keys in bytes (AES-256)
+const dataKeySize = 32
+
+// Provider of the key encryption key, used to wrap and unwrap the data keys
+// of encrypted objects
+type KeyProvider interface {
+	// Wrap a data key, returns the wrapped key and the ID of the wrapping key
+	WrapKey(dataKey []byte) ([]byte, string, error)
+	// Unwrap a data key wrapped by the key with the given ID
+	UnwrapKey(wrappedKey []byte, keyId string) ([]byte, error)
+}
+
+// Key provider wrapping data keys with AES-GCM using a local 256 bit key
+type FileKeyProvider struct {
+	keyId string
+	aead  cipher.AEAD
+}
+
+// Create a key provider from a file containing a base64 encoded 256 bit key,
+// e.g. generated with "openssl rand -base64 32"
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key file: %w", err)
+	}
+
+	return NewStaticKeyProvider(key)
+}
+
+// Create a key provider from the given 256 bit key
+func NewStaticKeyProvider(key []byte) (*FileKeyProvider, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("invalid key size %d (expected %d bytes)", len(key), dataKeySize)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identify the key by its fingerprint, so a wrong key is detected before
+	// trying to decrypt
+	fingerprint := sha256.Sum256(key)
+	return &FileKeyProvider{
+		keyId: "file:" + hex.EncodeToString(fingerprint[:8]),
+		aead:  aead,
+	}, nil
+}
+
+func (p *FileKeyProvider) WrapKey(dataKey []byte) ([]byte, string, error) {
+	wrappedKey, err := seal(p.aead, dataKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrappedKey, p.keyId, nil
+}
+
+func (p *FileKeyProvider) UnwrapKey(wrappedKey []byte, keyId string) ([]byte, error) {
+	if keyId != p.keyId {
+		return nil, fmt.Errorf("unknown key %s (provider has %s)", keyId, p.keyId)
+	}
+	return open(p.aead, wrappedKey, nil)
+}
+
+// Encrypt the data of the object with the given key with a new data key,
+// returns the ciphertext and the metadata to store along with it
+func encrypt(keys KeyProvider, key string, data []byte) ([]byte, map[string]string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrappedKey, keyId, err := keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	metadata := map[string]string{
+		metadataAlgorithm:  encryptionAlgorithm,
+		metadataKeyId:      keyId,
+		metadataWrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := seal(aead, data, additionalData(key, metadata))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ciphertext, metadata, nil
+}
+
+// Decrypt the data of the object with the given key and metadata
+func decrypt(keys KeyProvider, key string, ciphertext []byte, metadata map[string]string) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrEncrypted
+	}
+	if algorithm := metadata[metadataAlgorithm]; algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", algorithm)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(metadata[metadataWrappedKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wrapped data key: %w", err)
+	}
+	dataKey, err := keys.UnwrapKey(wrappedKey, metadata[metadataKeyId])
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, ciphertext, additionalData(key, metadata))
+}
+
+// Returns the additional authenticated data of the ciphertext of an object,
+// binding it to the object key and the encryption metadata. A ciphertext
+// copied to another key or stored with the metadata of another object fails
+// to decrypt. Each value is prefixed with its length to keep them apart.
+func additionalData(key string, metadata map[string]string) []byte {
+	values := []string{key, metadata[metadataAlgorithm], metadata[metadataKeyId], metadata[metadataWrappedKey]}
+
+	data := make([]byte, 0)
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+		data = append(data, value...)
+	}
+	return data
+}
+
+// Whether an object with the given metadata is encrypted
+func isEncrypted(metadata map[string]string) bool {
+	_, ok := metadata[metadataAlgorithm]
+	return ok
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt the plaintext, the random nonce is prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("failed to decrypt: ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyProvider(t *testing.T, fill byte) *FileKeyProvider {
+	keys, err := NewStaticKeyProvider(bytes.Repeat([]byte{fill}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	keys := testKeyProvider(t, 1)
+	plaintext := []byte("From: sender@example.org\r\n\r\nPrivate correspondence\r\n")
+
+	ciphertext, metadata, err := encrypt(keys, "in/forwarded/1", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, []byte("Private")) {
+		t.Errorf("expected ciphertext not to contain plaintext")
+	}
+	if !isEncrypted(metadata) {
+		t.Errorf("expected metadata to mark object as encrypted")
+	}
+
+	decrypted, err := decrypt(keys, "in/forwarded/1", ciphertext, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := string(plaintext), string(decrypted); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestDecryptError(t *testing.T) {
+	keys := testKeyProvider(t, 1)
+	ciphertext, metadata, err := encrypt(keys, "in/forwarded/1", []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("no key provider", func(t *testing.T) {
+		if _, err := decrypt(nil, "in/forwarded/1", ciphertext, metadata); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("want %v, got %v", ErrEncrypted, err)
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		if _, err := decrypt(testKeyProvider(t, 2), "in/forwarded/1", ciphertext, metadata); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := decrypt(keys, "in/forwarded/1", tampered, metadata); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		if _, err := decrypt(keys, "in/forwarded/2", ciphertext, metadata); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+	})
+
+	t.Run("other metadata", func(t *testing.T) {
+		_, otherMetadata, err := encrypt(keys, "in/forwarded/1", []byte("message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decrypt(keys, "in/forwarded/1", ciphertext, otherMetadata); err == nil {
+			t.Fatalf("Expected error, got nil")
+		}
+	})
+}
+
+func TestNewFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "key")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := testKeyProvider(t, 1).keyId, keys.keyId; want != got {
+		t.Errorf("key ID: want %v, got %v", want, got)
+	}
+
+	shortPath := filepath.Join(dir, "short")
+	if err := os.WriteFile(shortPath, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileKeyProvider(shortPath); err == nil {
+		t.Fatalf("Expected error, got nil")
+	}
+}
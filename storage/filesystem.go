@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directory below the root of a FileStorage holding the tags of the objects
+const fileTagsDir = ".tags"
+
+// Storage of objects as files below a root directory, e.g. for running the
+// forwarder locally. Keys map to paths relative to the root, the tags of an
+// object are kept in a JSON file below the .tags directory.
+type FileStorage struct {
+	root string
+}
+
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{root: root}
+}
+
+// Returns the path of the object, keys cannot escape the root
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *FileStorage) tagsPath(key string) string {
+	return filepath.Join(s.root, fileTagsDir, filepath.FromSlash(path.Clean("/"+key))+".json")
+}
+
+func (s *FileStorage) Get(key string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, fmt.Errorf("failed to get object %s: %w", key, ErrNotFound)
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	return file, info.Size(), nil
+}
+
+// Write the object atomically. Returns the MD5 of the data as ETag, like S3
+// does for single part uploads.
+func (s *FileStorage) Put(key string, reader io.Reader) (*string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object data: %w", err)
+	}
+
+	if err := writeFileAtomic(s.path(key), data); err != nil {
+		return nil, fmt.Errorf("failed to put object: %w", err)
+	}
+
+	sum := md5.Sum(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	return &etag, nil
+}
+
+// Move the object and its tags
+func (s *FileStorage) Move(sourceKey string, targetKey string) error {
+	if err := rename(s.path(sourceKey), s.path(targetKey)); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to move object %s: %w", sourceKey, ErrNotFound)
+	} else if err != nil {
+		return fmt.Errorf("failed to move object: %w", err)
+	}
+
+	if err := rename(s.tagsPath(sourceKey), s.tagsPath(targetKey)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to move tags of object %s: %w", sourceKey, err)
+	}
+
+	return nil
+}
+
+// Delete the object and its tags. Deleting a missing object succeeds, like on S3.
+func (s *FileStorage) Delete(key string) error {
+	for _, p := range []string{s.path(key), s.tagsPath(key)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+	}
+	return nil
+}
+
+// List the objects with the given prefix, sorted by key
+func (s *FileStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	err := filepath.WalkDir(s.root, func(p string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == s.root {
+			return fs.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if p == filepath.Join(s.root, fileTagsDir) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		relative, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, tmpSuffix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Returns the state of the object (empty if it has none)
+func (s *FileStorage) State(key string) (string, error) {
+	tags, err := s.getTags(key)
+	if err != nil {
+		return "", err
+	}
+	return tags[StateTagKey], nil
+}
+
+// Set the state of the object and add it to the state history
+func (s *FileStorage) SetState(key string, state string, at time.Time) error {
+	tags, err := s.getTags(key)
+	if err != nil {
+		return err
+	}
+
+	tags[StateTagKey] = state
+	tags[StateHistoryTagKey] = appendStateHistory(tags[StateHistoryTagKey], state, at)
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("failed to serialize tags: %w", err)
+	}
+	if err := writeFileAtomic(s.tagsPath(key), data); err != nil {
+		return fmt.Errorf("failed to put object tagging: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStorage) getTags(key string) (map[string]string, error) {
+	if _, err := os.Stat(s.path(key)); errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to get object tagging %s: %w", key, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get object tagging: %w", err)
+	}
+
+	tags := map[string]string{}
+	data, err := os.ReadFile(s.tagsPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return tags, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get object tagging: %w", err)
+	}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("failed to parse tags of object %s: %w", key, err)
+	}
+	return tags, nil
+}
+
+// Suffix of files being written
+const tmpSuffix = ".tmp"
+
+// Write the file to a temporary file first, so readers never see partial data
+func writeFileAtomic(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+tmpSuffix, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(p+tmpSuffix, p)
+}
+
+func rename(source string, target string) error {
+	if _, err := os.Stat(source); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(source, target)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFileStorage(t *testing.T) {
+	s := NewFileStorage(t.TempDir())
+
+	if _, _, err := s.Get("in/new/1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+
+	for _, key := range []string{"in/new/1", "in/new/2", "out/sent/1"} {
+		if _, err := s.Put(key, bytes.NewReader([]byte("message "+key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.SetState("in/new/1", "failed", time.Unix(1669144560, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Move("in/new/1", "in/forwarded/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Move("in/new/1", "in/forwarded/1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+	if err := s.Delete("in/new/2"); err != nil {
+		t.Fatal(err)
+	}
+
+	body, size, err := s.Get("in/forwarded/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "message in/new/1", readAll(t, body); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := int64(16), size; want != got {
+		t.Errorf("size: want %v, got %v", want, got)
+	}
+
+	// The tags are moved with the object
+	if state, err := s.State("in/forwarded/1"); err != nil || state != "failed" {
+		t.Errorf("want state failed, got %q (%v)", state, err)
+	}
+
+	objects, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, object := range objects {
+		got = append(got, object.Key)
+	}
+	if diff := cmp.Diff([]string{"in/forwarded/1", "out/sent/1"}, got); diff != "" {
+		t.Errorf("keys (-want +got):\n%s", diff)
+	}
+}
+
+func TestFileStoragePath(t *testing.T) {
+	s := NewFileStorage("/var/mail")
+
+	if want, got := "/var/mail/etc/passwd", s.path("../../etc/passwd"); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Object tags recording the processing state of a message, see
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-tagging.html
+const (
+	StateTagKey        = "forwarder-state"         // The current state, e.g. "forwarded"
+	StateHistoryTagKey = "forwarder-state-history" // The states with their Unix times, e.g. "failed:1669144560 forwarded:1669144600"
+)
+
+// Maximum length of a tag value
+const maxTagValueLength = 256
+
+// Returns the state of the object (empty if it has none)
+func (s *Storage) State(key string) (string, error) {
+	tags, err := s.getTags(key)
+	if err != nil {
+		return "", err
+	}
+	return tags[StateTagKey], nil
+}
+
+// Set the state of the object and add it to the state history. Other tags of
+// the object are kept. Unlike Move, the object itself is not changed.
+//
+// The tags are read and written in separate requests, S3 has no conditional
+// tagging. Concurrent calls for the same object (e.g. duplicate events) may
+// therefore lose a state of the history, the last call wins.
+func (s *Storage) SetState(key string, state string, at time.Time) error {
+	tags, err := s.getTags(key)
+	if err != nil {
+		return err
+	}
+
+	tags[StateTagKey] = state
+	tags[StateHistoryTagKey] = appendStateHistory(tags[StateHistoryTagKey], state, at)
+
+	return s.putTags(key, tags)
+}
+
+// List the objects with the given prefix and state. Objects cannot be listed
+// by tag, so this makes a GetObjectTagging request per object of the prefix,
+// which is slow and costly for large prefixes.
+func (s *Storage) ListByState(prefix string, state string) ([]ObjectInfo, error) {
+	objects, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]ObjectInfo, 0)
+	for _, object := range objects {
+		objectState, err := s.State(object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if objectState == state {
+			filtered = append(filtered, object)
+		}
+	}
+
+	return filtered, nil
+}
+
+// Append a state to the history, dropping the oldest states if the history
+// would exceed the maximum length of a tag value
+func appendStateHistory(history string, state string, at time.Time) string {
+	entries := strings.Fields(history)
+	entries = append(entries, state+":"+strconv.FormatInt(at.Unix(), 10))
+
+	for len(entries) > 1 && len(strings.Join(entries, " ")) > maxTagValueLength {
+		entries = entries[1:]
+	}
+
+	return strings.Join(entries, " ")
+}
+
+func (s *Storage) getTags(key string) (map[string]string, error) {
+	input := s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	}
+
+	result, err := s.s3Client.GetObjectTagging(context.TODO(), &input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, fmt.Errorf("failed to get tags of object %s: %w", key, ErrNotFound)
+			}
+			return nil, fmt.Errorf(
+				"failed to get object tags (code: %s, message: %s, fault: %s)",
+				apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
+			)
+		}
+		return nil, fmt.Errorf("failed to get object tags: %w", err)
+	}
+
+	tags := make(map[string]string, len(result.TagSet))
+	for _, tag := range result.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+func (s *Storage) putTags(key string, tags map[string]string) error {
+	tagSet := make([]types.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	input := s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s.bucketName),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: tagSet},
+	}
+
+	_, err := s.s3Client.PutObjectTagging(context.TODO(), &input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return fmt.Errorf("failed to tag object %s: %w", key, ErrNotFound)
+			}
+			return fmt.Errorf(
+				"failed to tag object (code: %s, message: %s, fault: %s)",
+				apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
+			)
+		}
+		return fmt.Errorf("failed to tag object: %w", err)
+	}
+
+	return nil
+}
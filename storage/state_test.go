@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendStateHistory(t *testing.T) {
+	at := time.Unix(1669144560, 0)
+
+	history := appendStateHistory("", "failed", at)
+	history = appendStateHistory(history, "forwarded", at.Add(time.Minute))
+	if want, got := "failed:1669144560 forwarded:1669144620", history; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// The oldest states are dropped to fit into a tag value
+	for i := 0; i < 20; i++ {
+		history = appendStateHistory(history, "forwarded", at)
+	}
+	if len(history) > maxTagValueLength {
+		t.Errorf("history exceeds %d characters: %d", maxTagValueLength, len(history))
+	}
+	if !strings.HasPrefix(history, "forwarded:") {
+		t.Errorf("expected oldest state to be dropped, got %v", history)
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	if want, got := "bucket/in/new/a%2Bb%20c", copySource("bucket", "in/new/a+b c"); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -1,19 +1,38 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
+// Returned by GetIfNoneMatch if the object still matches the given ETag
+var ErrNotModified = errors.New("object not modified")
+
+// Wrapped by the returned error if the object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// An object listed by List
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
 type Storage struct {
 	s3Client   *s3.Client
 	bucketName string
+	keys       KeyProvider // Encrypts stored objects if set
 }
 
 func NewStorage(awsConfig aws.Config, bucketName string) *Storage {
@@ -23,6 +42,14 @@ func NewStorage(awsConfig aws.Config, bucketName string) *Storage {
 	}
 }
 
+// Create a storage encrypting stored objects with data keys wrapped by the
+// given key provider. Encrypted objects are decrypted transparently by Get.
+func NewEncryptedStorage(awsConfig aws.Config, bucketName string, keys KeyProvider) *Storage {
+	storage := NewStorage(awsConfig, bucketName)
+	storage.keys = keys
+	return storage
+}
+
 func (s *Storage) Get(key string) (io.ReadCloser, int64, error) {
 	input := s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
@@ -33,6 +60,9 @@ func (s *Storage) Get(key string) (io.ReadCloser, int64, error) {
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, 0, fmt.Errorf("failed to get object %s: %w", key, ErrNotFound)
+			}
 			return nil, 0, fmt.Errorf(
 				"failed to get object (code: %s, message: %s, fault: %s)",
 				apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
@@ -41,9 +71,71 @@ func (s *Storage) Get(key string) (io.ReadCloser, int64, error) {
 		return nil, 0, fmt.Errorf("failed to get object: %w", err)
 	}
 
+	if isEncrypted(result.Metadata) {
+		plaintext, err := s.decryptBody(key, result.Body, result.Metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(plaintext)), int64(len(plaintext)), nil
+	}
+
 	return result.Body, result.ContentLength, nil
 }
 
+// Get the object only if its ETag differs from the given one.
+// Returns the body, the current ETag of the object or ErrNotModified.
+func (s *Storage) GetIfNoneMatch(key string, etag string) (io.ReadCloser, string, error) {
+	input := s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+
+	result, err := s.s3Client.GetObject(context.TODO(), &input)
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == 304 {
+			return nil, etag, ErrNotModified
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			return nil, "", fmt.Errorf(
+				"failed to get object (code: %s, message: %s, fault: %s)",
+				apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
+			)
+		}
+		return nil, "", fmt.Errorf("failed to get object: %w", err)
+	}
+
+	if isEncrypted(result.Metadata) {
+		plaintext, err := s.decryptBody(key, result.Body, result.Metadata)
+		if err != nil {
+			return nil, "", err
+		}
+		return io.NopCloser(bytes.NewReader(plaintext)), aws.ToString(result.ETag), nil
+	}
+
+	return result.Body, aws.ToString(result.ETag), nil
+}
+
+func (s *Storage) decryptBody(key string, body io.ReadCloser, metadata map[string]string) ([]byte, error) {
+	defer body.Close()
+
+	ciphertext, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+
+	plaintext, err := decrypt(s.keys, key, ciphertext, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object %s: %w", key, err)
+	}
+
+	return plaintext, nil
+}
+
 func (s *Storage) Put(key string, reader io.Reader) (*string, error) {
 	input := s3.PutObjectInput{
 		Body:   reader,
@@ -51,6 +143,19 @@ func (s *Storage) Put(key string, reader io.Reader) (*string, error) {
 		Key:    aws.String(key),
 	}
 
+	if s.keys != nil {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object: %w", err)
+		}
+		ciphertext, metadata, err := encrypt(s.keys, key, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt object %s: %w", key, err)
+		}
+		input.Body = bytes.NewReader(ciphertext)
+		input.Metadata = metadata
+	}
+
 	result, err := s.s3Client.PutObject(context.TODO(), &input)
 	if err != nil {
 		var apiErr smithy.APIError
@@ -65,22 +170,54 @@ func (s *Storage) Put(key string, reader io.Reader) (*string, error) {
 	return result.ETag, nil
 }
 
+// Move an object. If encryption is enabled, objects are encrypted for the
+// target key, as the ciphertext is bound to the key of its object. This also
+// encrypts unencrypted objects (e.g. stored by SES).
 func (s *Storage) Move(sourceKey string, targetKey string) error {
-	if _, err := s.copy(sourceKey, targetKey); err != nil {
+	if s.keys != nil {
+		if err := s.encryptTo(sourceKey, targetKey); err != nil {
+			return err
+		}
+	} else if _, err := s.copy(sourceKey, targetKey); err != nil {
+		return err
+	}
+
+	if err := s.Delete(sourceKey); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Store an encrypted copy of an object, decrypting it first if it is encrypted
+func (s *Storage) encryptTo(sourceKey string, targetKey string) error {
+	body, _, err := s.Get(sourceKey)
+	if err != nil {
 		return err
 	}
+	defer body.Close()
 
-	if err := s.delete(sourceKey); err != nil {
+	if _, err := s.Put(targetKey, body); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// Returns the URL encoded source of a copy, e.g. "bucket/in/new/a%2Bb" for "in/new/a+b".
+// "+" must be encoded as well, as S3 would decode it as space.
+func copySource(bucketName string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
+	}
+	return bucketName + "/" + strings.Join(segments, "/")
+}
+
 func (s *Storage) copy(sourceKey string, targetKey string) (*string, error) {
 	input := s3.CopyObjectInput{
 		Bucket:     aws.String(s.bucketName),
-		CopySource: aws.String(s.bucketName + "/" + sourceKey),
+		CopySource: aws.String(copySource(s.bucketName, sourceKey)),
 		Key:        aws.String(targetKey),
 	}
 
@@ -88,6 +225,9 @@ func (s *Storage) copy(sourceKey string, targetKey string) (*string, error) {
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, fmt.Errorf("failed to copy object %s: %w", sourceKey, ErrNotFound)
+			}
 			return nil, fmt.Errorf(
 				"failed to copy object (code: %s, message: %s, fault: %s)",
 				apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
@@ -99,7 +239,7 @@ func (s *Storage) copy(sourceKey string, targetKey string) (*string, error) {
 	return result.CopyObjectResult.ETag, nil
 }
 
-func (s *Storage) delete(key string) error {
+func (s *Storage) Delete(key string) error {
 	input := s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
@@ -119,3 +259,37 @@ func (s *Storage) delete(key string) error {
 
 	return nil
 }
+
+// List the objects with the given prefix
+func (s *Storage) List(prefix string) ([]ObjectInfo, error) {
+	input := s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	}
+
+	objects := make([]ObjectInfo, 0)
+	paginator := s3.NewListObjectsV2Paginator(s.s3Client, &input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) {
+				return nil, fmt.Errorf(
+					"failed to list objects (code: %s, message: %s, fault: %s)",
+					apiErr.ErrorCode(), apiErr.ErrorMessage(), apiErr.ErrorFault().String(),
+				)
+			}
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         object.Size,
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/internal/awsfake"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testBucket = "mail"
+
+func newTestStorage(t *testing.T) (*Storage, *awsfake.S3) {
+	fake := awsfake.NewS3(t, testBucket)
+	return NewStorage(awsfake.Config(fake, nil), testBucket), fake
+}
+
+func readAll(t *testing.T, body io.ReadCloser) string {
+	t.Helper()
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPutGet(t *testing.T) {
+	s, _ := newTestStorage(t)
+
+	for name, key := range map[string]string{
+		"plain":              "in/new/0123456789",
+		"special characters": "in/new/a+b c&d=é",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Put(key, bytes.NewReader([]byte("Subject: Test"))); err != nil {
+				t.Fatal(err)
+			}
+
+			body, size, err := s.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := "Subject: Test", readAll(t, body); want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+			if want, got := int64(13), size; want != got {
+				t.Errorf("size: want %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	s, _ := newTestStorage(t)
+
+	if _, _, err := s.Get("in/new/missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestGetIfNoneMatch(t *testing.T) {
+	s, fake := newTestStorage(t)
+	fake.PutObject(testBucket, "config.json", []byte("{}"))
+
+	body, etag, err := s.GetIfNoneMatch("config.json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+
+	if _, _, err := s.GetIfNoneMatch("config.json", etag); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("want ErrNotModified, got %v", err)
+	}
+
+	fake.PutObject(testBucket, "config.json", []byte(`{"fromEmail": "from@example.net"}`))
+	body, newEtag, err := s.GetIfNoneMatch("config.json", etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if newEtag == etag {
+		t.Errorf("expected a new ETag, got %v", newEtag)
+	}
+}
+
+func TestMove(t *testing.T) {
+	s, fake := newTestStorage(t)
+	fake.PutObject(testBucket, "in/new/a+b c", []byte("message"))
+
+	if err := s.Move("in/new/a+b c", "in/forwarded/a+b c"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"in/forwarded/a+b c"}, fake.Keys(testBucket)); diff != "" {
+		t.Errorf("keys (-want +got):\n%s", diff)
+	}
+
+	// Already moved, e.g. by a previous invocation
+	if err := s.Move("in/new/a+b c", "in/forwarded/a+b c"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s, fake := newTestStorage(t)
+	fake.PutObject(testBucket, "in/new/0123456789", []byte("message"))
+
+	if err := s.Delete("in/new/0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Keys(testBucket); len(got) != 0 {
+		t.Errorf("expected no keys, got %v", got)
+	}
+}
+
+func TestList(t *testing.T) {
+	s, fake := newTestStorage(t)
+	fake.PageSize = 2
+
+	want := []string{"out/sent/1", "out/sent/2", "out/sent/3", "out/sent/4", "out/sent/5"}
+	for _, key := range want {
+		fake.PutObject(testBucket, key, []byte("message"))
+	}
+	fake.PutObject(testBucket, "in/new/6", []byte("message"))
+
+	objects, err := s.List("out/sent/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0)
+	for _, object := range objects {
+		got = append(got, object.Key)
+		if object.Size != 7 || object.LastModified.IsZero() {
+			t.Errorf("%s: unexpected size %d or last modified %v", object.Key, object.Size, object.LastModified)
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("keys (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	fake := awsfake.NewS3(t, testBucket)
+	s := NewEncryptedStorage(awsfake.Config(fake, nil), testBucket, testKeyProvider(t, 1))
+
+	if _, err := s.Put("out/sent/1", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	if stored := fake.Object(testBucket, "out/sent/1"); bytes.Contains(stored.Data, []byte("secret")) {
+		t.Errorf("expected ciphertext, got %q", stored.Data)
+	}
+
+	// Messages stored by SES are encrypted when moved
+	fake.PutObject(testBucket, "in/new/1", []byte("incoming"))
+	if err := s.Move("in/new/1", "in/forwarded/1"); err != nil {
+		t.Fatal(err)
+	}
+	if stored := fake.Object(testBucket, "in/forwarded/1"); bytes.Contains(stored.Data, []byte("incoming")) {
+		t.Errorf("expected ciphertext, got %q", stored.Data)
+	}
+
+	// Encrypted messages are encrypted again for their new key
+	if err := s.Move("in/forwarded/1", "in/failed/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{"out/sent/1": "secret", "in/failed/1": "incoming"} {
+		body, _, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, body); want != got {
+			t.Errorf("%s: want %v, got %v", key, want, got)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	s, fake := newTestStorage(t)
+	fake.PutObject(testBucket, "in/new/1", []byte("message"))
+	fake.PutObject(testBucket, "in/new/2", []byte("message"))
+
+	if state, err := s.State("in/new/1"); err != nil || state != "" {
+		t.Fatalf("want no state, got %q (%v)", state, err)
+	}
+
+	at := time.Unix(1669144560, 0)
+	if err := s.SetState("in/new/1", "failed", at); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetState("in/new/1", "forwarded", at.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		StateTagKey:        "forwarded",
+		StateHistoryTagKey: "failed:1669144560 forwarded:1669144620",
+	}
+	if diff := cmp.Diff(want, fake.Object(testBucket, "in/new/1").Tags); diff != "" {
+		t.Errorf("tags (-want +got):\n%s", diff)
+	}
+
+	objects, err := s.ListByState("in/new/", "forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "in/new/1" {
+		t.Errorf("want in/new/1, got %v", objects)
+	}
+
+	if _, err := s.State("in/new/missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"mime"
+	"net/mail"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+)
+
+// The JSON payload describing a message
+type Payload struct {
+	MessageId   string               `json:"messageId"`      // The SES message ID
+	Recipient   string               `json:"recipient"`      // The original recipient mapped to the webhook
+	ReceivedAt  time.Time            `json:"receivedAt"`     // When SES received the message
+	From        string               `json:"from"`           // Decoded From header
+	To          string               `json:"to"`             // Decoded To header
+	Subject     string               `json:"subject"`        // Decoded Subject header
+	Headers     map[string][]string  `json:"headers"`        // All headers as received (not decoded)
+	Text        string               `json:"text,omitempty"` // The text/plain body
+	HTML        string               `json:"html,omitempty"` // The text/html body
+	Attachments []message.Attachment `json:"attachments"`    // Metadata of all other parts
+	RawMessage  string               `json:"rawMessage"`     // Location of the raw message, e.g. "s3://bucket/in/forwarded/<messageId>"
+}
+
+// Build the payload of the original (not rewritten) message
+func NewPayload(messageId string, recipient string, receivedAt time.Time, rawMessage string, msg *message.BufferedMessage) (*Payload, error) {
+	parts, err := message.ParseParts(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Payload{
+		MessageId:   messageId,
+		Recipient:   recipient,
+		ReceivedAt:  receivedAt,
+		From:        decodeHeader(msg.Header, "From"),
+		To:          decodeHeader(msg.Header, "To"),
+		Subject:     decodeHeader(msg.Header, "Subject"),
+		Headers:     msg.Header,
+		Text:        parts.Text,
+		HTML:        parts.HTML,
+		Attachments: parts.Attachments,
+		RawMessage:  rawMessage,
+	}, nil
+}
+
+// Returns the header with RFC 2047 encoded words decoded (as is if invalid)
+func decodeHeader(header mail.Header, key string) string {
+	value := header.Get(key)
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
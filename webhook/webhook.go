@@ -0,0 +1,97 @@
+// Package webhook delivers messages to webhook targets as signed JSON
+// payloads.
+//
+// Each request carries the headers X-Forwarder-Timestamp (Unix time) and
+// X-Forwarder-Signature ("sha256=" followed by the hex-encoded HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the shared secret). Receivers should check
+// the signature with Verify and reject old timestamps to prevent replays.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+)
+
+// Request headers of a delivery
+const (
+	TimestampHeader = "X-Forwarder-Timestamp"
+	SignatureHeader = "X-Forwarder-Signature"
+)
+
+// Client delivering payloads to webhooks
+type Client struct {
+	secret     []byte
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// Create a client signing payloads with the secret. The HTTP client should
+// have a timeout, as webhooks are called while handling the event.
+func NewClient(secret []byte, httpClient *http.Client) *Client {
+	return &Client{
+		secret:     secret,
+		httpClient: httpClient,
+		now:        time.Now,
+	}
+}
+
+// POST the payload to the URL. Network errors, 429 and 5xx responses are
+// transient, other non-2xx responses are permanent (see package failure).
+func (c *Client) Deliver(ctx context.Context, url string, payload *Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return failure.AsPermanent(fmt.Errorf("failed to serialize webhook payload: %w", err))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return failure.AsPermanent(fmt.Errorf("failed to create webhook request: %w", err))
+	}
+
+	timestamp := c.now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "aws-mail-forwarder")
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(c.secret, timestamp, body))
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return failure.AsTransient(fmt.Errorf("failed to call webhook: %w", err))
+	}
+	defer response.Body.Close()
+	// Allow the connection to be reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return failure.AsTransient(fmt.Errorf("webhook responded with status %d", response.StatusCode))
+	default:
+		return failure.AsPermanent(fmt.Errorf("webhook responded with status %d", response.StatusCode))
+	}
+}
+
+// Returns the signature of the body sent at the given Unix time
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether the signature of the body is valid, for receivers of payloads
+func Verify(secret []byte, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
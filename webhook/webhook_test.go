@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codezombiech/aws-mail-forwarder-test/failure"
+	"github.com/codezombiech/aws-mail-forwarder-test/message"
+)
+
+func TestDeliver(t *testing.T) {
+	secret := []byte("secret")
+
+	var received Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		if !Verify(secret, timestamp, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	msg := &message.BufferedMessage{
+		Header: map[string][]string{
+			"From":    {"Jane <jane@example.org>"},
+			"Subject": {"=?UTF-8?Q?Gr=C3=BCezi?="},
+		},
+		Body: []byte("Hello"),
+	}
+	payload, err := NewPayload("0123456789", "alerts@example.com", time.Unix(1669144560, 0), "s3://bucket/in/forwarded/0123456789", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewClient(secret, server.Client()).Deliver(context.Background(), server.URL, payload); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Grüezi", received.Subject; want != got {
+		t.Errorf("subject: want %v, got %v", want, got)
+	}
+	if want, got := "Hello", received.Text; want != got {
+		t.Errorf("text: want %v, got %v", want, got)
+	}
+
+	// Signed with another secret
+	err = NewClient([]byte("other"), server.Client()).Deliver(context.Background(), server.URL, payload)
+	if want, got := failure.Permanent, failure.Classify(err); want != got {
+		t.Errorf("class: want %v, got %v (%v)", want, got, err)
+	}
+}
+
+func TestDeliverErrorClass(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		want   failure.Class
+	}{
+		"too many requests": {status: http.StatusTooManyRequests, want: failure.Transient},
+		"server error":      {status: http.StatusBadGateway, want: failure.Transient},
+		"not found":         {status: http.StatusNotFound, want: failure.Permanent},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			err := NewClient([]byte("secret"), server.Client()).Deliver(context.Background(), server.URL, &Payload{})
+			if want, got := tc.want, failure.Classify(err); want != got {
+				t.Errorf("class: want %v, got %v (%v)", want, got, err)
+			}
+		})
+	}
+}